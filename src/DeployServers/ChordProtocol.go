@@ -1,11 +1,11 @@
 package main
 
 import (
-	"math"
+	"math/big"
 )
 
 type Node struct {
-	Id            int            `json:"id"`
+	Id            *big.Int       `json:"id"`
 	FingerTable   []*FingerEntry `json:"finger_table"`
 	successor     *Node
 	predecessor   *Node
@@ -15,14 +15,14 @@ type Node struct {
 }
 
 type FingerEntry struct {
-	Start       int `json:"start"`
+	Start       *big.Int `json:"start"`
 	successor   *Node
 	SuccessorID *NodeAddress `json:"successorID"`
 }
 
 type NodeAddress struct {
-	Id      int    `json:"id"`
-	Address string `json:"address"`
+	Id      *big.Int `json:"id"`
+	Address string   `json:"address"`
 }
 
 // FingerTable initialization for a node
@@ -39,9 +39,12 @@ type NodeAddress struct {
 //
 // Returns: None
 func _initFingerTable(n *Node, allNodes []*Node) {
+	ringSize := new(big.Int).Lsh(big.NewInt(1), uint(m))
+
 	for i := 1; i <= m; i++ {
-		start := (n.Id + int(math.Pow(2, float64(i-1)))) % int(math.Pow(2, float64(m))) // Start value for the finger entry
-		successor := findSuccessor(start, allNodes)                                     // Find the successor node for the start value
+		start := new(big.Int).Add(n.Id, new(big.Int).Lsh(big.NewInt(1), uint(i-1))) // Start value for the finger entry
+		start.Mod(start, ringSize)
+		successor := findSuccessor(start, allNodes) // Find the successor node for the start value
 
 		finger := &FingerEntry{
 			Start:     start,
@@ -55,12 +58,12 @@ func _initFingerTable(n *Node, allNodes []*Node) {
 	}
 }
 
-func get_address(id int, allNodes []*Node) string {
+func get_address(id *big.Int, allNodes []*Node) string {
 
 	// Returns the index number where the id is found in the allNodes array
 	index := -1
 	for i, node := range allNodes {
-		if node.Id == id {
+		if node.Id.Cmp(id) == 0 {
 			index = i
 			break
 		}
@@ -86,9 +89,9 @@ func get_address(id int, allNodes []*Node) string {
 //
 // Returns:
 // - The successor node for the given key.
-func findSuccessor(key int, allNodes []*Node) *Node {
+func findSuccessor(key *big.Int, allNodes []*Node) *Node {
 	for _, node := range allNodes { // Iterate through all nodes to find the successor
-		if node.Id >= key { // If the node ID is greater than or equal to the key
+		if node.Id.Cmp(key) >= 0 { // If the node ID is greater than or equal to the key
 			return node // Return the node as the successor
 		}
 	}
@@ -116,10 +119,10 @@ func initializeChordRing() []*Node {
 	allNodes := make([]*Node, amount_nodes)
 
 	// Need to spread the nodes across the identifier space evenly
-	interval := int(math.Floor(math.Pow(2, float64(m)) / float64(amount_nodes)))
+	interval := new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), uint(m)), big.NewInt(int64(amount_nodes)))
 	for i := 0; i < amount_nodes; i++ {
 		allNodes[i] = &Node{
-			Id:      i * interval,
+			Id:      new(big.Int).Mul(big.NewInt(int64(i)), interval),
 			Address: address_list[i],
 		}
 	}
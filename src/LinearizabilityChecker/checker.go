@@ -0,0 +1,274 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// register is the state of one key in the model: absent, or present with a value
+type register struct {
+	present bool
+	value   string
+}
+
+// step applies op to the register and returns the new state, or false if the outcome of op
+// is impossible in state. The storage never overwrites a key: a PUT of an existing key is refused.
+// Operations with an unknown outcome may or may not have taken effect. Not taking effect is
+// covered by linearizing them last, as their return is at the end of the history.
+func step(state register, op *Operation) (register, bool) {
+	switch op.Kind {
+	case opPut:
+		switch op.Outcome {
+		case outcomeOK:
+			return register{present: true, value: op.Value}, !state.present
+		case outcomeExists:
+			return state, state.present
+		case outcomeUnknown:
+			if !state.present {
+				return register{present: true, value: op.Value}, true
+			}
+			return state, true
+		}
+	case opGet:
+		switch op.Outcome {
+		case outcomeOK:
+			return state, state.present && state.value == op.Output
+		case outcomeNotFound:
+			return state, !state.present
+		}
+	case opDelete:
+		switch op.Outcome {
+		case outcomeOK:
+			return register{}, state.present
+		case outcomeNotFound:
+			return state, !state.present
+		case outcomeUnknown:
+			return register{}, true
+		}
+	}
+	return state, false
+}
+
+// entry is the call or the return of an operation in the doubly linked event list
+type entry struct {
+	id    int
+	op    *Operation
+	call  bool
+	time  int64
+	match *entry
+	prev  *entry
+	next  *entry
+}
+
+// lift removes the call entry and its return from the list
+func (e *entry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	match := e.match
+	match.prev.next = match.next
+	if match.next != nil {
+		match.next.prev = match.prev
+	}
+}
+
+// unlift puts the call entry and its return back where they were
+func (e *entry) unlift() {
+	match := e.match
+	match.prev.next = match
+	if match.next != nil {
+		match.next.prev = match
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) bitset   { b[i/64] |= 1 << (i % 64); return b }
+func (b bitset) clear(i int) bitset { b[i/64] &^= 1 << (i % 64); return b }
+
+func (b bitset) clone() bitset {
+	c := make(bitset, len(b))
+	copy(c, b)
+	return c
+}
+
+func (b bitset) equals(c bitset) bool {
+	for i := range b {
+		if b[i] != c[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, word := range b {
+		h ^= word
+		h *= 1099511628211
+	}
+	return h
+}
+
+// cacheEntry is a set of linearized operations together with the state they lead to
+type cacheEntry struct {
+	linearized bitset
+	state      register
+}
+
+// KeyResult is the outcome of checking the operations on one key
+type KeyResult struct {
+	Key          string `json:"key"`
+	Operations   int    `json:"operations"`
+	Linearizable bool   `json:"linearizable"`
+	TimedOut     bool   `json:"timed_out,omitempty"`
+	// For a history that is not linearizable, the operations left over by the longest
+	// linearization that was found, in the order they were invoked
+	Unplaced []*Operation `json:"unplaced,omitempty"`
+}
+
+// checkKey searches for a linearization of the operations on one key, with the algorithm of
+// Wing and Gong as improved by Lowe: operations are linearized one by one in an order that
+// respects real time, backtracking when no pending operation fits the register, and states
+// that were already explored are skipped.
+func checkKey(key string, ops []*Operation, deadline time.Time) *KeyResult {
+
+	result := &KeyResult{Key: key, Operations: len(ops)}
+
+	events := make([]*entry, 0, 2*len(ops))
+	for i, op := range ops {
+		end := op.Return
+		if op.Outcome == outcomeUnknown {
+			end = math.MaxInt64
+		}
+		call := &entry{id: i, op: op, call: true, time: op.Invoke}
+		ret := &entry{id: i, op: op, time: end}
+		call.match = ret
+		events = append(events, call, ret)
+	}
+
+	// Calls go before returns at the same time, so those operations count as concurrent
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].call && !events[j].call
+	})
+
+	head := &entry{}
+	prev := head
+	for _, e := range events {
+		e.prev = prev
+		prev.next = e
+		prev = e
+	}
+
+	type frame struct {
+		entry *entry
+		state register
+	}
+
+	var stack []frame
+	var state register
+	linearized := newBitset(len(ops))
+	best, bestCount := linearized.clone(), 0
+	cache := make(map[uint64][]cacheEntry)
+
+	// seen adds the linearized set and state to the cache and reports whether it was there already
+	seen := func(b bitset, s register) bool {
+		h := b.hash()
+		for _, cached := range cache[h] {
+			if cached.state == s && cached.linearized.equals(b) {
+				return true
+			}
+		}
+		cache[h] = append(cache[h], cacheEntry{linearized: b, state: s})
+		return false
+	}
+
+	e := head.next
+	for steps := 0; head.next != nil; steps++ {
+
+		if steps%1024 == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			result.TimedOut = true
+			return result
+		}
+
+		if e.call {
+			if next, ok := step(state, e.op); ok {
+				candidate := linearized.clone().set(e.id)
+				if !seen(candidate, next) {
+					stack = append(stack, frame{entry: e, state: state})
+					state = next
+					linearized.set(e.id)
+					e.lift()
+					if len(stack) > bestCount {
+						best, bestCount = linearized.clone(), len(stack)
+					}
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+			continue
+		}
+
+		// A return was reached while its operation is still pending, so go back one operation
+		if len(stack) == 0 {
+			for i, op := range ops {
+				if best[i/64]&(1<<(i%64)) == 0 {
+					result.Unplaced = append(result.Unplaced, op)
+				}
+			}
+			return result
+		}
+
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.entry.id)
+		top.entry.unlift()
+		e = top.entry.next
+	}
+
+	result.Linearizable = true
+	return result
+}
+
+// checkHistory checks the operations of every key on its own, which is enough for
+// linearizability since the keys are independent registers. Failed GETs are left out.
+func checkHistory(history *History, timeout time.Duration) []*KeyResult {
+
+	byKey := make(map[string][]*Operation)
+	for _, op := range history.Operations {
+		if op.Kind == opGet && op.Outcome == outcomeUnknown {
+			continue
+		}
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	results := make([]*KeyResult, 0, len(keys))
+	for _, key := range keys {
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+
+		ops := byKey[key]
+		sort.SliceStable(ops, func(i, j int) bool { return ops[i].Invoke < ops[j].Invoke })
+		results = append(results, checkKey(key, ops, deadline))
+	}
+	return results
+}
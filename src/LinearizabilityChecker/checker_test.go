@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// op returns an operation of one client on key "k" that ran from invoke to ret
+func op(kind, value, outcome string, invoke, ret int64) *Operation {
+	operation := &Operation{Kind: kind, Key: "k", Invoke: invoke, Return: ret, Outcome: outcome}
+	if kind == opGet {
+		operation.Output = value
+	} else {
+		operation.Value = value
+	}
+	return operation
+}
+
+func TestCheckKey(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		ops          []*Operation
+		linearizable bool
+		unplaced     int
+	}{
+		{"empty history", nil, true, 0},
+		{"sequential put, get and delete", []*Operation{
+			op(opPut, "a", outcomeOK, 0, 1),
+			op(opGet, "a", outcomeOK, 2, 3),
+			op(opDelete, "", outcomeOK, 4, 5),
+			op(opGet, "", outcomeNotFound, 6, 7),
+		}, true, 0},
+		{"a get concurrent with the put sees either state", []*Operation{
+			op(opPut, "a", outcomeOK, 0, 10),
+			op(opGet, "", outcomeNotFound, 1, 2),
+			op(opGet, "a", outcomeOK, 3, 4),
+		}, true, 0},
+		{"the second of two concurrent puts is refused", []*Operation{
+			op(opPut, "a", outcomeOK, 0, 10),
+			op(opPut, "b", outcomeExists, 1, 9),
+			op(opGet, "a", outcomeOK, 11, 12),
+		}, true, 0},
+		{"a put without an answer may not have taken effect", []*Operation{
+			op(opPut, "a", outcomeUnknown, 0, 1),
+			op(opGet, "", outcomeNotFound, 2, 3),
+			op(opPut, "b", outcomeOK, 4, 5),
+		}, true, 0},
+		{"a put without an answer may take effect later", []*Operation{
+			op(opPut, "a", outcomeUnknown, 0, 1),
+			op(opGet, "", outcomeNotFound, 2, 3),
+			op(opGet, "a", outcomeOK, 4, 5),
+		}, true, 0},
+		{"a get misses a put that returned", []*Operation{
+			op(opPut, "a", outcomeOK, 0, 1),
+			op(opGet, "", outcomeNotFound, 2, 3),
+		}, false, 1},
+		{"a deleted value comes back", []*Operation{
+			op(opPut, "a", outcomeOK, 0, 1),
+			op(opDelete, "", outcomeOK, 2, 3),
+			op(opGet, "a", outcomeOK, 4, 5),
+		}, false, 1},
+		{"a get reads a value that was never written", []*Operation{
+			op(opPut, "a", outcomeOK, 0, 1),
+			op(opGet, "b", outcomeOK, 2, 3),
+		}, false, 1},
+		{"two puts of an absent key both succeed", []*Operation{
+			op(opPut, "a", outcomeOK, 0, 1),
+			op(opPut, "b", outcomeOK, 2, 3),
+		}, false, 1},
+	}
+	for _, test := range tests {
+		result := checkKey("k", test.ops, time.Time{})
+		if result.Linearizable != test.linearizable {
+			t.Errorf("%s: linearizable = %v, want %v", test.name, result.Linearizable, test.linearizable)
+		}
+		if len(result.Unplaced) != test.unplaced {
+			t.Errorf("%s: %d unplaced operations, want %d", test.name, len(result.Unplaced), test.unplaced)
+		}
+		if result.TimedOut {
+			t.Errorf("%s: timed out without a deadline", test.name)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LinearizabilityChecker runs clients against /storage while it crashes nodes and makes them
+// leave and rejoin, records every operation, and checks whether the history is linearizable, e.g.
+//
+//	go run ./src/LinearizabilityChecker -duration 30s -faults crash,leave host1:8080 host2:8080 host3:8080
+//
+// With -check it only checks a history that was recorded before.
+var (
+	clients       = flag.Int("clients", 5, "number of concurrent clients")
+	keyCount      = flag.Int("keys", 5, "number of keys the clients use")
+	duration      = flag.Duration("duration", 20*time.Second, "how long the clients run")
+	pause         = flag.Duration("pause", 10*time.Millisecond, "time a client waits between two operations")
+	reads         = flag.Float64("reads", 0.5, "fraction of the operations that are GETs")
+	deletes       = flag.Float64("deletes", 0.2, "fraction of the operations that are DELETEs, the rest are PUTs")
+	faults        = flag.String("faults", "crash,leave", "comma separated faults to inject: crash, leave, or none")
+	faultInterval = flag.Duration("fault-interval", 4*time.Second, "time between the end of one fault and the start of the next")
+	faultLength   = flag.Duration("fault-duration", 3*time.Second, "how long a node stays crashed or out of the ring")
+	consistency   = flag.String("consistency", "", "consistency level sent with every storage request: one, quorum or all, the default of the nodes if empty")
+	token         = flag.String("token", os.Getenv("DHT_TOKEN"), "token sent as \"Authorization: Bearer <token>\", must be an admin token to inject faults")
+	timeout       = flag.Duration("timeout", 5*time.Second, "timeout of every request")
+	seed          = flag.Int64("seed", time.Now().UnixNano(), "seed of the operation, key, node and fault choices")
+	historyFile   = flag.String("history", "", "write the recorded history as JSON to this file")
+	checkFile     = flag.String("check", "", "check the history in this file instead of recording one")
+	checkTimeout  = flag.Duration("check-timeout", time.Minute, "give up the check of a key after this long")
+)
+
+// Exit codes
+const (
+	exitLinearizable    = 0
+	exitNotLinearizable = 1
+	exitUsage           = 2
+	exitUnknown         = 3 // The check timed out or the history could not be recorded
+)
+
+// Operation kinds
+const (
+	opPut    = "put"
+	opGet    = "get"
+	opDelete = "delete"
+)
+
+// Outcomes of an operation
+const (
+	outcomeOK       = "ok"        // PUT stored, GET found the key, DELETE removed it
+	outcomeExists   = "exists"    // PUT refused since the key is already stored
+	outcomeNotFound = "not_found" // GET or DELETE did not find the key
+	outcomeUnknown  = "unknown"   // No answer or an error, the operation may or may not have taken effect
+)
+
+// Operation is one client request. Times are in nanoseconds since the start of the run.
+type Operation struct {
+	Client  int    `json:"client"`
+	Kind    string `json:"kind"`
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Node    string `json:"node"`
+	Invoke  int64  `json:"invoke"`
+	Return  int64  `json:"return"`
+	Outcome string `json:"outcome"`
+	Output  string `json:"output,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Fault is a fault injected into one node, from Start until it was healed at End
+type Fault struct {
+	Kind  string `json:"kind"`
+	Node  string `json:"node"`
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+	Error string `json:"error,omitempty"`
+}
+
+// History is everything that happened during a run
+type History struct {
+	Started    time.Time    `json:"started"`
+	Addresses  []string     `json:"addresses"`
+	Seed       int64        `json:"seed"`
+	Operations []*Operation `json:"operations"`
+	Faults     []*Fault     `json:"faults"`
+}
+
+var client *http.Client
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: LinearizabilityChecker [options] <host:port> [host:port...]")
+		fmt.Fprintln(os.Stderr, "       LinearizabilityChecker -check <history.json>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var history *History
+	if *checkFile != "" {
+		var err error
+		history, err = readHistory(*checkFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading history:", err)
+			os.Exit(exitUsage)
+		}
+	} else {
+		faultKinds, err := checkFlags()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+
+		client = &http.Client{Timeout: *timeout}
+		history = record(flag.Args(), faultKinds)
+
+		if *historyFile != "" {
+			if err := writeHistory(*historyFile, history); err != nil {
+				fmt.Fprintln(os.Stderr, "Error writing history:", err)
+			}
+		}
+	}
+
+	os.Exit(report(history, checkHistory(history, *checkTimeout)))
+}
+
+func checkFlags() ([]string, error) {
+
+	if flag.NArg() == 0 {
+		return nil, errors.New("no node addresses given")
+	}
+	switch {
+	case *clients < 1:
+		return nil, errors.New("-clients must be at least 1")
+	case *keyCount < 1:
+		return nil, errors.New("-keys must be at least 1")
+	case *reads < 0 || *deletes < 0 || *reads+*deletes > 1:
+		return nil, errors.New("-reads and -deletes must be fractions that add up to at most 1")
+	}
+
+	var kinds []string
+	for _, kind := range strings.Split(*faults, ",") {
+		switch kind {
+		case "none", "":
+		case "crash":
+			kinds = append(kinds, kind)
+		case "leave":
+			if flag.NArg() < 2 {
+				return nil, errors.New("the leave fault needs at least two nodes, one to rejoin through")
+			}
+			kinds = append(kinds, kind)
+		default:
+			return nil, fmt.Errorf("unknown fault %q, must be crash, leave or none", kind)
+		}
+	}
+	return kinds, nil
+}
+
+// record runs the clients and the fault injection, and returns what happened
+func record(addresses []string, faultKinds []string) *History {
+
+	history := &History{Started: time.Now(), Addresses: addresses, Seed: *seed}
+	start := time.Now()
+	since := func() int64 { return int64(time.Since(start)) }
+	stop := time.Now().Add(*duration)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	fmt.Fprintf(os.Stderr, "Running %d clients on %d keys for %s, faults: %s\n", *clients, *keyCount, *duration, *faults)
+
+	for c := 0; c < *clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(*seed + int64(c) + 1))
+
+			for seq := 0; time.Now().Before(stop); seq++ {
+				op := &Operation{
+					Client: c,
+					Key:    fmt.Sprintf("lin-%d-%d", *seed, r.Intn(*keyCount)),
+					Node:   addresses[r.Intn(len(addresses))],
+				}
+				switch x := r.Float64(); {
+				case x < *reads:
+					op.Kind = opGet
+				case x < *reads+*deletes:
+					op.Kind = opDelete
+				default:
+					op.Kind = opPut
+					// Every written value is unique, so a read tells which write it saw
+					op.Value = fmt.Sprintf("c%d-%d", c, seq)
+				}
+
+				op.Invoke = since()
+				perform(op)
+				op.Return = since()
+
+				mu.Lock()
+				history.Operations = append(history.Operations, op)
+				mu.Unlock()
+
+				time.Sleep(*pause)
+			}
+		}(c)
+	}
+
+	if len(faultKinds) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			history.Faults = injectFaults(addresses, faultKinds, stop, since)
+		}()
+	}
+
+	wg.Wait()
+	return history
+}
+
+// request sends a request with the token and returns the status code and body
+func request(method, address, path string, body []byte) (int, []byte, error) {
+
+	req, err := http.NewRequest(method, "http://"+address+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// perform sends the operation to its node and records the outcome. Anything but the
+// expected answers leaves the outcome unknown, since a forwarded request may have been
+// applied by the owner of the key before the error.
+func perform(op *Operation) {
+
+	path := "/storage/" + url.PathEscape(op.Key)
+	if *consistency != "" {
+		path += "?consistency=" + url.QueryEscape(*consistency)
+	}
+	var status int
+	var body []byte
+	var err error
+
+	switch op.Kind {
+	case opPut:
+		status, body, err = request(http.MethodPut, op.Node, path, []byte(op.Value))
+	case opGet:
+		status, body, err = request(http.MethodGet, op.Node, path, nil)
+	case opDelete:
+		status, body, err = request(http.MethodDelete, op.Node, path, nil)
+	}
+
+	op.Status = status
+	op.Outcome = outcomeUnknown
+	if err != nil {
+		op.Error = err.Error()
+		return
+	}
+
+	switch {
+	case status == http.StatusOK:
+		op.Outcome = outcomeOK
+		if op.Kind == opGet {
+			op.Output = string(body)
+		}
+	case status == http.StatusForbidden && op.Kind == opPut:
+		op.Outcome = outcomeExists
+	case status == http.StatusAccepted && op.Kind == opPut:
+		// A hinted write is handed over later and may still be refused, so its outcome stays unknown
+		op.Error = "stored as hint"
+	case status == http.StatusNotFound && op.Kind != opPut:
+		op.Outcome = outcomeNotFound
+	default:
+		op.Error = strings.TrimSpace(string(body))
+	}
+}
+
+// injectFaults crashes nodes or makes them leave, one at a time, until stop. Every fault is
+// healed before the next one starts: a crashed node recovers, and a node that left joins the
+// ring again through another node.
+func injectFaults(addresses []string, kinds []string, stop time.Time, since func() int64) []*Fault {
+
+	r := rand.New(rand.NewSource(*seed))
+	var faults []*Fault
+
+	for {
+		time.Sleep(*faultInterval)
+		if time.Now().Add(*faultLength).After(stop) {
+			return faults
+		}
+
+		fault := &Fault{Kind: kinds[r.Intn(len(kinds))], Node: addresses[r.Intn(len(addresses))]}
+		nprime := fault.Node
+		for nprime == fault.Node && len(addresses) > 1 {
+			nprime = addresses[r.Intn(len(addresses))]
+		}
+
+		start, heal := "/sim-crash", "/sim-recover"
+		if fault.Kind == "leave" {
+			start, heal = "/leave", "/join?nprime="+url.QueryEscape(nprime)
+		}
+
+		fault.Start = since()
+		if err := admin(fault.Node, start); err != nil {
+			fault.Error = err.Error()
+			fault.End = since()
+			faults = append(faults, fault)
+			fmt.Fprintf(os.Stderr, "%s of %s failed: %v\n", fault.Kind, fault.Node, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%8.3fs %s %s\n", seconds(fault.Start), fault.Kind, fault.Node)
+
+		time.Sleep(*faultLength)
+
+		if err := admin(fault.Node, heal); err != nil {
+			fault.Error = err.Error()
+			fmt.Fprintf(os.Stderr, "Healing %s of %s failed: %v\n", fault.Kind, fault.Node, err)
+		}
+		fault.End = since()
+		faults = append(faults, fault)
+		fmt.Fprintf(os.Stderr, "%8.3fs healed %s\n", seconds(fault.End), fault.Node)
+	}
+}
+
+// admin sends a POST to an admin endpoint
+func admin(address, path string) error {
+	status, body, err := request(http.MethodPost, address, path, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("status %d: %s", status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func readHistory(path string) (*History, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var history History
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+	return &history, nil
+}
+
+func writeHistory(path string, history *History) error {
+	jsonData, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, jsonData, 0644)
+}
+
+func seconds(t int64) float64 {
+	return float64(t) / float64(time.Second)
+}
+
+// report prints the result of every key and the operations that could not be linearized,
+// and returns the exit code
+func report(history *History, results []*KeyResult) int {
+
+	counts := make(map[string]int)
+	for _, op := range history.Operations {
+		counts[op.Kind+" "+op.Outcome]++
+	}
+	fmt.Printf("%d operations, %d faults\n", len(history.Operations), len(history.Faults))
+	for _, kind := range []string{opPut, opGet, opDelete} {
+		fmt.Printf("  %-6s ok %d, exists %d, not found %d, unknown %d\n", kind,
+			counts[kind+" "+outcomeOK], counts[kind+" "+outcomeExists], counts[kind+" "+outcomeNotFound], counts[kind+" "+outcomeUnknown])
+	}
+	fmt.Println()
+
+	code := exitLinearizable
+	for _, result := range results {
+		switch {
+		case result.TimedOut:
+			fmt.Printf("%s: %d operations, check timed out\n", result.Key, result.Operations)
+			if code == exitLinearizable {
+				code = exitUnknown
+			}
+		case result.Linearizable:
+			fmt.Printf("%s: %d operations, linearizable\n", result.Key, result.Operations)
+		default:
+			fmt.Printf("%s: %d operations, NOT linearizable, %d could not be placed, first ones:\n",
+				result.Key, result.Operations, len(result.Unplaced))
+			for i, op := range result.Unplaced {
+				if i == 10 {
+					fmt.Printf("    ... %d more\n", len(result.Unplaced)-i)
+					break
+				}
+				fmt.Printf("    %s\n", describe(op, history.Faults))
+			}
+			code = exitNotLinearizable
+		}
+	}
+
+	fmt.Println()
+	switch code {
+	case exitLinearizable:
+		fmt.Println("History is linearizable")
+	case exitNotLinearizable:
+		fmt.Println("History is NOT linearizable")
+	default:
+		fmt.Println("Could not decide whether the history is linearizable")
+	}
+	return code
+}
+
+// describe formats an operation with its time, outcome and the faults active during it
+func describe(op *Operation, faults []*Fault) string {
+
+	end := fmt.Sprintf("%.3fs", seconds(op.Return))
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%.3fs, %s] client %d %s", seconds(op.Invoke), end, op.Client, op.Kind)
+	if op.Kind == opPut {
+		fmt.Fprintf(&b, " %q", op.Value)
+	}
+	fmt.Fprintf(&b, " via %s -> %s", op.Node, op.Outcome)
+	if op.Kind == opGet && op.Outcome == outcomeOK {
+		fmt.Fprintf(&b, " %q", op.Output)
+	}
+	if op.Error != "" {
+		fmt.Fprintf(&b, " (%s)", op.Error)
+	}
+
+	for _, fault := range faults {
+		if fault.Start <= op.Return && op.Invoke <= fault.End {
+			fmt.Fprintf(&b, ", during %s of %s", fault.Kind, fault.Node)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadGenerator sends PUT and GET requests to a set of nodes from many workers at once
+// and reports throughput and latency percentiles, e.g.
+//
+//	go run ./src/LoadGenerator -keys 1000 -reads 0.9 -c 16 -distribution zipf host1:8080 host2:8080
+var (
+	keyCount     = flag.Int("keys", 1000, "number of distinct keys")
+	valueSize    = flag.Int("value-size", 100, "size of the stored values in bytes")
+	reads        = flag.Float64("reads", 0.5, "fraction of the requests that are GETs, the rest are PUTs")
+	concurrency  = flag.Int("c", 8, "number of concurrent workers")
+	requestCount = flag.Int("requests", 10000, "number of requests to send, 0 for no limit (needs -duration)")
+	duration     = flag.Duration("duration", 0, "stop after this long, 0 for no limit")
+	distribution = flag.String("distribution", "uniform", "how keys are picked: uniform or zipf")
+	zipfS        = flag.Float64("zipf-s", 1.1, "skew of the zipf distribution, must be > 1")
+	preload      = flag.Bool("preload", true, "PUT every key once before the measurement, so GETs find their keys")
+	seed         = flag.Int64("seed", 1, "seed of the key and operation choices")
+	token        = flag.String("token", os.Getenv("DHT_TOKEN"), "API token sent as \"Authorization: Bearer <token>\"")
+	timeout      = flag.Duration("timeout", 10*time.Second, "timeout of every request")
+	consistency  = flag.String("consistency", "", "consistency level sent with every request: one, quorum or all, the default of the nodes if empty")
+	label        = flag.Int("label", 0, "value of the nodes column in the results, the number of addresses if 0")
+	format       = flag.String("o", "csv", "output format: csv or json")
+	outFile      = flag.String("out", "", "append the results to this file instead of writing them to stdout")
+)
+
+// Operation names, also used in the results
+const (
+	opPut = "put"
+	opGet = "get"
+	opAll = "all"
+)
+
+// sample is the outcome of one request
+type sample struct {
+	op      string
+	latency time.Duration
+	err     string // empty if the request succeeded
+}
+
+// Result is the summary of all requests of one operation
+type Result struct {
+	Nodes        int            `json:"nodes"`
+	Operation    string         `json:"operation"`
+	Requests     int            `json:"requests"`
+	Errors       int            `json:"errors"`
+	Seconds      float64        `json:"seconds"`
+	Throughput   float64        `json:"throughput"`
+	MeanMs       float64        `json:"mean_ms"`
+	P50Ms        float64        `json:"p50_ms"`
+	P95Ms        float64        `json:"p95_ms"`
+	P99Ms        float64        `json:"p99_ms"`
+	MaxMs        float64        `json:"max_ms"`
+	ErrorsByKind map[string]int `json:"errors_by_kind"`
+}
+
+// Report is the JSON output of a run
+type Report struct {
+	Addresses    []string  `json:"addresses"`
+	Keys         int       `json:"keys"`
+	ValueSize    int       `json:"value_size"`
+	Reads        float64   `json:"reads"`
+	Concurrency  int       `json:"concurrency"`
+	Distribution string    `json:"distribution"`
+	Started      time.Time `json:"started"`
+	Results      []*Result `json:"results"`
+}
+
+var client *http.Client
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: LoadGenerator [options] <host:port> [host:port...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	addresses := flag.Args()
+	if len(addresses) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := checkFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	nodes := *label
+	if nodes == 0 {
+		nodes = len(addresses)
+	}
+
+	client = &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			MaxIdleConns:        *concurrency * len(addresses),
+			MaxIdleConnsPerHost: *concurrency,
+		},
+	}
+
+	keys := make([]string, *keyCount)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("load-%d-%d", *seed, i)
+	}
+
+	if *preload {
+		fmt.Fprintf(os.Stderr, "Storing %d keys...\n", len(keys))
+		if failed := preloadKeys(addresses, keys); failed > 0 {
+			fmt.Fprintf(os.Stderr, "%d of %d keys could not be stored\n", failed, len(keys))
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Sending requests with %d workers to %d nodes...\n", *concurrency, len(addresses))
+	started := time.Now()
+	samples, elapsed := run(addresses, keys)
+
+	report := &Report{
+		Addresses:    addresses,
+		Keys:         *keyCount,
+		ValueSize:    *valueSize,
+		Reads:        *reads,
+		Concurrency:  *concurrency,
+		Distribution: *distribution,
+		Started:      started,
+		Results: []*Result{
+			summarize(nodes, opPut, samples, elapsed),
+			summarize(nodes, opGet, samples, elapsed),
+			summarize(nodes, opAll, samples, elapsed),
+		},
+	}
+
+	for _, result := range report.Results {
+		fmt.Fprintf(os.Stderr, "%-4s %7d requests %6d errors %9.1f req/s  p50 %7.2f ms  p95 %7.2f ms  p99 %7.2f ms\n",
+			result.Operation, result.Requests, result.Errors, result.Throughput, result.P50Ms, result.P95Ms, result.P99Ms)
+	}
+
+	if err := writeReport(report); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing results:", err)
+		os.Exit(1)
+	}
+}
+
+func checkFlags() error {
+	switch {
+	case *keyCount < 1:
+		return errors.New("-keys must be at least 1")
+	case *valueSize < 0:
+		return errors.New("-value-size must not be negative")
+	case *reads < 0 || *reads > 1:
+		return errors.New("-reads must be between 0 and 1")
+	case *concurrency < 1:
+		return errors.New("-c must be at least 1")
+	case *requestCount <= 0 && *duration <= 0:
+		return errors.New("-requests or -duration must be set")
+	case *distribution != "uniform" && *distribution != "zipf":
+		return fmt.Errorf("unknown distribution %q, must be uniform or zipf", *distribution)
+	case *distribution == "zipf" && *zipfS <= 1:
+		return errors.New("-zipf-s must be greater than 1")
+	case *format != "csv" && *format != "json":
+		return fmt.Errorf("unknown output format %q, must be csv or json", *format)
+	}
+	return nil
+}
+
+// keyPicker returns a function that picks key indices with the configured distribution.
+// The zipf distribution makes key 0 the most popular one.
+func keyPicker(r *rand.Rand) func() int {
+	if *distribution == "zipf" {
+		zipf := rand.NewZipf(r, *zipfS, 1, uint64(*keyCount-1))
+		return func() int { return int(zipf.Uint64()) }
+	}
+	return func() int { return r.Intn(*keyCount) }
+}
+
+// preloadKeys stores every key once, spread over the nodes. Returns how many PUTs failed.
+func preloadKeys(addresses []string, keys []string) int {
+
+	var next, failed int64
+	var wg sync.WaitGroup
+
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			value := newValue(rand.New(rand.NewSource(*seed - int64(w) - 1)))
+			for {
+				i := int(atomic.AddInt64(&next, 1) - 1)
+				if i >= len(keys) {
+					return
+				}
+				if s := send(opPut, addresses[i%len(addresses)], keys[i], value); s.err != "" {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	return int(failed)
+}
+
+func newValue(r *rand.Rand) []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	value := make([]byte, *valueSize)
+	for i := range value {
+		value[i] = letters[r.Intn(len(letters))]
+	}
+	return value
+}
+
+// run sends requests from all workers until the request count or the duration is reached.
+// Every worker picks its node, key and operation at random from its own seeded source.
+func run(addresses []string, keys []string) ([]sample, time.Duration) {
+
+	var sent int64
+	var wg sync.WaitGroup
+	results := make([][]sample, *concurrency)
+
+	var deadline time.Time
+	if *duration > 0 {
+		deadline = time.Now().Add(*duration)
+	}
+
+	start := time.Now()
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			r := rand.New(rand.NewSource(*seed + int64(w)))
+			pick := keyPicker(r)
+			value := newValue(r)
+
+			for {
+				if *requestCount > 0 && atomic.AddInt64(&sent, 1) > int64(*requestCount) {
+					return
+				}
+				if !deadline.IsZero() && time.Now().After(deadline) {
+					return
+				}
+
+				op := opPut
+				if r.Float64() < *reads {
+					op = opGet
+				}
+				address := addresses[r.Intn(len(addresses))]
+				results[w] = append(results[w], send(op, address, keys[pick()], value))
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var samples []sample
+	for _, worker := range results {
+		samples = append(samples, worker...)
+	}
+	return samples, elapsed
+}
+
+// send does one request and classifies its outcome
+func send(op, address, key string, value []byte) sample {
+
+	method, body := http.MethodGet, io.Reader(nil)
+	if op == opPut {
+		method, body = http.MethodPut, bytes.NewReader(value)
+	}
+
+	path := "/storage/" + url.PathEscape(key)
+	if *consistency != "" {
+		path += "?consistency=" + url.QueryEscape(*consistency)
+	}
+
+	req, err := http.NewRequest(method, "http://"+address+path, body)
+	if err != nil {
+		return sample{op: op, err: "request"}
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return sample{op: op, latency: time.Since(start), err: errorKind(err)}
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+
+	switch {
+	case err != nil:
+		return sample{op: op, latency: latency, err: errorKind(err)}
+	case resp.StatusCode == http.StatusOK:
+		return sample{op: op, latency: latency}
+	case resp.StatusCode == http.StatusMultipleChoices && op == opGet:
+		// Siblings of concurrent writes, with -conflict-mode vclock on the nodes
+		return sample{op: op, latency: latency}
+	case resp.StatusCode == http.StatusAccepted && op == opPut:
+		// Stored as a hint for an owner that is down
+		return sample{op: op, latency: latency}
+	case resp.StatusCode == http.StatusNotFound:
+		return sample{op: op, latency: latency, err: "not_found"}
+	case resp.StatusCode == http.StatusForbidden && op == opPut:
+		// The storage does not overwrite keys, an existing key is no failure of the node
+		return sample{op: op, latency: latency}
+	}
+	return sample{op: op, latency: latency, err: "status_" + strconv.Itoa(resp.StatusCode)}
+}
+
+// errorKind names a transport error for the error breakdown
+func errorKind(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return "connection_refused"
+	}
+	return "connection"
+}
+
+// summarize computes the result of operation op, or of all operations for opAll
+func summarize(nodes int, op string, samples []sample, elapsed time.Duration) *Result {
+
+	result := &Result{
+		Nodes:        nodes,
+		Operation:    op,
+		Seconds:      elapsed.Seconds(),
+		ErrorsByKind: map[string]int{},
+	}
+
+	var latencies []float64
+	var total float64
+	for _, s := range samples {
+		if op != opAll && s.op != op {
+			continue
+		}
+		result.Requests++
+		if s.err != "" {
+			result.Errors++
+			result.ErrorsByKind[s.err]++
+			continue
+		}
+		ms := float64(s.latency) / float64(time.Millisecond)
+		latencies = append(latencies, ms)
+		total += ms
+	}
+
+	if result.Seconds > 0 {
+		result.Throughput = round(float64(result.Requests-result.Errors) / result.Seconds)
+	}
+
+	if len(latencies) > 0 {
+		sort.Float64s(latencies)
+		result.MeanMs = round(total / float64(len(latencies)))
+		result.P50Ms = percentile(latencies, 50)
+		result.P95Ms = percentile(latencies, 95)
+		result.P99Ms = percentile(latencies, 99)
+		result.MaxMs = round(latencies[len(latencies)-1])
+	}
+	result.Seconds = round(result.Seconds)
+
+	return result
+}
+
+// percentile returns the nearest-rank percentile p of the sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return round(sorted[rank-1])
+}
+
+func round(value float64) float64 {
+	return math.Round(value*1000) / 1000
+}
+
+// csvHeader are the columns of the CSV output, one row per operation
+var csvHeader = []string{"nodes", "operation", "requests", "errors", "seconds", "throughput",
+	"mean_ms", "p50_ms", "p95_ms", "p99_ms", "max_ms", "errors_by_kind"}
+
+// writeReport writes the report to stdout, or appends it to -out. The CSV header is only
+// written to empty files, so the results of several runs can be collected in one file.
+func writeReport(report *Report) error {
+
+	var w io.Writer = os.Stdout
+	header := true
+
+	if *outFile != "" {
+		file, err := os.OpenFile(*outFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		header = info.Size() == 0
+		w = file
+	}
+
+	if *format == "json" {
+		jsonData, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		// One report per line, so appended runs stay readable
+		_, err = fmt.Fprintln(w, string(jsonData))
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	if header {
+		writer.Write(csvHeader)
+	}
+	for _, result := range report.Results {
+		writer.Write([]string{
+			strconv.Itoa(result.Nodes),
+			result.Operation,
+			strconv.Itoa(result.Requests),
+			strconv.Itoa(result.Errors),
+			formatFloat(result.Seconds),
+			formatFloat(result.Throughput),
+			formatFloat(result.MeanMs),
+			formatFloat(result.P50Ms),
+			formatFloat(result.P95Ms),
+			formatFloat(result.P99Ms),
+			formatFloat(result.MaxMs),
+			formatErrors(result.ErrorsByKind),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// formatErrors writes the error breakdown as kind=count pairs separated by semicolons
+func formatErrors(errorsByKind map[string]int) string {
+	kinds := make([]string, 0, len(errorsByKind))
+	for kind := range errorsByKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	pairs := make([]string, len(kinds))
+	for i, kind := range kinds {
+		pairs[i] = fmt.Sprintf("%s=%d", kind, errorsByKind[kind])
+	}
+	return strings.Join(pairs, ";")
+}
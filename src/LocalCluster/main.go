@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// LocalCluster starts a Chord ring on this machine, without ssh or a list of cluster nodes.
+// Everything after -- is passed on to every node, e.g.
+//
+//	go run ./src/LocalCluster -n 5 -bits 16 -- -vnodes 2
+var (
+	count      = flag.Int("n", 3, "number of nodes to start")
+	bits       = flag.Int("bits", 16, "identifier space of the ring in bits")
+	host       = flag.String("host", "127.0.0.1", "host the nodes listen on and advertise")
+	serverPath = flag.String("server", "", "node binary to run, built from the source tree if empty")
+	token      = flag.String("token", os.Getenv("DHT_TOKEN"), "admin token used for /join, if the nodes are started with -admin-tokens")
+	logDir     = flag.String("logs", "", "directory for the node logs, a new temporary directory if empty")
+	waitFor    = flag.Duration("wait", time.Minute, "how long to wait for the ring to converge")
+)
+
+// node is a running node process
+type node struct {
+	address string
+	cmd     *exec.Cmd
+	exited  chan struct{}
+}
+
+func main() {
+
+	flag.Parse()
+	nodeArgs := flag.Args()
+
+	if *count < 1 {
+		fmt.Println("Number of nodes must be at least 1")
+		os.Exit(2)
+	}
+
+	if *logDir == "" {
+		dir, err := os.MkdirTemp("", "chord-cluster-")
+		if err != nil {
+			fmt.Println("Error creating log directory:", err)
+			os.Exit(1)
+		}
+		*logDir = dir
+	}
+
+	binary := *serverPath
+	if binary == "" {
+		var err error
+		binary, err = buildServer(*logDir)
+		if err != nil {
+			fmt.Println("Error building the node binary:", err)
+			os.Exit(1)
+		}
+	}
+
+	addresses, err := freeAddresses(*host, *count)
+	if err != nil {
+		fmt.Println("Error finding free ports:", err)
+		os.Exit(1)
+	}
+
+	// Stop on Ctrl-C from here on, also while the ring is still being set up
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	var nodes []*node
+	for _, address := range addresses {
+		n, err := startNode(binary, address, nodeArgs)
+		if err != nil {
+			fmt.Printf("Error starting node %s: %v\n", address, err)
+			stopAll(nodes)
+			os.Exit(1)
+		}
+		nodes = append(nodes, n)
+	}
+
+	fmt.Printf("Started %d nodes, logs in %s\n", len(nodes), *logDir)
+
+	setup := make(chan error, 1)
+	go func() { setup <- buildRing(nodes) }()
+
+	select {
+	case err := <-setup:
+		if err != nil {
+			fmt.Println("Error setting up the ring:", err)
+			stopAll(nodes)
+			os.Exit(1)
+		}
+	case <-interrupt:
+		stopAll(nodes)
+		os.Exit(1)
+	}
+
+	fmt.Println("Ring converged, nodes:")
+	for _, n := range nodes {
+		fmt.Println(n.address)
+	}
+	fmt.Println("Press Ctrl-C to stop the cluster")
+
+	// Run until interrupted, or until a node goes away on its own
+	exited := make(chan *node, len(nodes))
+	for _, n := range nodes {
+		go func(n *node) {
+			<-n.exited
+			exited <- n
+		}(n)
+	}
+
+	select {
+	case <-interrupt:
+	case n := <-exited:
+		fmt.Printf("Node %s exited, see %s\n", n.address, logFile(n.address))
+	}
+
+	stopAll(nodes)
+}
+
+// buildServer compiles the node into dir and returns the path of the binary
+func buildServer(dir string) (string, error) {
+
+	binary := filepath.Join(dir, "chord")
+	fmt.Println("Building the node binary...")
+
+	cmd := exec.Command("go", "build", "-o", binary, "INF-3200/src")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return binary, cmd.Run()
+}
+
+// freeAddresses returns count addresses on host with ports nothing is listening on.
+// All listeners stay open until the last port is picked, so no port is returned twice.
+func freeAddresses(host string, count int) ([]string, error) {
+
+	var listeners []net.Listener
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	addresses := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+
+		port := listener.Addr().(*net.TCPAddr).Port
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return addresses, nil
+}
+
+func logFile(address string) string {
+	return filepath.Join(*logDir, "node-"+address+".log")
+}
+
+// startNode runs a new node at address, as a ring of its own
+func startNode(binary, address string, nodeArgs []string) (*node, error) {
+
+	log, err := os.Create(logFile(address))
+	if err != nil {
+		return nil, err
+	}
+
+	// The nodes are stopped with the cluster, not after the default lifetime
+	args := append([]string{"-lifetime", "0"}, nodeArgs...)
+	args = append(args, "0", "true", address, strconv.Itoa(*bits))
+
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	if err := cmd.Start(); err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	n := &node{address: address, cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		log.Close()
+		close(n.exited)
+	}()
+	return n, nil
+}
+
+// stopAll interrupts every node and kills those that have not exited after a few seconds
+func stopAll(nodes []*node) {
+
+	fmt.Println("Stopping the cluster...")
+
+	for _, n := range nodes {
+		n.cmd.Process.Signal(os.Interrupt)
+	}
+
+	deadline := time.After(10 * time.Second)
+	for _, n := range nodes {
+		select {
+		case <-n.exited:
+		case <-deadline:
+			n.cmd.Process.Kill()
+			<-n.exited
+		}
+	}
+}
+
+// buildRing waits for all nodes to answer, joins them to the first one and waits for the ring to converge
+func buildRing(nodes []*node) error {
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for _, n := range nodes {
+		if err := waitUntilUp(client, n); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range nodes[1:] {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+n.address+"/join?nprime="+url.QueryEscape(nodes[0].address), nil)
+		if *token != "" {
+			req.Header.Set("Authorization", "Bearer "+*token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("could not join %s: %v", n.address, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("could not join %s: status %d, see %s", n.address, resp.StatusCode, logFile(n.address))
+		}
+	}
+
+	return waitForConvergence(client, nodes)
+}
+
+// waitUntilUp polls /helloworld until the node answers
+func waitUntilUp(client *http.Client, n *node) error {
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-n.exited:
+			return fmt.Errorf("node %s exited during startup, see %s", n.address, logFile(n.address))
+		default:
+		}
+
+		resp, err := client.Get("http://" + n.address + "/helloworld")
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("node %s did not start, see %s", n.address, logFile(n.address))
+}
+
+// waitForConvergence asks the ring walker of the first node until it reports a consistent ring that contains every node
+func waitForConvergence(client *http.Client, nodes []*node) error {
+
+	var report struct {
+		Members []struct {
+			Address string `json:"address"`
+		} `json:"members"`
+		Consistent bool `json:"consistent"`
+		Problems   []struct {
+			Message string `json:"message"`
+		} `json:"problems"`
+	}
+
+	deadline := time.Now().Add(*waitFor)
+	lastProblems := -1
+
+	for time.Now().Before(deadline) {
+
+		resp, err := client.Get("http://" + nodes[0].address + "/ring")
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&report)
+			resp.Body.Close()
+		}
+
+		if err == nil {
+			servers := make(map[string]bool)
+			for _, member := range report.Members {
+				servers[member.Address] = true
+			}
+			if report.Consistent && len(servers) == len(nodes) {
+				return nil
+			}
+			if len(report.Problems) != lastProblems {
+				lastProblems = len(report.Problems)
+				fmt.Printf("Waiting for the ring to converge: %d of %d nodes in the ring, %d problems\n", len(servers), len(nodes), lastProblems)
+			}
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	message := fmt.Sprintf("ring did not converge within %s", *waitFor)
+	if len(report.Problems) > 0 {
+		message += ", first problem: " + report.Problems[0].Message
+	}
+	return errors.New(message)
+}
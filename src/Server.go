@@ -2,125 +2,187 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/binary"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"math"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
-func InitServer(node *Node) {
+func InitServer(nodes []*Node) {
 
-	addressParts := strings.Split(node.Address, ":")
+	s := newServer(nodes, nil)
 
-	keyIdentifierSpace = len(node.FingerTable)
-
-	// Create a new server instance
-	serverInstance = &Server{
-		hostname: addressParts[0],
-		port:     addressParts[1],
-		node:     node,
-		storage:  make(map[string]string),
-		crashed:  false,
+	s.server = &http.Server{
+		Addr:    ":" + s.port,
+		Handler: s.handler,
 	}
 
-	serverInstance.server = &http.Server{
-		Addr:    ":" + serverInstance.port,
-		Handler: initMux(),
+	for _, node := range s.nodes {
+		fmt.Printf("\nServer initialized at: %s and node ID %s\n", s.hostname+":"+s.port, node.Id)
 	}
 
-	fmt.Printf("\nServer initialized at: %s and node ID %d\n", serverInstance.hostname+":"+serverInstance.port, serverInstance.node.Id)
-
 	// Channel to listen for shutdown signal (interrupts or timer)
 	shutdownChan := make(chan os.Signal, 1)
 	signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
 
 	// Start the server
-	go startServer()
+	go s.startServer()
 
 	// Start the server shutdown timer
 	go startServerShutdownTimer(shutdownChan)
 
-	// Start the periodic finger table update
-	go periodicUpdateFingerTable()
+	// Start the periodic stabilization, finger table update, anti-entropy between replicas and hint delivery
+	for _, task := range s.maintenanceTasks() {
+		go task.loop.run(task.round)
+	}
 
 	// Wait for the shutdown signal
 	<-shutdownChan
 
 	// Shutdown the server
-	shutdownServer()
+	s.shutdownServer()
 
 	fmt.Println("Server exiting")
 }
 
-func hash(input string) int {
+// newServer creates a server hosting the given virtual nodes, without starting it.
+// Requests to other nodes go through transport, or over the network if it is nil.
+func newServer(nodes []*Node, transport http.RoundTripper) *Server {
 
-	// Hash the input using SHA-256
-	hash := sha256.Sum256([]byte(input))
+	addressParts := strings.Split(nodes[0].Address, ":")
 
-	// Convert the first 8 bytes of the hash to a uint64
-	hashedValue := binary.BigEndian.Uint64(hash[:8])
+	keyIdentifierSpace = len(nodes[0].FingerTable)
 
-	// Apply modulo 2^n to restrict the result between 0 and 2^n - 1
-	return int(hashedValue % uint64(1<<keyIdentifierSpace))
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	// Create a new server instance
+	s := &Server{
+		hostname:  addressParts[0],
+		port:      addressParts[1],
+		nodes:     nodes,
+		storage:   newStorage(),
+		transport: transport,
+		log:       os.Stdout,
+		clock:     time.Now,
+
+		stabilizeLoop: newMaintenanceLoop(*stabilizeInterval, *maxStabilizeInterval),
+		fingerLoop:    newMaintenanceLoop(*fixFingersInterval, *maxFixFingersInterval),
+		antiEntropy:   &antiEntropy{loop: newMaintenanceLoop(*antiEntropyInterval, *maxAntiEntropyInterval)},
+		hints:         &hintStore{loop: newMaintenanceLoop(*hintInterval, *hintInterval)},
+		expiryLoop:    newMaintenanceLoop(*expiryInterval, *expiryInterval),
+		chunkGCLoop:   newMaintenanceLoop(*chunkGCInterval, *chunkGCInterval),
+		chunkUses:     &chunkUses{last: make(map[string]time.Time)},
+		watches:       &watchHub{watchers: make(map[*watcher]bool)},
+		relays:        &relayHub{groups: make(map[watchTarget]*relayGroup)},
+	}
+	s.storage.changed = s.keyChanged
+	s.storage.clock = func() time.Time { return s.clock() }
+
+	// Keep the virtual nodes sorted so they can be linked into a ring
+	sort.Slice(s.nodes, func(i, j int) bool {
+		return s.nodes[i].Id.Cmp(s.nodes[j].Id) < 0
+	})
+
+	// Virtual nodes of a new server start out as a ring of their own
+	if len(s.nodes) > 1 {
+		s.linkVirtualNodes()
+	}
+
+	s.handler = s.initMux()
+	return s
 }
 
-func initMux() *http.ServeMux {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/helloworld", helloworldHandler)
-	mux.HandleFunc("/storage/", storageHandler)
-	mux.HandleFunc("/network", networkHandler)
-	mux.HandleFunc("/node-info", nodeInfoHandler)
-	mux.HandleFunc("/leave", leaveHandler)
-	mux.HandleFunc("/sim-crash", simulateCrashHandler)
-	mux.HandleFunc("/sim-recover", simulateRecoverHandler)
-	mux.HandleFunc("/join", joinRingHandler)
-	mux.HandleFunc("/update-successor", updateSuccessorHandler)
-	mux.HandleFunc("/update-predecessor", updatePredecessorHandler)
+func hash(input string) ID {
 
-	return mux
+	// Hash the input using the configured hash function
+	hash := keyHash.Sum([]byte(input))
+
+	// Apply modulo 2^n to the whole hash to restrict the result between 0 and 2^n - 1
+	return idFromBytes(hash)
+}
+
+func (s *Server) initMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/helloworld", s.helloworldHandler)
+	mux.HandleFunc("/storage/", s.requireScope(scopeStorage, s.storageHandler))
+	mux.HandleFunc("/network", s.networkHandler)
+	mux.HandleFunc("/ring", s.ringHandler)
+	mux.HandleFunc("/node-info", s.nodeInfoHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/leave", s.requireScope(scopeAdmin, s.leaveHandler))
+	mux.HandleFunc("/sim-crash", s.requireScope(scopeAdmin, s.simulateCrashHandler))
+	mux.HandleFunc("/sim-recover", s.requireScope(scopeAdmin, s.simulateRecoverHandler))
+	mux.HandleFunc("/join", s.requireScope(scopeAdmin, s.joinRingHandler))
+	mux.HandleFunc("/update-successor", s.requireScope(scopePeer, s.updateSuccessorHandler))
+	mux.HandleFunc("/update-predecessor", s.requireScope(scopePeer, s.updatePredecessorHandler))
+	mux.HandleFunc("/replica/", s.requireScope(scopePeer, s.replicaHandler))
+	mux.HandleFunc("/chunk/", s.requireScope(scopePeer, s.chunkHandler))
+	mux.HandleFunc("/chunk-refs", s.requireScope(scopePeer, s.chunkRefsHandler))
+	mux.HandleFunc("/merkle", s.requireScope(scopePeer, s.merkleHandler))
+	mux.HandleFunc("/merkle/records", s.requireScope(scopePeer, s.merkleRecordsHandler))
+	mux.HandleFunc("/anti-entropy", s.antiEntropyHandler)
+	mux.HandleFunc("/anti-entropy/sync", s.requireScope(scopeAdmin, s.antiEntropySyncHandler))
+	mux.HandleFunc("/hints", s.requireScope(scopeAdmin, s.hintsHandler))
+	mux.HandleFunc("/keys", s.requireScope(scopeStorage, s.keysHandler))
+	mux.HandleFunc("/scan", s.requireScope(scopeStorage, s.scanHandler))
+	mux.HandleFunc("/scan/local", s.requireScope(scopePeer, s.scanLocalHandler))
+	mux.HandleFunc("/watch", s.requireScope(scopeStorage, s.watchHandler))
+	mux.HandleFunc("/watch/", s.requireScope(scopeStorage, s.watchHandler))
+
+	return s.checkRingParameters(mux)
 }
 
-func shutdownServer() {
+func (s *Server) shutdownServer() {
+	for _, task := range s.maintenanceTasks() {
+		task.loop.stop()
+	}
+
 	// Shutdown the server
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := serverInstance.server.Shutdown(ctx); err != nil {
+	if err := s.server.Shutdown(ctx); err != nil {
 		fmt.Println("Server forced to shutdown:", err)
 	}
 }
 
-func startServer() {
+func (s *Server) startServer() {
 	// Start the server in a separate goroutine
-	err := serverInstance.server.ListenAndServe()
+	err := s.server.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
-		fmt.Printf("Could not listen on %s: %v\n", serverInstance.port, err)
+		fmt.Printf("Could not listen on %s: %v\n", s.port, err)
 	}
 }
 
 func startServerShutdownTimer(shutdownChan chan os.Signal) {
-	// Timer to shut down the server after 10 minutes
-	time.Sleep(10 * time.Minute)
-	fmt.Println("Shutting down the server after 10 minutes...")
+	// Timer to shut down the server after -lifetime, 10 minutes by default
+	if *lifetime <= 0 {
+		return
+	}
+	time.Sleep(*lifetime)
+	fmt.Printf("Shutting down the server after %s...\n", *lifetime)
 	shutdownChan <- os.Interrupt
 }
 
-func (s *Server) findSuccessor(key int) *NodeAddress {
+func (n *Node) findSuccessor(key ID) *NodeAddress {
 
 	// First, check if the key falls between the current node and its immediate successor (me, successor]
-	if isBetweenInclusive(s.node.Id, key, s.node.SuccessorID.Id) {
-		return s.node.SuccessorID
+	successor := n.successor()
+	if isBetweenInclusive(n.Id, key, successor.Id) {
+		return successor
 	}
 
 	// Otherwise, look in the finger table for the closest predecessor
-	closestPredecessor := s.findClosestPredecessor(key)
+	closestPredecessor := n.findClosestPredecessor(key)
 
 	// Recursively call findSuccessor on the closest predecessor if it's not nil
 	if closestPredecessor != nil {
@@ -128,48 +190,197 @@ func (s *Server) findSuccessor(key int) *NodeAddress {
 	}
 
 	// If no closer predecessor is found, return the successor as fallback
-	return s.node.SuccessorID
+	return successor
 }
 
-func (s *Server) findClosestPredecessor(key int) *NodeAddress {
+func (n *Node) findClosestPredecessor(key ID) *NodeAddress {
+
+	fingers := n.fingers()
 
 	is_nil := false
-	for _, finger := range s.node.FingerTable {
+	for _, finger := range fingers {
 		if finger.SuccessorID == nil {
 			is_nil = true
 		}
 	}
 
 	if is_nil {
-		return s.node.SuccessorID
+		return n.successor()
 	}
 
 	// Iterate through the finger table in reverse order
-	for i := len(s.node.FingerTable) - 1; i >= 0; i-- {
-		finger := s.node.FingerTable[i]
+	for i := len(fingers) - 1; i >= 0; i-- {
+		finger := fingers[i]
 
 		// Check if the finger points to a node that is a valid predecessor of the key
 		// and that the finger node is closer to the key than the current node
-		if isBetween(s.node.Id, finger.SuccessorID.Id, key) {
+		if isBetween(n.Id, finger.SuccessorID.Id, key) {
 			return finger.SuccessorID
 		}
 	}
 
-	// Return myself
-	return s.node.SuccessorID
+	// No finger lies between this node and the key, so the successor is the closest node known
+	return n.successor()
+}
 
-	// return s.node.FingerTable[len(s.node.FingerTable)-1].SuccessorID
+// address returns the address of the node, as used by other nodes to reach it
+func (n *Node) address() *NodeAddress {
+	return &NodeAddress{Id: n.Id, Address: n.Address}
 }
 
-func get_response(url string) *http.Response {
-	client := &http.Client{Timeout: 10 * time.Second}
+// reset removes the node from the ring, leaving it as its own successor
+func (n *Node) reset() {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.PredecessorID = nil
+	n.SuccessorID = n.address()
+	n.Successors = nil
+
+	// Reset the finger table
+	for i := range n.FingerTable {
+		n.FingerTable[i] = &FingerEntry{Start: n.Id.addPowerOfTwo(i), SuccessorID: n.address()}
+	}
+}
+
+// owns reports whether key falls in the range (predecessor, node] of the node
+func (n *Node) owns(key ID) bool {
+
+	// A node without a predecessor is alone and owns every key
+	predecessor := n.predecessor()
+	if predecessor == nil {
+		return true
+	}
+
+	return isBetweenInclusive(predecessor.Id, key, n.Id)
+}
+
+// vnode returns the virtual node a request is addressed to, using the "vnode" query parameter.
+// Requests without the parameter go to the first virtual node. Returns nil for an unknown ID.
+func (s *Server) vnode(r *http.Request) *Node {
+
+	vnodeID := r.URL.Query().Get("vnode")
+	if vnodeID == "" {
+		return s.nodes[0]
+	}
+
+	id, err := parseID(vnodeID)
+	if err != nil {
+		return nil
+	}
+
+	for _, node := range s.nodes {
+		if node.Id.Equal(id) {
+			return node
+		}
+	}
+	return nil
+}
+
+// ownerOf returns the virtual node on this server responsible for key, or nil if it is stored elsewhere
+func (s *Server) ownerOf(key ID) *Node {
+
+	// Nodes that know their predecessor are checked first, since a node without one claims everything
+	for _, node := range s.nodes {
+		if node.predecessor() != nil && node.owns(key) {
+			return node
+		}
+	}
+
+	for _, node := range s.nodes {
+		if node.predecessor() == nil {
+			return node
+		}
+	}
+	return nil
+}
+
+// closestNode returns the virtual node on this server that most closely precedes key,
+// which is the best place to start a lookup from
+func (s *Server) closestNode(key ID) *Node {
+
+	closest := s.nodes[len(s.nodes)-1]
+	for _, node := range s.nodes {
+		if node.Id.Cmp(key) < 0 {
+			closest = node
+		}
+	}
+	return closest
+}
+
+// linkVirtualNodes resets the ring to contain only this server's virtual nodes
+func (s *Server) linkVirtualNodes() {
+
+	// A single node is alone in the ring and has no predecessor
+	if len(s.nodes) == 1 {
+		s.nodes[0].reset()
+		return
+	}
+
+	for i, node := range s.nodes {
+		node.setSuccessor(s.nodes[(i+1)%len(s.nodes)].address())
+		node.setPredecessor(s.nodes[(i-1+len(s.nodes))%len(s.nodes)].address())
+
+		for i := range node.FingerTable {
+			node.setFinger(i, s.localSuccessor(node.Id.addPowerOfTwo(i)))
+		}
+	}
+}
+
+// localSuccessor returns the first of this server's virtual nodes at or after key
+func (s *Server) localSuccessor(key ID) *NodeAddress {
+	for _, node := range s.nodes {
+		if node.Id.Cmp(key) >= 0 {
+			return node.address()
+		}
+	}
+	return s.nodes[0].address()
+}
+
+// sameNode reports whether two node addresses point to the same node, treating nil as no node
+func sameNode(a, b *NodeAddress) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Id == b.Id && a.Address == b.Address
+}
+
+// nodeURL returns the URL of an endpoint on the virtual node at address.
+// The endpoint may contain a query, e.g. "node-info?successor=5".
+func nodeURL(address *NodeAddress, endpoint string) string {
+	separator := "?"
+	if strings.Contains(endpoint, "?") {
+		separator = "&"
+	}
+	return fmt.Sprintf("http://%s/%s%svnode=%s", address.Address, endpoint, separator, address.Id)
+}
+
+// nodeAddressFrom extracts the ID and address of a node from a decoded /node-info response
+func nodeAddressFrom(data map[string]interface{}) *NodeAddress {
+	id, _ := parseID(fmt.Sprint(data["id"]))
+	return &NodeAddress{
+		Id:      id,
+		Address: data["address"].(string),
+	}
+}
+
+// decodeJSON decodes a JSON response into data, keeping numbers exact so large IDs survive
+func decodeJSON(body io.Reader, data interface{}) error {
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	return decoder.Decode(data)
+}
+
+func (s *Server) get_response(url string) *http.Response {
+	client := s.newClient(10 * time.Second)
 	request, _ := http.NewRequest(http.MethodGet, url, nil)
 	resp, _ := client.Do(request)
 	return resp
 }
 
-func put_request(url string, jsonData []byte) *http.Response {
-	client := &http.Client{Timeout: 5 * time.Second}
+func (s *Server) put_request(url string, jsonData []byte) *http.Response {
+	client := s.newClient(5 * time.Second)
 	req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(string(jsonData)))
 
 	req.Header.Set("Content-Type", "application/json")
@@ -178,70 +389,144 @@ func put_request(url string, jsonData []byte) *http.Response {
 }
 
 // Additional functions
-func updateSuccessor(address_from NodeAddress, address_to *NodeAddress) {
-	request := fmt.Sprintf("http://%s/update-successor", address_from.Address)
+func (s *Server) updateSuccessor(address_from NodeAddress, address_to *NodeAddress) {
+	request := nodeURL(&address_from, "update-successor")
 	jsonData, _ := json.Marshal(address_to)
-	put_request(request, jsonData)
+	s.deliver(func() { s.put_request(request, jsonData) })
 }
 
-func updatePredecessor(address_from NodeAddress, address_to *NodeAddress) {
-	request := fmt.Sprintf("http://%s/update-predecessor", address_from.Address)
+func (s *Server) updatePredecessor(address_from NodeAddress, address_to *NodeAddress) {
+	request := nodeURL(&address_from, "update-predecessor")
 	jsonData, _ := json.Marshal(address_to)
-	put_request(request, jsonData)
+	s.deliver(func() { s.put_request(request, jsonData) })
 }
 
-func getNode(address string) map[string]interface{} {
+// deliver sends a one-way message to another node, through the send hook if one is set
+func (s *Server) deliver(message func()) {
+	if s.send == nil {
+		message()
+		return
+	}
+	s.send(message)
+}
 
-	fmt.Printf("Fetchin info from %s\n", address)
+func (s *Server) getNode(address *NodeAddress) map[string]interface{} {
 
-	request := fmt.Sprintf("http://%s/node-info", address)
-	resp := get_response(request)
+	fmt.Fprintf(s.log, "Fetchin info from %s\n", address.Address)
+
+	request := nodeURL(address, "node-info")
+	resp := s.get_response(request)
 
 	var data map[string]interface{}
-	decoder := json.NewDecoder(resp.Body)
-	decoder.Decode(&data)
+	decodeJSON(resp.Body, &data)
 
 	return data
 }
 
 func createNewNode() {
 
-	// Creates a new id by hashing a random number
-	id := hash(strconv.Itoa(int(time.Now().UnixNano())))
+	nodes, err := newNodes(flag.Arg(2), *vnodeCount)
+	if err != nil {
+		fmt.Println("Error choosing node IDs:", err)
+		return
+	}
 
-	address := os.Args[3]
-	fingerTable := make([]*FingerEntry, keyIdentifierSpace)
+	InitServer(nodes)
+}
 
-	for i := 0; i < keyIdentifierSpace; i++ {
-		fingerTable[i] = &FingerEntry{
-			Start:       int(math.Pow(2, float64(i))),
-			SuccessorID: &NodeAddress{Id: id, Address: address},
-		}
-	}
+// newNodes creates count virtual nodes at address, each alone in its own ring
+func newNodes(address string, count int) ([]*Node, error) {
+
+	nodes := make([]*Node, count)
 
-	newNode := &Node{
-		Id:            id,
-		FingerTable:   fingerTable,
-		SuccessorID:   &NodeAddress{Id: id, Address: address},
-		PredecessorID: nil,
-		Address:       address,
+	ids, err := nodeIDs(address, count)
+	if err != nil {
+		return nil, err
 	}
 
-	InitServer(newNode)
-}
+	for v, id := range ids {
+
+		fingerTable := make([]*FingerEntry, keyIdentifierSpace)
 
-// Helper function to check if 'key' is in the interval (n1, n2] with wraparound handling
-func isBetweenInclusive(n1, key, n2 int) bool {
-	if n1 < n2 {
-		return n1 < key && key <= n2
+		for i := 0; i < keyIdentifierSpace; i++ {
+			fingerTable[i] = &FingerEntry{
+				Start:       id.addPowerOfTwo(i),
+				SuccessorID: &NodeAddress{Id: id, Address: address},
+			}
+		}
+
+		nodes[v] = &Node{
+			Id:            id,
+			FingerTable:   fingerTable,
+			SuccessorID:   &NodeAddress{Id: id, Address: address},
+			PredecessorID: nil,
+			Address:       address,
+		}
 	}
-	return n1 < key || key <= n2
+
+	return nodes, nil
 }
 
-// Helper function to check if 'key' is in the interval (n1, n2) with wraparound handling
-func isBetween(n1, key, n2 int) bool {
-	if n1 < n2 {
-		return n1 < key && key < n2
+// nodeIDs picks the IDs of the virtual nodes of a new server, according to the -id-strategy option:
+//
+// address:  hash of the advertised address, so a restarted node gets the same place in the ring
+// explicit: the IDs given with -id
+// random:   hash of the current time
+func nodeIDs(address string, count int) ([]ID, error) {
+
+	ids := make([]ID, 0, count)
+	used := make(map[ID]bool)
+
+	switch *idStrategy {
+	case "address":
+		for v := 0; v < count; v++ {
+
+			// The first virtual node hashes the plain address, so a server without virtual nodes
+			// gets the same ID as before. Colliding IDs are salted until they are unique.
+			input := address
+			if v > 0 {
+				input = address + "#" + strconv.Itoa(v)
+			}
+			id := nodeHash(input)
+			for salt := 1; used[id]; salt++ {
+				id = nodeHash(input + "#" + strconv.Itoa(salt))
+			}
+			used[id] = true
+			ids = append(ids, id)
+		}
+
+	case "explicit":
+		explicitIDs := splitList(*explicitID)
+		if len(explicitIDs) != count {
+			return nil, fmt.Errorf("-id must list exactly %d IDs, one per virtual node", count)
+		}
+		for _, value := range explicitIDs {
+			id, err := parseID(value)
+			if err != nil {
+				return nil, err
+			}
+			if used[id] {
+				return nil, fmt.Errorf("ID %s is given more than once", id)
+			}
+			used[id] = true
+			ids = append(ids, id)
+		}
+
+	case "random":
+		for v := 0; v < count; v++ {
+
+			// Creates a new id by hashing a random number, skipping ids already taken by another virtual node
+			id := nodeHash(strconv.Itoa(int(time.Now().UnixNano())))
+			for used[id] {
+				id = nodeHash(strconv.Itoa(int(time.Now().UnixNano())))
+			}
+			used[id] = true
+			ids = append(ids, id)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown ID strategy %q, must be address, explicit or random", *idStrategy)
 	}
-	return n1 < key || key < n2
+
+	return ids, nil
 }
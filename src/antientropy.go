@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxMerkleDepth limits the size of the trees a node builds for others
+const maxMerkleDepth = 16
+
+// keyRange is the range (start, end] of the ring. A range that starts where it ends is the whole ring.
+type keyRange struct {
+	start ID
+	end   ID
+}
+
+func (kr keyRange) contains(id ID) bool {
+	return kr.start.Equal(kr.end) || isBetweenInclusive(kr.start, id, kr.end)
+}
+
+// bucket returns which of the 2^depth equally large parts of the range id falls in
+func (kr keyRange) bucket(id ID, depth int) int {
+
+	ring := ringSize()
+	size := new(big.Int).Sub(kr.end.bigInt(), kr.start.bigInt())
+	size.Mod(size, ring)
+	if size.Sign() == 0 {
+		size = ring
+	}
+
+	// The range starts just after start
+	offset := new(big.Int).Sub(id.bigInt(), kr.start.bigInt())
+	offset.Sub(offset, big.NewInt(1))
+	offset.Mod(offset, ring)
+
+	offset.Lsh(offset, uint(depth))
+	return int(offset.Div(offset, size).Int64())
+}
+
+// MerkleTree summarizes the records in a key range. The range is split into 2^depth buckets,
+// every leaf hashes the records of one bucket, and every inner node hashes its two children.
+type MerkleTree struct {
+	Root   string   `json:"root"`
+	Leaves []string `json:"leaves"`
+}
+
+func buildMerkleTree(records map[string]*Record, kr keyRange, depth int) *MerkleTree {
+
+	buckets := make([][]string, 1<<depth)
+	for key := range records {
+		i := kr.bucket(keyID(key), depth)
+		buckets[i] = append(buckets[i], key)
+	}
+
+	tree := &MerkleTree{Leaves: make([]string, len(buckets))}
+	level := make([][]byte, len(buckets))
+	for i, keys := range buckets {
+		sort.Strings(keys)
+		h := sha256.New()
+		for _, key := range keys {
+			record := records[key]
+			fmt.Fprintf(h, "%q %d %q %t", key, record.Version, record.Writer, record.Deleted)
+			for _, sib := range record.Siblings {
+				fmt.Fprintf(h, " %s:%d", sib.Node, sib.Counter)
+			}
+			if record.CRDT != nil {
+				fmt.Fprintf(h, " %s", record.CRDT.encode())
+			}
+			if record.Manifest != nil {
+				fmt.Fprintf(h, " %s", strings.Join(record.Manifest.Chunks, ","))
+			}
+			fmt.Fprintln(h)
+		}
+		level[i] = h.Sum(nil)
+		tree.Leaves[i] = hex.EncodeToString(level[i])
+	}
+
+	for len(level) > 1 {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			sum := sha256.Sum256(append(append([]byte{}, level[2*i]...), level[2*i+1]...))
+			next[i] = sum[:]
+		}
+		level = next
+	}
+	tree.Root = hex.EncodeToString(level[0])
+
+	return tree
+}
+
+// AntiEntropyRound counts what one or more rounds of anti-entropy did
+type AntiEntropyRound struct {
+	Comparisons   int64 `json:"comparisons"`    // Key ranges compared with a replica
+	InSync        int64 `json:"in_sync"`        // Comparisons whose root hashes matched
+	BucketsSynced int64 `json:"buckets_synced"` // Buckets whose hashes differed and were exchanged
+	KeysPulled    int64 `json:"keys_pulled"`    // Newer records taken from replicas
+	KeysPushed    int64 `json:"keys_pushed"`    // Newer records sent to replicas
+	Errors        int64 `json:"errors"`
+}
+
+func (total *AntiEntropyRound) add(round *AntiEntropyRound) {
+	total.Comparisons += round.Comparisons
+	total.InSync += round.InSync
+	total.BucketsSynced += round.BucketsSynced
+	total.KeysPulled += round.KeysPulled
+	total.KeysPushed += round.KeysPushed
+	total.Errors += round.Errors
+}
+
+// AntiEntropyStats are the totals of all rounds since the server started, and the last round
+type AntiEntropyStats struct {
+	Rounds int64 `json:"rounds"`
+	AntiEntropyRound
+	LastRound    time.Time         `json:"last_round"`
+	LastDuration string            `json:"last_duration"`
+	Last         *AntiEntropyRound `json:"last"`
+}
+
+// antiEntropy is the state of the anti-entropy process of a server
+type antiEntropy struct {
+	loop    *maintenanceLoop
+	running sync.Mutex // Held during a round, so periodic and manual rounds do not overlap
+	mu      sync.Mutex
+	stats   AntiEntropyStats
+}
+
+// antiEntropyRound compares the key range of every virtual node with each of its replicas and syncs
+// the buckets that differ. Returns whether any records were exchanged.
+func (s *Server) antiEntropyRound() bool {
+	round := s.syncReplicas()
+	return round.KeysPulled > 0 || round.KeysPushed > 0
+}
+
+// syncReplicas runs one round of anti-entropy and returns what it did
+func (s *Server) syncReplicas() *AntiEntropyRound {
+
+	s.antiEntropy.running.Lock()
+	defer s.antiEntropy.running.Unlock()
+
+	round := &AntiEntropyRound{}
+	if s.crashed.Load() {
+		return round
+	}
+
+	started := time.Now()
+	for _, node := range s.nodes {
+
+		// Without a predecessor the node does not know its range
+		predecessor := node.predecessor()
+		if predecessor == nil {
+			continue
+		}
+
+		kr := keyRange{start: predecessor.Id, end: node.Id}
+		for _, replica := range node.replicas() {
+			s.syncRange(replica, kr, round)
+		}
+	}
+
+	metrics.add("anti_entropy_keys_pulled", round.KeysPulled)
+	metrics.add("anti_entropy_keys_pushed", round.KeysPushed)
+	metrics.add("anti_entropy_errors", round.Errors)
+
+	s.antiEntropy.mu.Lock()
+	defer s.antiEntropy.mu.Unlock()
+	stats := &s.antiEntropy.stats
+	stats.Rounds++
+	stats.add(round)
+	stats.LastRound = started
+	stats.LastDuration = time.Since(started).String()
+	stats.Last = round
+
+	return round
+}
+
+// syncRange compares the records in kr with a replica. Only if the root hashes differ, the leaves
+// are fetched, and only the buckets whose leaves differ are exchanged.
+func (s *Server) syncRange(replica *NodeAddress, kr keyRange, round *AntiEntropyRound) {
+
+	round.Comparisons++
+	local := s.storage.inRange(kr)
+
+	remote, err := s.fetchMerkleTree(replica, kr, 0)
+	if err != nil {
+		fmt.Fprintln(s.log, "Anti-entropy with", replica.Address, "failed:", err)
+		round.Errors++
+		return
+	}
+	if remote.Root == buildMerkleTree(local, kr, 0).Root {
+		round.InSync++
+		return
+	}
+
+	depth := *merkleDepth
+	remote, err = s.fetchMerkleTree(replica, kr, depth)
+	if err != nil || len(remote.Leaves) != 1<<depth {
+		fmt.Fprintln(s.log, "Anti-entropy with", replica.Address, "failed:", err)
+		round.Errors++
+		return
+	}
+
+	tree := buildMerkleTree(local, kr, depth)
+	for i, leaf := range tree.Leaves {
+		if leaf != remote.Leaves[i] {
+			s.syncBucket(replica, kr, depth, i, local, round)
+		}
+	}
+}
+
+// syncBucket exchanges the records of one bucket with a replica, so both end up with the newer version of every key
+func (s *Server) syncBucket(replica *NodeAddress, kr keyRange, depth, bucket int, local map[string]*Record, round *AntiEntropyRound) {
+
+	remote, err := s.fetchBucket(replica, kr, depth, bucket)
+	if err != nil {
+		fmt.Fprintln(s.log, "Anti-entropy with", replica.Address, "failed:", err)
+		round.Errors++
+		return
+	}
+	round.BucketsSynced++
+
+	for key, record := range remote {
+		if s.makeRoom(key, record) != nil {
+			round.Errors++
+			continue
+		}
+		applied, err := s.storage.applyWithin(key, record)
+		if err != nil {
+			round.Errors++
+			continue
+		}
+		if applied {
+			round.KeysPulled++
+		}
+	}
+
+	for key, record := range local {
+		if kr.bucket(keyID(key), depth) != bucket || !record.newerThan(remote[key]) {
+			continue
+		}
+		if err := s.storeReplica(replica, key, record); err != nil {
+			round.Errors++
+			continue
+		}
+		round.KeysPushed++
+	}
+}
+
+func rangeQuery(kr keyRange, depth int) string {
+	return fmt.Sprintf("start=%s&end=%s&depth=%d", kr.start, kr.end, depth)
+}
+
+func (s *Server) fetchMerkleTree(replica *NodeAddress, kr keyRange, depth int) (*MerkleTree, error) {
+	var tree MerkleTree
+	err := s.fetchJSON(nodeURL(replica, "merkle?"+rangeQuery(kr, depth)), &tree)
+	return &tree, err
+}
+
+func (s *Server) fetchBucket(replica *NodeAddress, kr keyRange, depth, bucket int) (map[string]*Record, error) {
+	var records map[string]*Record
+	err := s.fetchJSON(nodeURL(replica, fmt.Sprintf("merkle/records?%s&bucket=%d", rangeQuery(kr, depth), bucket)), &records)
+	return records, err
+}
+
+// fetchJSON gets url from another node and decodes the JSON response into data
+func (s *Server) fetchJSON(url string, data interface{}) error {
+
+	client := s.newClient(10 * time.Second)
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(data)
+}
+
+// parseRangeQuery reads the key range and tree depth of a /merkle request
+func parseRangeQuery(r *http.Request) (keyRange, int, error) {
+
+	query := r.URL.Query()
+	start, err := parseID(query.Get("start"))
+	if err != nil {
+		return keyRange{}, 0, err
+	}
+	end, err := parseID(query.Get("end"))
+	if err != nil {
+		return keyRange{}, 0, err
+	}
+	depth, err := strconv.Atoi(query.Get("depth"))
+	if err != nil || depth < 0 || depth > maxMerkleDepth {
+		return keyRange{}, 0, fmt.Errorf("depth must be between 0 and %d", maxMerkleDepth)
+	}
+	return keyRange{start: start, end: end}, depth, nil
+}
+
+// merkleHandler returns the Merkle tree of the records this server stores in a key range
+func (s *Server) merkleHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	kr, depth, err := parseRangeQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, buildMerkleTree(s.storage.inRange(kr), kr, depth))
+}
+
+// merkleRecordsHandler returns the records, tombstones included, in one bucket of a key range
+func (s *Server) merkleRecordsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	kr, depth, err := parseRangeQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bucket, err := strconv.Atoi(r.URL.Query().Get("bucket"))
+	if err != nil || bucket < 0 || bucket >= 1<<depth {
+		http.Error(w, "Invalid bucket", http.StatusBadRequest)
+		return
+	}
+
+	records := make(map[string]*Record)
+	for key, record := range s.storage.inRange(kr) {
+		if kr.bucket(keyID(key), depth) == bucket {
+			records[key] = record
+		}
+	}
+	writeJSON(w, records)
+}
+
+// antiEntropyHandler returns the statistics of the anti-entropy process
+func (s *Server) antiEntropyHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.antiEntropy.mu.Lock()
+	stats := s.antiEntropy.stats
+	s.antiEntropy.mu.Unlock()
+
+	writeJSON(w, stats)
+}
+
+// antiEntropySyncHandler runs a round of anti-entropy right away and returns what it did
+func (s *Server) antiEntropySyncHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, s.syncReplicas())
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+
+	jsonData, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error encoding JSON"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestKeyRangeBucket(t *testing.T) {
+	smallRing(t)
+
+	tests := []struct {
+		start, end int64
+		id         int64
+		depth      int
+		want       int
+	}{
+		// (0, 8] in two halves: 1-4 and 5-8
+		{0, 8, 1, 1, 0},
+		{0, 8, 4, 1, 0},
+		{0, 8, 5, 1, 1},
+		{0, 8, 8, 1, 1},
+		// One bucket per ID
+		{0, 8, 1, 3, 0},
+		{0, 8, 6, 3, 5},
+		{0, 8, 8, 3, 7},
+		{0, 8, 3, 0, 0},
+		// (12, 4] wraps around zero: 13-0 and 1-4
+		{12, 4, 13, 1, 0},
+		{12, 4, 0, 1, 0},
+		{12, 4, 1, 1, 1},
+		{12, 4, 4, 1, 1},
+		// A range that starts where it ends is the whole ring, (3, 3]: 4-11 and 12-3
+		{3, 3, 4, 1, 0},
+		{3, 3, 11, 1, 0},
+		{3, 3, 12, 1, 1},
+		{3, 3, 3, 1, 1},
+		{3, 3, 3, 4, 15},
+	}
+	for _, test := range tests {
+		kr := keyRange{start: newID(test.start), end: newID(test.end)}
+		if got := kr.bucket(newID(test.id), test.depth); got != test.want {
+			t.Errorf("(%d, %d].bucket(%d, %d) = %d, want %d", test.start, test.end, test.id, test.depth, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes an endpoint can require
+const (
+	scopePeer    = "peer"    // Only other nodes, authenticated with a signed request
+	scopeStorage = "storage" // Clients with a storage token, admins or other nodes
+	scopeAdmin   = "admin"   // Clients with an admin token
+)
+
+// Headers used for signed requests between nodes
+const (
+	timestampHeader = "X-Chord-Timestamp"
+	nonceHeader     = "X-Chord-Nonce"
+	signatureHeader = "X-Chord-Signature"
+)
+
+// A signed request is only accepted if its timestamp is within this window
+const signatureMaxSkew = 30 * time.Second
+
+// nonceCache remembers the nonces of signed requests until their timestamp leaves the window,
+// so a captured request cannot be replayed while its signature is still accepted. The nonces are
+// also kept in the order they can be forgotten, so each request only drops the ones that are due.
+type nonceCache struct {
+	mu      sync.Mutex
+	seen    map[string]bool
+	expires nonceQueue
+}
+
+var nonces = &nonceCache{seen: make(map[string]bool)}
+
+// nonceExpiry is a nonce and when it can be forgotten
+type nonceExpiry struct {
+	nonce string
+	at    time.Time
+}
+
+// nonceQueue orders nonces by when they can be forgotten, earliest first
+type nonceQueue []nonceExpiry
+
+func (q nonceQueue) Len() int            { return len(q) }
+func (q nonceQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q nonceQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nonceQueue) Push(x interface{}) { *q = append(*q, x.(nonceExpiry)) }
+func (q *nonceQueue) Pop() interface{} {
+	old := *q
+	expiry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return expiry
+}
+
+// remember records a nonce, and reports false if it was seen before
+func (c *nonceCache) remember(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for c.expires.Len() > 0 && now.After(c.expires[0].at) {
+		delete(c.seen, heap.Pop(&c.expires).(nonceExpiry).nonce)
+	}
+	if c.seen[nonce] {
+		return false
+	}
+	c.seen[nonce] = true
+	heap.Push(&c.expires, nonceExpiry{nonce: nonce, at: expires})
+	return true
+}
+
+// newNonce returns a random nonce for a signed request
+func newNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// requireScope wraps a handler so that it only runs for requests that are
+// authorized for the given scope. A scope without any configured secret or
+// token is left open, so a ring started without options behaves as before.
+func (s *Server) requireScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		status, reason := authorize(scope, r)
+		if status != http.StatusOK {
+			fmt.Fprintf(s.log, "Rejected %s %s from %s (%s scope): %s\n", r.Method, r.URL.Path, r.RemoteAddr, scope, reason)
+			metrics.inc("auth_rejected_" + scope)
+			w.WriteHeader(status)
+			w.Write([]byte(reason))
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// authorize checks the credentials of a request against a scope.
+// It returns http.StatusOK on success, otherwise the status to respond with and the reason.
+func authorize(scope string, r *http.Request) (int, string) {
+
+	signed := r.Header.Get(signatureHeader) != ""
+	token := bearerToken(r)
+
+	// A signature is checked whenever it is present, so a forged one is never ignored
+	if signed {
+		if err := verifySignature(r); err != nil {
+			return http.StatusUnauthorized, err.Error()
+		}
+	}
+
+	switch scope {
+	case scopePeer:
+		if *peerSecret == "" || signed {
+			return http.StatusOK, ""
+		}
+		return http.StatusUnauthorized, "missing request signature"
+
+	case scopeStorage:
+		clientTokens := splitList(*clientToken)
+		if len(clientTokens) == 0 || signed {
+			return http.StatusOK, ""
+		}
+		if token == "" {
+			return http.StatusUnauthorized, "missing API token"
+		}
+		if tokenIn(token, clientTokens) || tokenIn(token, splitList(*adminToken)) {
+			return http.StatusOK, ""
+		}
+		return http.StatusForbidden, "token not valid for storage access"
+
+	case scopeAdmin:
+		adminTokens := splitList(*adminToken)
+		if len(adminTokens) == 0 {
+			return http.StatusOK, ""
+		}
+		if token == "" {
+			return http.StatusUnauthorized, "missing API token"
+		}
+		if tokenIn(token, adminTokens) {
+			return http.StatusOK, ""
+		}
+		return http.StatusForbidden, "token not valid for admin operations"
+	}
+
+	return http.StatusForbidden, "unknown scope"
+}
+
+// bearerToken returns the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) string {
+	return strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// tokenIn reports whether token is one of the allowed tokens, in constant time per token
+func tokenIn(token string, allowed []string) bool {
+	found := false
+	for _, candidate := range allowed {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// signature computes the HMAC of a request over its method, path, query, timestamp, nonce and body
+func signature(method, uri, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(*peerSecret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks the signature headers of a request made by another node.
+// The body is read and replaced so the handler can still decode it.
+func verifySignature(r *http.Request) error {
+
+	if *peerSecret == "" {
+		return fmt.Errorf("request signatures are not enabled on this node")
+	}
+
+	timestamp := r.Header.Get(timestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request timestamp")
+	}
+
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return fmt.Errorf("request timestamp outside of the allowed window")
+	}
+
+	nonce := r.Header.Get(nonceHeader)
+	if nonce == "" {
+		return fmt.Errorf("missing request nonce")
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			return fmt.Errorf("error reading body")
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := signature(r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(signatureHeader))) {
+		return fmt.Errorf("invalid request signature")
+	}
+
+	// Only a valid signature spends the nonce, so forged requests cannot block real ones
+	if !nonces.remember(nonce, time.Unix(seconds, 0).Add(signatureMaxSkew)) {
+		return fmt.Errorf("replayed request")
+	}
+
+	return nil
+}
+
+// peerTransport tells the receiver which ring parameters this node uses,
+// and signs every outgoing request with the peer secret
+type peerTransport struct {
+	base     http.RoundTripper
+	unsigned bool // Streams the body as it is read instead of signing it
+}
+
+func (t *peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	if *peerSecret == "" || t.unsigned {
+		req = req.Clone(req.Context())
+		setRingParameters(req)
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signed := req.Clone(req.Context())
+	setRingParameters(signed)
+	signed.Body = http.NoBody
+	signed.ContentLength = int64(len(body))
+	if len(body) > 0 {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), newNonce()
+	signed.Header.Set(timestampHeader, timestamp)
+	signed.Header.Set(nonceHeader, nonce)
+	signed.Header.Set(signatureHeader, signature(signed.Method, signed.URL.RequestURI(), timestamp, nonce, body))
+
+	return t.base.RoundTrip(signed)
+}
+
+// newClient returns an HTTP client for talking to other nodes
+func (s *Server) newClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &peerTransport{base: s.transport},
+	}
+}
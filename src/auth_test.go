@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withAuth sets the peer secret and the client and admin tokens for the rest of the test
+func withAuth(t *testing.T, secret, clients, admins string) {
+	saved := []string{*peerSecret, *clientToken, *adminToken}
+	*peerSecret, *clientToken, *adminToken = secret, clients, admins
+	t.Cleanup(func() { *peerSecret, *clientToken, *adminToken = saved[0], saved[1], saved[2] })
+}
+
+// signedRequest returns a request signed like peerTransport does, at the given time and with the given nonce
+func signedRequest(method, uri, body string, at time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	r.Header.Set(timestampHeader, timestamp)
+	r.Header.Set(nonceHeader, nonce)
+	r.Header.Set(signatureHeader, signature(method, uri, timestamp, nonce, []byte(body)))
+	return r
+}
+
+func TestAuthorize(t *testing.T) {
+	withAuth(t, "ring-secret", "client-1,client-2", "admin-1")
+
+	now := time.Now()
+	tampered := func(r *http.Request, change func(r *http.Request)) *http.Request {
+		change(r)
+		return r
+	}
+	withToken := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/storage/key", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		scope  string
+		r      *http.Request
+		status int
+	}{
+		{"valid signature", scopePeer, signedRequest(http.MethodPut, "/storage/key?consistency=one", "value", now, newNonce()), http.StatusOK},
+		{"tampered body", scopePeer, tampered(signedRequest(http.MethodPut, "/storage/key", "value", now, newNonce()), func(r *http.Request) {
+			r.Body = io.NopCloser(strings.NewReader("other value"))
+		}), http.StatusUnauthorized},
+		{"tampered URI", scopePeer, tampered(signedRequest(http.MethodPut, "/storage/key", "value", now, newNonce()), func(r *http.Request) {
+			r.URL.Path = "/storage/other"
+		}), http.StatusUnauthorized},
+		{"tampered method", scopePeer, tampered(signedRequest(http.MethodGet, "/storage/key", "", now, newNonce()), func(r *http.Request) {
+			r.Method = http.MethodDelete
+		}), http.StatusUnauthorized},
+		{"stale timestamp", scopePeer, signedRequest(http.MethodGet, "/node-info", "", now.Add(-2*signatureMaxSkew), newNonce()), http.StatusUnauthorized},
+		{"timestamp in the future", scopePeer, signedRequest(http.MethodGet, "/node-info", "", now.Add(2*signatureMaxSkew), newNonce()), http.StatusUnauthorized},
+		{"timestamp within the skew", scopePeer, signedRequest(http.MethodGet, "/node-info", "", now.Add(-signatureMaxSkew/2), newNonce()), http.StatusOK},
+		{"missing signature", scopePeer, httptest.NewRequest(http.MethodGet, "/node-info", nil), http.StatusUnauthorized},
+		{"signed request on a storage endpoint", scopeStorage, signedRequest(http.MethodGet, "/storage/key", "", now, newNonce()), http.StatusOK},
+		{"forged signature with a valid token", scopeStorage, tampered(signedRequest(http.MethodGet, "/storage/key", "", now, newNonce()), func(r *http.Request) {
+			r.Header.Set(signatureHeader, "00")
+			r.Header.Set("Authorization", "Bearer client-1")
+		}), http.StatusUnauthorized},
+		{"client token", scopeStorage, withToken("client-2"), http.StatusOK},
+		{"admin token for storage", scopeStorage, withToken("admin-1"), http.StatusOK},
+		{"unknown token", scopeStorage, withToken("guess"), http.StatusForbidden},
+		{"missing token", scopeStorage, withToken(""), http.StatusUnauthorized},
+		{"client token for admin operations", scopeAdmin, withToken("client-1"), http.StatusForbidden},
+		{"admin token", scopeAdmin, withToken("admin-1"), http.StatusOK},
+	}
+	for _, test := range tests {
+		if status, reason := authorize(test.scope, test.r); status != test.status {
+			t.Errorf("%s: authorize = %d %q, want %d", test.name, status, reason, test.status)
+		}
+	}
+}
+
+func TestReplayedRequest(t *testing.T) {
+	withAuth(t, "ring-secret", "", "")
+
+	nonce := newNonce()
+	if status, reason := authorize(scopePeer, signedRequest(http.MethodPost, "/leave", "", time.Now(), nonce)); status != http.StatusOK {
+		t.Fatalf("first request: %d %s", status, reason)
+	}
+	if status, _ := authorize(scopePeer, signedRequest(http.MethodPost, "/leave", "", time.Now(), nonce)); status != http.StatusUnauthorized {
+		t.Errorf("replayed request answered %d, want 401", status)
+	}
+
+	// A forged request does not spend the nonce of a real one
+	forged := signedRequest(http.MethodPost, "/leave", "", time.Now(), "fresh-nonce")
+	forged.Header.Set(signatureHeader, "00")
+	authorize(scopePeer, forged)
+	if status, _ := authorize(scopePeer, signedRequest(http.MethodPost, "/leave", "", time.Now(), "fresh-nonce")); status != http.StatusOK {
+		t.Errorf("a forged request spent the nonce of a real one: %d", status)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+
+	cache := &nonceCache{seen: make(map[string]bool)}
+	now := time.Now()
+
+	if !cache.remember("a", now.Add(time.Minute)) || !cache.remember("b", now.Add(-time.Second)) {
+		t.Fatalf("new nonces were taken for replays")
+	}
+	if cache.remember("a", now.Add(time.Minute)) {
+		t.Errorf("a nonce was accepted twice within its window")
+	}
+
+	// Nonces are dropped once they can be forgotten, the others stay
+	cache.remember("c", now.Add(time.Minute))
+	if cache.seen["b"] || len(cache.seen) != 2 || cache.expires.Len() != 2 {
+		t.Errorf("cache holds %v after b could be forgotten, want a and c", cache.seen)
+	}
+}
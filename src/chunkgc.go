@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// chunkUses remembers when uploads last used the chunks owned by this server, whether they
+// stored a chunk or found it stored already. A chunk that was used recently may belong to an
+// upload whose manifest is not written yet, so it is not collected.
+type chunkUses struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func (u *chunkUses) use(digest string, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.last[digest] = now
+}
+
+// usedAfter reports whether an upload used a chunk after t
+func (u *chunkUses) usedAfter(digest string, t time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	last, ok := u.last[digest]
+	return ok && last.After(t)
+}
+
+// forget drops the uses before t, which no longer keep a chunk from being collected
+func (u *chunkUses) forget(t time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for digest, last := range u.last {
+		if last.Before(t) {
+			delete(u.last, digest)
+		}
+	}
+}
+
+// chunkGrace is how long a chunk is kept after an upload used it. An upload takes at most
+// -stream-timeout, so by then its manifest is stored, or the upload was given up.
+func chunkGrace() time.Duration {
+	return 2 * *streamTimeout
+}
+
+// referencedChunks returns the digests of the chunks that the live manifests on this server refer to
+func (st *Storage) referencedChunks() []string {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, record := range st.records {
+		if record.live(st.clock()) && record.Manifest != nil {
+			for _, digest := range record.Manifest.Chunks {
+				seen[digest] = true
+			}
+		}
+	}
+
+	digests := make([]string, 0, len(seen))
+	for digest := range seen {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+	return digests
+}
+
+// chunkRefsHandler returns the chunks that the manifests on this server refer to, GET /chunk-refs.
+// Replicas answer for their copies too, so a manifest is found even if its owner missed it.
+func (s *Server) chunkRefsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, s.storage.referencedChunks())
+}
+
+// chunkRefs asks every server in the ring for the chunks its manifests refer to. It fails unless the
+// ring walk gets around the ring and every server answers, since a missed manifest would lose its chunks.
+func (s *Server) chunkRefs() (map[string]bool, error) {
+
+	report := s.walkRing(s.nodes[0].address())
+	if !report.Closed {
+		return nil, fmt.Errorf("the ring walk did not get around the ring")
+	}
+
+	refs := make(map[string]bool)
+	asked := make(map[string]bool)
+	for _, member := range report.Members {
+		if asked[member.Address] {
+			continue
+		}
+		asked[member.Address] = true
+
+		var digests []string
+		if err := s.fetchJSON(nodeURL(member.address(), "chunk-refs"), &digests); err != nil {
+			return nil, fmt.Errorf("%s: %v", member.Address, err)
+		}
+		for _, digest := range digests {
+			refs[digest] = true
+		}
+	}
+	return refs, nil
+}
+
+// unusedChunks returns the digests of the chunks owned by this server that no upload stored or used since cutoff
+func (s *Server) unusedChunks(cutoff time.Time) []string {
+	s.storage.mu.RLock()
+	defer s.storage.mu.RUnlock()
+
+	var digests []string
+	for key, record := range s.storage.records {
+		digest, ok := chunkDigest(key)
+		if ok && record.holdsValue() && s.unused(digest, record, cutoff) && s.chunkOwner(digest) != nil {
+			digests = append(digests, digest)
+		}
+	}
+	sort.Strings(digests)
+	return digests
+}
+
+// unused reports whether a chunk was neither stored nor used by an upload since cutoff
+func (s *Server) unused(digest string, record *Record, cutoff time.Time) bool {
+	return record.Meta != nil && record.Meta.Modified.Before(cutoff) && !s.chunkUses.usedAfter(digest, cutoff)
+}
+
+// chunkGCRound collects the chunks owned by this server that no manifest in the ring refers to,
+// once they have not been used for chunkGrace: mark the chunks of all live manifests, then sweep
+// the rest. Returns whether a chunk was collected.
+func (s *Server) chunkGCRound() bool {
+
+	if s.crashed.Load() {
+		return false
+	}
+
+	cutoff := s.clock().Add(-chunkGrace())
+	s.chunkUses.forget(cutoff)
+
+	candidates := s.unusedChunks(cutoff)
+	if len(candidates) == 0 {
+		return false
+	}
+
+	refs, err := s.chunkRefs()
+	if err != nil {
+		fmt.Fprintln(s.log, "Collecting chunks skipped:", err)
+		return false
+	}
+
+	collected := 0
+	for _, digest := range candidates {
+		if refs[digest] {
+			continue
+		}
+
+		// Checked again under the lock of the storage, in case an upload used the chunk since
+		if s.collectChunk(digest, func(record *Record) bool { return s.unused(digest, record, cutoff) }) {
+			collected++
+		}
+	}
+	return collected > 0
+}
+
+// collectChunk replaces a chunk owned by this server with a tombstone, on this server and its
+// replicas, if remove accepts its record. Returns whether the chunk was removed.
+func (s *Server) collectChunk(digest string, remove func(record *Record) bool) bool {
+	if !s.expire(chunkPrefix+digest, remove) {
+		return false
+	}
+	metrics.inc("chunks_collected")
+	return true
+}
+
+// dropChunks removes the chunks that an upload stored before it was given up. A chunk that another
+// upload used since it was stored is kept, the chunk collection removes it if it stays unused.
+func (s *Server) dropChunks(digests []string) {
+	for _, digest := range digests {
+		if err := s.dropChunk(digest); err != nil {
+			fmt.Fprintln(s.log, "Dropping chunk", digest, "failed:", err)
+		}
+	}
+}
+
+// dropChunk removes a chunk of an upload that was given up, at its owner. Like storeChunk, the
+// request is forwarded towards the owner one node at a time.
+func (s *Server) dropChunk(digest string) error {
+
+	if owner := s.chunkOwner(digest); owner != nil {
+		s.collectChunk(digest, func(record *Record) bool {
+			return record.Meta != nil && !s.chunkUses.usedAfter(digest, record.Meta.Modified)
+		})
+		return nil
+	}
+
+	id := chunkID(digest)
+	successor := s.closestNode(id).findSuccessor(id)
+	req, err := http.NewRequest(http.MethodDelete, nodeURL(successor, "chunk/"+digest), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.newClient(10 * time.Second).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", successor.Address, resp.StatusCode)
+	}
+	return nil
+}
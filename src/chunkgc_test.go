@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestChunkGCRound(t *testing.T) {
+	fastMaintenance(t)
+
+	ts := startTestServer(t, 1)
+	defer ts.stop()
+	waitForRing(t, ts, 1)
+
+	old := ts.clock().Add(-2 * chunkGrace())
+	digestOf := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	chunk := func(data string, stored time.Time) string {
+		digest := digestOf(data)
+		record := ts.newRecord([]byte(data), false, nil)
+		record.Meta = newMetadata("", record.Value, nil, stored)
+		ts.storage.apply(chunkPrefix+digest, record)
+		return digest
+	}
+
+	// The manifest is stored first, and the use noted before the chunk, since the maintenance loop
+	// of the server may collect chunks at any time
+	manifest := ts.newRecord(nil, false, nil)
+	manifest.Manifest = &Manifest{Chunks: []string{digestOf("referenced")}}
+	ts.storage.apply("value", manifest)
+	ts.chunkUses.use(digestOf("reused"), ts.clock())
+
+	referenced := chunk("referenced", old)
+	orphan := chunk("orphan", old)
+	recent := chunk("recent", ts.clock())
+	reused := chunk("reused", old)
+
+	ts.chunkGCRound()
+	for digest, kept := range map[string]bool{referenced: true, orphan: false, recent: true, reused: true} {
+		if got := ts.storage.record(chunkPrefix + digest).holdsValue(); got != kept {
+			t.Errorf("chunk %s kept = %v, want %v", digest[:8], got, kept)
+		}
+	}
+
+	// Once the manifest is deleted, its chunk goes too
+	ts.storage.apply("value", ts.newRecord(nil, true, ts.storage.record("value")))
+	ts.chunkGCRound()
+	if ts.storage.record(chunkPrefix + referenced).holdsValue() {
+		t.Errorf("chunk of a deleted value was kept")
+	}
+}
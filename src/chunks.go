@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chunkPrefix starts the keys of the chunks of large values. Clients cannot use these keys.
+const chunkPrefix = ".chunks/"
+
+var errChunkMissing = errors.New("chunk is missing")
+
+// Manifest lists the chunks a large value was split into, in order. Every chunk is stored under
+// chunkPrefix and the sha256 of its bytes, so equal chunks are only stored once.
+type Manifest struct {
+	Size      int64    `json:"size"`
+	ChunkSize int      `json:"chunk_size"`
+	Chunks    []string `json:"chunks"`
+}
+
+// chunkDigest returns the digest of a chunk key, or false for other keys
+func chunkDigest(key string) (string, bool) {
+	digest, ok := strings.CutPrefix(key, chunkPrefix)
+	if !ok || len(digest) != 2*sha256.Size {
+		return "", false
+	}
+	_, err := hex.DecodeString(digest)
+	return digest, err == nil
+}
+
+// chunkID returns the place of a chunk on the ring. Chunks are placed by the digest of their bytes,
+// not by the hash of their keys, so the chunks of a value spread over the ring whatever the hash
+// function, even one that keeps keys with a common prefix together.
+func chunkID(digest string) ID {
+	sum, _ := hex.DecodeString(digest)
+	return idFromBytes(sum)
+}
+
+// chunkOwner returns the virtual node of this server that owns a chunk, or nil
+func (s *Server) chunkOwner(digest string) *Node {
+	return s.ownerOf(chunkID(digest))
+}
+
+// keyID returns the place of a stored key on the ring, for the maintenance that moves, compares and
+// lists the keys a server holds: the digest for chunks, the hash of the key for all other keys
+func keyID(key string) ID {
+	if digest, ok := chunkDigest(key); ok {
+		return chunkID(digest)
+	}
+	return hash(key)
+}
+
+// progressReader restarts a timer whenever a body is read further
+type progressReader struct {
+	body  io.Reader
+	timer *time.Timer
+}
+
+func (p *progressReader) Read(data []byte) (int, error) {
+	p.timer.Reset(10 * time.Second)
+	return p.body.Read(data)
+}
+
+// stream forwards a request whose body or answer may be too large to hold in memory. It gives up
+// when the next node takes neither the body nor answers for 10 seconds, and when the whole transfer,
+// answer included, takes longer than -stream-timeout. A body is sent without signing it, since that
+// would mean reading it all first, so the next node checks the client's token instead.
+func (s *Server) stream(r *http.Request, method, url string, body io.Reader) (*http.Response, error) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), *streamTimeout)
+	timer := time.AfterFunc(10*time.Second, cancel)
+	if body != nil {
+		body = &progressReader{body: body, timer: timer}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+
+	// Pass the client's token on, in case the ring is not using signed requests, the causal context and the content type
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	req.Header.Set(contextHeader, r.Header.Get(contextHeader))
+	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+
+	transport := &peerTransport{base: s.transport}
+	if body != nil {
+		req.ContentLength = r.ContentLength
+		transport.unsigned = true
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if !timer.Stop() && err == nil {
+		resp.Body.Close()
+		err = fmt.Errorf("timed out waiting for %s", req.URL.Host)
+	}
+	return resp, err
+}
+
+// storeLarge stores a value of more than -chunk-size bytes under key, owned by a virtual node
+// of this server. The body is read one chunk at a time, and every chunk is stored on the ring
+// before the next is read, so the value is never held in memory as a whole. Like a forwarded
+// upload, the body has to arrive within -stream-timeout.
+func (s *Server) storeLarge(w http.ResponseWriter, r *http.Request, owner *Node, key, level string, body io.Reader) {
+
+	// Answers written without a connection, e.g. in simulations, cannot have a deadline
+	http.NewResponseController(w).SetReadDeadline(time.Now().Add(*streamTimeout))
+
+	if vectorClocks() {
+		http.Error(w, "Values over -chunk-size are only supported with -conflict-mode lww", http.StatusRequestEntityTooLarge)
+		return
+	}
+	ttl, err := requestTTL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check that the key is free before the chunks are sent around
+	record, ok := s.readRecord(owner, key, level, false)
+	if !ok {
+		metrics.inc("consistency_failures")
+		http.Error(w, "Not enough replicas answered", http.StatusServiceUnavailable)
+		return
+	}
+	if record.live(s.clock()) && record.CRDT != nil {
+		http.Error(w, "Key holds a "+record.CRDT.Type+", change it with POST", http.StatusConflict)
+		return
+	}
+	if record.live(s.clock()) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// The chunks this upload stored, rather than found stored already, are dropped if it is given up
+	var stored []string
+	written := false
+	defer func() {
+		if !written && len(stored) > 0 {
+			s.dropChunks(stored)
+		}
+	}()
+
+	manifest := &Manifest{ChunkSize: *chunkSize, Chunks: []string{}}
+	buffer := make([]byte, *chunkSize)
+	whole := sha256.New()
+	for {
+		n, err := io.ReadFull(io.TeeReader(body, whole), buffer)
+		if n > 0 {
+			digest, created, storeErr := s.storeChunk(buffer[:n], level)
+			if created {
+				stored = append(stored, digest)
+			}
+			if errors.Is(storeErr, errStorageFull) {
+				writeStorageFull(w, storeErr)
+				return
+			}
+			if storeErr != nil {
+				fmt.Fprintln(s.log, "Storing a chunk of", key, "failed:", storeErr)
+				http.Error(w, "Storing a chunk failed: "+storeErr.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			manifest.Chunks = append(manifest.Chunks, digest)
+			manifest.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(s.log, "Error reading body:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	now, contentType := s.clock().UTC(), r.Header.Get("Content-Type")
+	record = s.newRecord(nil, false, record)
+	record.Manifest = manifest
+	record.Meta = &Metadata{ContentType: contentType, Length: manifest.Size, Checksum: hex.EncodeToString(whole.Sum(nil)), Created: now, Modified: now}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		record.Meta.Expires = &expires
+	}
+	if err := s.makeRoom(key, record); err != nil {
+		writeStorageFull(w, err)
+		return
+	}
+	acknowledged, err := s.writeRecord(owner, key, record, level)
+	if err != nil {
+		writeStorageFull(w, err)
+		return
+	}
+
+	// The manifest is stored here even if too few replicas took it, so its chunks stay
+	written = true
+	if !acknowledged {
+		metrics.inc("consistency_failures")
+		http.Error(w, "Not enough replicas acknowledged the write", http.StatusServiceUnavailable)
+		return
+	}
+	metrics.inc("large_values_stored")
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeLarge answers a GET of a large value by reading its chunks in order and sending them on.
+// A HEAD only gets the metadata, without reading any chunk. The last chunk is held back until the
+// value as a whole matches its checksum, so a value that was put together wrongly breaks off.
+func (s *Server) writeLarge(w http.ResponseWriter, r *http.Request, record *Record, level string) {
+
+	if r.Method == http.MethodHead {
+		writeMetadata(w, record.Meta)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	whole := sha256.New()
+	var size int64
+	for i, digest := range record.Manifest.Chunks {
+		data, err := s.fetchChunk(digest, level)
+		if err != nil {
+			fmt.Fprintln(s.log, "Reading chunk", digest, "failed:", err)
+
+			// The first chunk is read before answering, so a missing chunk there still gets a status
+			if i == 0 {
+				http.Error(w, "Reading a chunk failed: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+			// Otherwise the client can only tell from the answer breaking off before its length
+			panic(http.ErrAbortHandler)
+		}
+		whole.Write(data)
+		size += int64(len(data))
+
+		if i == len(record.Manifest.Chunks)-1 && (size != record.Meta.Length || hex.EncodeToString(whole.Sum(nil)) != record.Meta.Checksum) {
+			metrics.inc("checksum_failures")
+			fmt.Fprintln(s.log, "The chunks of", r.URL.Path, "do not match the checksum of the value")
+			if i == 0 {
+				http.Error(w, "The value does not match its checksum", http.StatusServiceUnavailable)
+				return
+			}
+			panic(http.ErrAbortHandler)
+		}
+
+		if i == 0 {
+			writeMetadata(w, record.Meta)
+			w.WriteHeader(http.StatusOK)
+		}
+		w.Write(data)
+	}
+}
+
+// storeChunk stores a chunk on the ring, at the place its digest points to, and returns the digest
+// and whether the chunk was stored new, rather than found stored already. Like storage requests,
+// the chunk is forwarded towards its owner one node at a time.
+func (s *Server) storeChunk(data []byte, level string) (string, bool, error) {
+
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	if owner := s.chunkOwner(digest); owner != nil {
+		created, err := s.putChunk(owner, digest, data, level)
+		return digest, created, err
+	}
+
+	id := chunkID(digest)
+	successor := s.closestNode(id).findSuccessor(id)
+	req, err := http.NewRequest(http.MethodPut, nodeURL(successor, "chunk/"+digest+"?consistency="+level), bytes.NewReader(data))
+	if err != nil {
+		return "", false, err
+	}
+
+	resp, err := s.newClient(10 * time.Second).Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	resp.Body.Close()
+
+	// The owner answers 201 for a chunk it stored new
+	if resp.StatusCode == http.StatusInsufficientStorage {
+		return "", false, fmt.Errorf("%w at %s", errStorageFull, successor.Address)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", false, fmt.Errorf("%s answered %d", successor.Address, resp.StatusCode)
+	}
+	return digest, resp.StatusCode == http.StatusCreated, nil
+}
+
+// putChunk stores a chunk owned by a virtual node of this server on its replicas, unless it is stored
+// already. Returns whether it was stored new.
+func (s *Server) putChunk(owner *Node, digest string, data []byte, level string) (bool, error) {
+
+	// The use is noted before the chunk is looked up, so the chunk collection either sees it and keeps
+	// the chunk, or removed the chunk before and this upload stores it again
+	s.chunkUses.use(digest, s.clock())
+
+	key := chunkPrefix + digest
+	record, ok := s.readRecord(owner, key, level, false)
+	if !ok {
+		return false, fmt.Errorf("not enough replicas answered")
+	}
+	if record.live(s.clock()) {
+		metrics.inc("chunks_deduplicated")
+		return false, nil
+	}
+
+	// The caller reuses data for the next chunk, so the record gets its own copy
+	record = s.newRecord(bytes.Clone(data), false, record)
+	record.Meta = newMetadata("", data, nil, s.clock())
+	if err := s.makeRoom(key, record); err != nil {
+		return false, err
+	}
+	acknowledged, err := s.writeRecord(owner, key, record, level)
+	if err != nil {
+		return false, err
+	}
+	metrics.inc("chunks_stored")
+	if !acknowledged {
+		return true, fmt.Errorf("not enough replicas acknowledged the write")
+	}
+	return true, nil
+}
+
+// fetchChunk reads a chunk from the ring and checks that it still matches its digest
+func (s *Server) fetchChunk(digest, level string) ([]byte, error) {
+
+	key := chunkPrefix + digest
+
+	var data []byte
+	if owner := s.chunkOwner(digest); owner != nil {
+		record, ok := s.readRecord(owner, key, level, true)
+		if !ok {
+			return nil, fmt.Errorf("not enough replicas answered")
+		}
+		if !record.live(s.clock()) {
+			return nil, errChunkMissing
+		}
+		data = record.Value
+
+	} else {
+		id := chunkID(digest)
+		successor := s.closestNode(id).findSuccessor(id)
+		resp, err := s.newClient(10 * time.Second).Get(nodeURL(successor, "chunk/"+digest+"?consistency="+level))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errChunkMissing
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s answered %d", successor.Address, resp.StatusCode)
+		}
+		if data, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != digest {
+		metrics.inc("chunks_corrupt")
+		return nil, fmt.Errorf("chunk does not match its digest")
+	}
+	return data, nil
+}
+
+// chunkHandler stores and reads the chunks of large values: PUT /chunk/<digest> and GET /chunk/<digest>.
+// DELETE /chunk/<digest> drops a chunk of an upload that was given up, see dropChunk.
+// The owner of the chunk serves the request, other nodes pass it on.
+func (s *Server) chunkHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	digest := strings.TrimPrefix(r.URL.Path, "/chunk/")
+	if _, ok := chunkDigest(chunkPrefix + digest); !ok {
+		http.Error(w, "Invalid chunk digest", http.StatusBadRequest)
+		return
+	}
+
+	level, err := consistencyLevel(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err := s.fetchChunk(digest, level)
+		if err == errChunkMissing {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			fmt.Fprintln(s.log, "Error reading body:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != digest {
+			http.Error(w, "Chunk does not match its digest", http.StatusBadRequest)
+			return
+		}
+		_, created, err := s.storeChunk(data, level)
+		if errors.Is(err, errStorageFull) {
+			writeStorageFull(w, err)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if created {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodDelete:
+		if err := s.dropChunk(digest); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
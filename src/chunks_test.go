@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestKeyID(t *testing.T) {
+
+	sum := sha256.Sum256([]byte("chunk"))
+	digest := hex.EncodeToString(sum[:])
+
+	if got, ok := chunkDigest(chunkPrefix + digest); !ok || got != digest {
+		t.Errorf("chunkDigest of a chunk key = %q, %v, want its digest", got, ok)
+	}
+	if got := keyID(chunkPrefix + digest); got != idFromBytes(sum[:]) {
+		t.Errorf("chunk placed at %s, want %s from its digest", got, idFromBytes(sum[:]))
+	}
+
+	// Keys that only look like chunk keys are hashed like any other key
+	for _, key := range []string{"key", chunkPrefix + "short", chunkPrefix + strings.Repeat("x", 2*sha256.Size)} {
+		if _, ok := chunkDigest(key); ok {
+			t.Errorf("%q taken for a chunk key", key)
+		}
+		if keyID(key) != hash(key) {
+			t.Errorf("%q placed at %s, want its hash %s", key, keyID(key), hash(key))
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+)
+
+// Command line options. Every option can be given before the positional
+// arguments, e.g. ./src -admin-tokens secret 0 true host:port 8
+var (
+	peerSecret             = flag.String("peer-secret", os.Getenv("CHORD_PEER_SECRET"), "shared secret used to sign requests between nodes")
+	clientToken            = flag.String("client-tokens", os.Getenv("CHORD_CLIENT_TOKENS"), "comma separated API tokens allowed to use /storage")
+	adminToken             = flag.String("admin-tokens", os.Getenv("CHORD_ADMIN_TOKENS"), "comma separated API tokens allowed to use /join, /leave, /sim-crash and /sim-recover")
+	vnodeCount             = flag.Int("vnodes", 1, "number of virtual nodes hosted by a new server")
+	idStrategy             = flag.String("id-strategy", "address", "how a new server picks its node IDs: address, explicit or random")
+	explicitID             = flag.String("id", "", "comma separated node IDs, one per virtual node, used with -id-strategy explicit")
+	stabilizeInterval      = flag.Duration("stabilize-interval", 2*time.Second, "shortest time between two rounds of stabilization")
+	maxStabilizeInterval   = flag.Duration("max-stabilize-interval", 16*time.Second, "longest time between two rounds of stabilization, reached while the ring is stable")
+	fixFingersInterval     = flag.Duration("fix-fingers-interval", time.Second, "shortest time between two rounds of finger fixing")
+	maxFixFingersInterval  = flag.Duration("max-fix-fingers-interval", 16*time.Second, "longest time between two rounds of finger fixing, reached while the ring is stable")
+	fingersPerRound        = flag.Int("fingers-per-round", 2, "number of fingers refreshed per round, in rotating order")
+	lifetime               = flag.Duration("lifetime", 10*time.Minute, "shut the server down after this long, 0 keeps it running until interrupted")
+	simulationScript       = flag.String("simulate", "", "run the simulation script in this file instead of a node")
+	simulationSeed         = flag.Int64("seed", 1, "seed of the simulation, which decides the order of messages")
+	simulationVerbose      = flag.Bool("sim-verbose", false, "show the output of the simulated nodes")
+	antiEntropyInterval    = flag.Duration("anti-entropy-interval", 10*time.Second, "shortest time between two rounds of anti-entropy between replicas")
+	maxAntiEntropyInterval = flag.Duration("max-anti-entropy-interval", 2*time.Minute, "longest time between two rounds of anti-entropy, reached while the replicas agree")
+	merkleDepth            = flag.Int("merkle-depth", 6, "depth of the Merkle trees compared by anti-entropy, a key range is split into 2^depth buckets")
+	replicas               = flag.Int("replicas", 3, "number of servers that store each key: the owner and the next servers in the ring")
+	defaultConsistency     = flag.String("consistency", consistencyOne, "consistency level of storage requests without ?consistency=: one, quorum or all")
+	hintInterval           = flag.Duration("hint-interval", 5*time.Second, "time between two attempts to hand hinted writes over to their owners")
+	hintExpiry             = flag.Duration("hint-expiry", 10*time.Minute, "how long a hinted write is kept for an owner that does not come back")
+	maxKeys                = flag.Int("max-keys", 0, "most keys a server stores, replicas included, 0 for no limit")
+	maxBytes               = flag.Int64("max-bytes", 0, "most bytes of keys and values a server stores, replicas included, 0 for no limit")
+	evictionPolicy         = flag.String("eviction", evictNone, "how a full server makes room by evicting keys of the cache namespaces: none, lru or ttl")
+	cachePrefixes          = flag.String("cache-prefixes", "", "comma separated key prefixes of cache namespaces, whose keys may be evicted")
+	expiryInterval         = flag.Duration("expiry-interval", 5*time.Second, "time between two sweeps for values whose TTL ran out")
+	chunkGCInterval        = flag.Duration("chunk-gc-interval", 10*time.Minute, "time between two collections of the chunks that no large value refers to")
+	chunkSize              = flag.Int("chunk-size", 1<<20, "values larger than this many bytes are streamed and stored as chunks of this size spread over the ring")
+	streamTimeout          = flag.Duration("stream-timeout", time.Hour, "longest time a large value may take to be passed on by a node, or read by its owner")
+	conflictMode           = flag.String("conflict-mode", conflictLWW, "how concurrent writes of a key are settled: lww keeps the last write, vclock keeps concurrent writes as siblings")
+	hashName               = flag.String("hash", "sha256", "hash function placing keys and nodes on the ring: "+strings.Join(hashFunctionNames(), ", "))
+)
+
+// splitList splits a comma separated option into its non-empty parts
+func splitList(value string) []string {
+	var parts []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
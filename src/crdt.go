@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Types of values that replicas merge without conflicts
+const (
+	crdtCounter  = "counter"  // PN-counter, changed with increment and decrement
+	crdtSet      = "set"      // OR-set, changed with add and remove
+	crdtRegister = "register" // LWW-register, changed with set
+)
+
+// crdtOperations are the operations of every type
+var crdtOperations = map[string][]string{
+	crdtCounter:  {"increment", "decrement"},
+	crdtSet:      {"add", "remove"},
+	crdtRegister: {"set"},
+}
+
+// CRDT is a value that replicas merge without conflicts, so it can be changed through
+// any replica at any time. Only the fields of its type are used.
+type CRDT struct {
+	Type string `json:"type"`
+
+	// PN-counter: the total increments and decrements made through every node, by node ID
+	Increments map[string]int64 `json:"increments,omitempty"`
+	Decrements map[string]int64 `json:"decrements,omitempty"`
+
+	// OR-set: the unique tags under which every element was added, and the tags that were removed
+	Added   map[string]map[string]bool `json:"added,omitempty"`
+	Removed map[string]bool            `json:"removed,omitempty"`
+
+	// LWW-register: the value with the latest timestamp, ties broken by the writer
+	Value     string `json:"value,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Writer    string `json:"writer,omitempty"`
+}
+
+func newCRDT(kind string) *CRDT {
+	return &CRDT{
+		Type:       kind,
+		Increments: map[string]int64{},
+		Decrements: map[string]int64{},
+		Added:      map[string]map[string]bool{},
+		Removed:    map[string]bool{},
+	}
+}
+
+func (c *CRDT) encode() string {
+	jsonData, _ := json.Marshal(c)
+	return string(jsonData)
+}
+
+// merge returns the state that has seen everything c and other have seen
+func (c *CRDT) merge(other *CRDT) *CRDT {
+
+	merged := newCRDT(c.Type)
+	for _, value := range []*CRDT{c, other} {
+		for node, n := range value.Increments {
+			merged.Increments[node] = max(merged.Increments[node], n)
+		}
+		for node, n := range value.Decrements {
+			merged.Decrements[node] = max(merged.Decrements[node], n)
+		}
+		for element, tags := range value.Added {
+			if merged.Added[element] == nil {
+				merged.Added[element] = map[string]bool{}
+			}
+			for tag := range tags {
+				merged.Added[element][tag] = true
+			}
+		}
+		for tag := range value.Removed {
+			merged.Removed[tag] = true
+		}
+		if value.Timestamp > merged.Timestamp || (value.Timestamp == merged.Timestamp && value.Writer > merged.Writer) {
+			merged.Value, merged.Timestamp, merged.Writer = value.Value, value.Timestamp, value.Writer
+		}
+	}
+	return merged
+}
+
+// apply changes the value with an operation made through node at the time now
+func (c *CRDT) apply(op, node string, amount int64, argument string, now time.Time) {
+
+	switch op {
+	case "increment":
+		c.Increments[node] += amount
+
+	case "decrement":
+		c.Decrements[node] += amount
+
+	case "add":
+		if c.Added[argument] == nil {
+			c.Added[argument] = map[string]bool{}
+		}
+		c.Added[argument][fmt.Sprintf("%s:%d", node, now.UnixNano())] = true
+
+	case "remove":
+		// Only the adds seen here are removed, so a concurrent add elsewhere survives
+		for tag := range c.Added[argument] {
+			c.Removed[tag] = true
+		}
+
+	case "set":
+		timestamp := now.UnixNano()
+		if timestamp <= c.Timestamp {
+			timestamp = c.Timestamp + 1
+		}
+		c.Value, c.Timestamp, c.Writer = argument, timestamp, node
+	}
+}
+
+// value returns what the CRDT holds: a number, a sorted list of elements or a string
+func (c *CRDT) value() interface{} {
+
+	switch c.Type {
+	case crdtCounter:
+		var total int64
+		for _, n := range c.Increments {
+			total += n
+		}
+		for _, n := range c.Decrements {
+			total -= n
+		}
+		return total
+
+	case crdtSet:
+		elements := []string{}
+		for element, tags := range c.Added {
+			for tag := range tags {
+				if !c.Removed[tag] {
+					elements = append(elements, element)
+					break
+				}
+			}
+		}
+		sort.Strings(elements)
+		return elements
+	}
+	return c.Value
+}
+
+func writeCRDT(w http.ResponseWriter, c *CRDT) {
+	writeJSON(w, map[string]interface{}{"type": c.Type, "value": c.value()})
+}
+
+// crdtOperation reads the type, operation and amount of a POST to /storage
+func crdtOperation(r *http.Request) (kind, op string, amount int64, err error) {
+
+	query := r.URL.Query()
+	kind, op = query.Get("type"), query.Get("op")
+
+	ops, ok := crdtOperations[kind]
+	if !ok {
+		return "", "", 0, fmt.Errorf("unknown type %q, must be counter, set or register", kind)
+	}
+	valid := false
+	for _, name := range ops {
+		valid = valid || name == op
+	}
+	if !valid {
+		return "", "", 0, fmt.Errorf("unknown operation %q for a %s", op, kind)
+	}
+
+	amount = 1
+	if text := query.Get("amount"); text != "" {
+		amount, err = strconv.ParseInt(text, 10, 64)
+		if err != nil || amount < 1 {
+			return "", "", 0, fmt.Errorf("amount must be a positive number")
+		}
+	}
+	return kind, op, amount, nil
+}
+
+// updateCRDT applies an operation to the CRDT under key, owned by a virtual node of this server. The
+// states of the replicas are merged in first, then the operation is applied and the state is sent to
+// the replicas, which merge it with theirs.
+func (s *Server) updateCRDT(w http.ResponseWriter, r *http.Request, owner *Node, key, level string, body []byte) {
+
+	kind, op, amount, err := crdtOperation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	read, ok := s.readRecord(owner, key, level, false)
+	if !ok {
+		metrics.inc("consistency_failures")
+		http.Error(w, "Not enough replicas answered", http.StatusServiceUnavailable)
+		return
+	}
+	if read != nil {
+		s.storage.apply(key, read)
+	}
+
+	change := func(current *Record) *Record {
+		if current.live(s.clock()) && (current.CRDT == nil || current.CRDT.Type != kind) {
+			return nil
+		}
+
+		value := newCRDT(kind)
+		if current.live(s.clock()) {
+			value = value.merge(current.CRDT)
+		}
+		value.apply(op, owner.Id.String(), amount, string(body), s.clock())
+
+		record := s.newRecord(nil, false, current)
+		record.CRDT = value
+		return record
+	}
+
+	// The change is tried on a copy first, to check that it fits into the storage
+	if err := s.makeRoom(key, change(s.storage.record(key))); err != nil {
+		writeStorageFull(w, err)
+		return
+	}
+
+	// The operation runs under the lock of the storage, so concurrent operations through this server do not get
+	// lost, and checks again that it fits
+	record, err := s.storage.update(key, change)
+	if err != nil {
+		metrics.inc("quota_rejections")
+		writeStorageFull(w, err)
+		return
+	}
+	if record == nil {
+		http.Error(w, "Key holds a value of another type", http.StatusConflict)
+		return
+	}
+
+	if acknowledged, _ := s.writeRecord(owner, key, record, level); !acknowledged {
+		metrics.inc("consistency_failures")
+		http.Error(w, "Not enough replicas acknowledged the write", http.StatusServiceUnavailable)
+		return
+	}
+	writeCRDT(w, record.CRDT)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// crdtReplicas returns states of every type that replicas reach with concurrent operations
+func crdtReplicas() map[string][]*CRDT {
+
+	at := func(seconds int64) time.Time { return time.Unix(seconds, 0) }
+
+	counters := []*CRDT{newCRDT(crdtCounter), newCRDT(crdtCounter), newCRDT(crdtCounter)}
+	counters[0].apply("increment", "n1", 3, "", at(1))
+	counters[1].apply("increment", "n1", 1, "", at(1))
+	counters[1].apply("decrement", "n2", 2, "", at(2))
+	counters[2].apply("increment", "n3", 5, "", at(3))
+
+	sets := []*CRDT{newCRDT(crdtSet), newCRDT(crdtSet), newCRDT(crdtSet)}
+	sets[0].apply("add", "n1", 0, "x", at(1))
+	sets[1] = sets[1].merge(sets[0])
+	sets[1].apply("remove", "n2", 0, "x", at(2))
+	sets[1].apply("add", "n2", 0, "y", at(2))
+	sets[2].apply("add", "n3", 0, "x", at(3))
+
+	registers := []*CRDT{newCRDT(crdtRegister), newCRDT(crdtRegister), newCRDT(crdtRegister)}
+	registers[0].apply("set", "n1", 0, "first", at(1))
+	registers[1].apply("set", "n2", 0, "second", at(2))
+	registers[2].apply("set", "n3", 0, "tied", at(2))
+
+	return map[string][]*CRDT{crdtCounter: counters, crdtSet: sets, crdtRegister: registers}
+}
+
+func TestCRDTMerge(t *testing.T) {
+
+	want := map[string]interface{}{
+		crdtCounter:  int64(6),           // n1 counted once at its highest, n2 and n3 added
+		crdtSet:      []string{"x", "y"}, // The add of x at n3 was not seen by the remove
+		crdtRegister: "tied",             // Latest timestamp, ties broken by the writer
+	}
+
+	for kind, replicas := range crdtReplicas() {
+		a, b, c := replicas[0], replicas[1], replicas[2]
+
+		if got := a.merge(b).merge(c).value(); !reflect.DeepEqual(got, want[kind]) {
+			t.Errorf("%s: merged value %v, want %v", kind, got, want[kind])
+		}
+
+		for _, value := range replicas {
+			if value.merge(value).encode() != value.encode() {
+				t.Errorf("%s: merging %s with itself changes it", kind, value.encode())
+			}
+		}
+		for _, pair := range [][2]*CRDT{{a, b}, {a, c}, {b, c}} {
+			if pair[0].merge(pair[1]).encode() != pair[1].merge(pair[0]).encode() {
+				t.Errorf("%s: merging %s and %s depends on the order", kind, pair[0].encode(), pair[1].encode())
+			}
+		}
+		if a.merge(b).merge(c).encode() != a.merge(b.merge(c)).encode() {
+			t.Errorf("%s: merging three states depends on the grouping", kind)
+		}
+	}
+}
+
+func TestCRDTRecords(t *testing.T) {
+
+	counter := func(node string, n int64) *Record {
+		c := newCRDT(crdtCounter)
+		c.Increments[node] = n
+		return &Record{Version: 1, Writer: "a", CRDT: c}
+	}
+
+	// A replica's state is newer if it holds something the other has not seen, whatever the version
+	if !counter("n2", 1).newerThan(counter("n1", 5)) {
+		t.Errorf("a counter with an unseen increment is not newer")
+	}
+	if counter("n1", 1).newerThan(counter("n1", 5)) {
+		t.Errorf("a counter seen already is newer")
+	}
+
+	// Records with CRDTs of the same type merge their values and keep the highest version
+	a, b := newCRDT(crdtCounter), newCRDT(crdtCounter)
+	a.Increments["n1"] = 2
+	b.Increments["n2"] = 3
+	merged := (&Record{Version: 5, Writer: "x", CRDT: a}).merge(&Record{Version: 3, Writer: "y", CRDT: b})
+	if merged.CRDT.value() != int64(5) || merged.Version != 5 || merged.Writer != "x" {
+		t.Errorf("merged counters to %v at version %d by %s, want 5 at version 5 by x", merged.CRDT.value(), merged.Version, merged.Writer)
+	}
+}
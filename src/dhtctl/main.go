@@ -0,0 +1,848 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes, so scripts can tell the outcomes apart
+const (
+	exitOK           = 0 // The command succeeded
+	exitNotFound     = 1 // The key does not exist, or already exists for put
+	exitUsage        = 2 // Wrong command line
+	exitFailed       = 3 // The node answered with an error
+	exitUnreachable  = 4 // The node could not be reached, or is crashed
+	exitUnauthorized = 5 // The token was missing or not accepted
+	exitInconsistent = 6 // The ring walk found inconsistencies
+)
+
+var (
+	node        = flag.String("node", envOr("DHT_NODE", "localhost:8080"), "address (host:port) of the node to talk to")
+	token       = flag.String("token", os.Getenv("DHT_TOKEN"), "API token sent as \"Authorization: Bearer <token>\"")
+	output      = flag.String("o", "table", "output format: table or json")
+	timeout     = flag.Duration("timeout", 10*time.Second, "timeout of every request")
+	contentType = flag.String("content-type", "", "content type stored with the value by put and upload")
+	ttl         = flag.String("ttl", "", "how long the value of put and upload lives, e.g. 30s or 10m")
+	context     = flag.String("context", "", "causal context from a get, sent with put so the value replaces the siblings it has seen (-conflict-mode vclock)")
+)
+
+// contextHeader carries the causal context of a key in the vector clock conflict mode
+const contextHeader = "X-Context"
+
+var commands = map[string]func(args []string) int{
+	"get":      getCommand,
+	"put":      putCommand,
+	"upload":   uploadCommand,
+	"download": downloadCommand,
+	"stat":     statCommand,
+	"delete":   deleteCommand,
+	"scan":     scanCommand,
+	"keys":     keysCommand,
+	"info":     infoCommand,
+	"ring":     ringCommand,
+	"export":   exportCommand,
+	"join":     joinCommand,
+	"leave":    adminCommand("leave"),
+	"crash":    adminCommand("sim-crash"),
+	"recover":  adminCommand("sim-recover"),
+}
+
+func main() {
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown output format %q, must be table or json\n", *output)
+		os.Exit(exitUsage)
+	}
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	os.Exit(command(flag.Args()[1:]))
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: dhtctl [options] <command> [arguments]
+
+Commands:
+  get <key>              print the value stored under key, or its siblings as JSON
+  put <key> <value>      store value under key, "-" reads the value from stdin
+  upload <key> <file>    stream a file, "-" for stdin, to key; large files are stored in chunks
+  download <key> <file>  stream the value of key to a file, "-" for stdout
+  stat <key>             show the content type, length, checksum and times of the value of key
+  delete <key>           remove key
+  scan [prefix]          list the keys that start with prefix, and their values, in order
+  keys [cluster]         list the keys stored on the node, or on every node of the ring
+  info                   show the node, its neighbours and finger table
+  ring [vnode]           list all nodes of the ring in order and check it for inconsistencies
+  export <dot|graph>     write the ring as a Graphviz graph, or as nodes and links for D3
+  join <address>         make the node join the ring that address is part of
+  leave                  make the node leave its ring
+  crash                  simulate a crash of the node
+  recover                recover the node from a simulated crash
+
+Exit codes:
+  0 success, 1 key not found (or already exists for put), 2 usage error,
+  3 error response, 4 node unreachable or crashed, 5 unauthorized,
+  6 ring inconsistent
+
+Options:
+`)
+	flag.PrintDefaults()
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// request sends a request to the node and returns the status code and body.
+// The returned exit code is exitOK unless the node could not be reached.
+func request(method, path string, body []byte) (int, []byte, int) {
+	status, _, data, code := exchange(method, path, body)
+	return status, data, code
+}
+
+// exchange is request that also returns the response headers
+func exchange(method, path string, body []byte) (int, http.Header, []byte, int) {
+
+	req, err := http.NewRequest(method, "http://"+*node+path, bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating request:", err)
+		return 0, nil, nil, exitUsage
+	}
+
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	if *context != "" {
+		req.Header.Set(contextHeader, *context)
+	}
+	if *contentType != "" && method == http.MethodPut {
+		req.Header.Set("Content-Type", *contentType)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			fmt.Fprintf(os.Stderr, "Timed out waiting for %s\n", *node)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error connecting to %s: %v\n", *node, err)
+		}
+		return 0, nil, nil, exitUnreachable
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading response:", err)
+		return resp.StatusCode, resp.Header, nil, exitUnreachable
+	}
+
+	return resp.StatusCode, resp.Header, data, exitOK
+}
+
+// statusExitCode maps an unexpected status code to an exit code and reports it on stderr
+func statusExitCode(status int, body []byte) int {
+
+	message := strings.TrimSpace(string(body))
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	fmt.Fprintf(os.Stderr, "%s answered %d: %s\n", *node, status, message)
+
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return exitUnauthorized
+	case http.StatusServiceUnavailable:
+		return exitUnreachable
+	}
+	return exitFailed
+}
+
+// printJSON writes value as indented JSON to stdout
+func printJSON(value interface{}) {
+	jsonData, _ := json.MarshalIndent(value, "", "  ")
+	fmt.Println(string(jsonData))
+}
+
+// printResult prints the outcome of a command that has no other output
+func printResult(command, message string) {
+	if *output == "json" {
+		printJSON(map[string]string{"command": command, "node": *node, "result": message})
+		return
+	}
+	fmt.Println(message)
+}
+
+func storagePath(key string) string {
+	return "/storage/" + url.PathEscape(key)
+}
+
+// putPath is the storage path of key for put and upload, with the -ttl of the value
+func putPath(key string) string {
+	if *ttl == "" {
+		return storagePath(key)
+	}
+	return storagePath(key) + "?ttl=" + url.QueryEscape(*ttl)
+}
+
+func getCommand(args []string) int {
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl get <key>")
+		return exitUsage
+	}
+
+	status, header, body, code := exchange(http.MethodGet, storagePath(args[0]), nil)
+	if code != exitOK {
+		return code
+	}
+
+	switch status {
+	case http.StatusOK:
+		if *output == "json" {
+			result := map[string]string{"key": args[0], "value": string(body)}
+			if context := header.Get(contextHeader); context != "" {
+				result["context"] = context
+			}
+			printJSON(result)
+		} else {
+			os.Stdout.Write(body)
+			fmt.Println()
+		}
+		return exitOK
+	case http.StatusMultipleChoices:
+		// Concurrent writes kept as siblings, the body lists them with their causal context
+		os.Stdout.Write(body)
+		fmt.Println()
+		return exitOK
+	case http.StatusNotFound:
+		fmt.Fprintf(os.Stderr, "Key %q not found\n", args[0])
+		return exitNotFound
+	}
+	return statusExitCode(status, body)
+}
+
+func putCommand(args []string) int {
+
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl put <key> <value>")
+		return exitUsage
+	}
+
+	value := []byte(args[1])
+	if args[1] == "-" {
+		var err error
+		value, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading stdin:", err)
+			return exitUsage
+		}
+	}
+
+	status, body, code := request(http.MethodPut, putPath(args[0]), value)
+	if code != exitOK {
+		return code
+	}
+
+	switch status {
+	case http.StatusOK:
+		printResult("put", "stored")
+		return exitOK
+	case http.StatusAccepted:
+		// The owner is down, the node keeps the value and hands it over once the owner is back
+		printResult("put", "stored as hint")
+		return exitOK
+	case http.StatusForbidden:
+		fmt.Fprintf(os.Stderr, "Key %q already exists\n", args[0])
+		return exitNotFound
+	}
+	return statusExitCode(status, body)
+}
+
+// stream sends a request with a body of any size and returns the response with its body still
+// to be read. -timeout only limits the wait for the response to start, not the transfer.
+func stream(method, path string, body io.Reader, length int64) (*http.Response, int) {
+
+	req, err := http.NewRequest(method, "http://"+*node+path, body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating request:", err)
+		return nil, exitUsage
+	}
+	req.ContentLength = length
+
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	if *contentType != "" && method == http.MethodPut {
+		req.Header.Set("Content-Type", *contentType)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = *timeout
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to %s: %v\n", *node, err)
+		return nil, exitUnreachable
+	}
+	return resp, exitOK
+}
+
+// statCommand shows the metadata of a value, which HEAD returns as headers
+func statCommand(args []string) int {
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl stat <key>")
+		return exitUsage
+	}
+
+	status, header, body, code := exchange(http.MethodHead, storagePath(args[0]), nil)
+	if code != exitOK {
+		return code
+	}
+
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		fmt.Fprintf(os.Stderr, "Key %q not found\n", args[0])
+		return exitNotFound
+	default:
+		return statusExitCode(status, body)
+	}
+
+	fields := []struct{ name, header string }{
+		{"content_type", "Content-Type"},
+		{"length", "Content-Length"},
+		{"checksum", "X-Checksum-Sha256"},
+		{"created", "X-Created"},
+		{"modified", "X-Modified"},
+		{"expires", "X-Expires"},
+	}
+
+	if *output == "json" {
+		result := map[string]string{"key": args[0]}
+		for _, field := range fields {
+			result[field.name] = header.Get(field.header)
+		}
+		printJSON(result)
+		return exitOK
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, field := range fields {
+		fmt.Fprintf(table, "%s\t%s\n", field.name, header.Get(field.header))
+	}
+	table.Flush()
+	return exitOK
+}
+
+func uploadCommand(args []string) int {
+
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl upload <key> <file>")
+		return exitUsage
+	}
+
+	var body io.Reader = os.Stdin
+	length := int64(-1)
+	if args[1] != "-" {
+		file, err := os.Open(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening file:", err)
+			return exitUsage
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading file:", err)
+			return exitUsage
+		}
+		body, length = file, info.Size()
+	}
+
+	resp, code := stream(http.MethodPut, putPath(args[0]), body, length)
+	if code != exitOK {
+		return code
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		printResult("upload", "stored")
+		return exitOK
+	case http.StatusAccepted:
+		printResult("upload", "stored as hint")
+		return exitOK
+	case http.StatusForbidden:
+		fmt.Fprintf(os.Stderr, "Key %q already exists\n", args[0])
+		return exitNotFound
+	}
+	return statusExitCode(resp.StatusCode, data)
+}
+
+func downloadCommand(args []string) int {
+
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl download <key> <file>")
+		return exitUsage
+	}
+
+	resp, code := stream(http.MethodGet, storagePath(args[0]), nil, 0)
+	if code != exitOK {
+		return code
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		fmt.Fprintf(os.Stderr, "Key %q not found\n", args[0])
+		return exitNotFound
+	default:
+		data, _ := io.ReadAll(resp.Body)
+		return statusExitCode(resp.StatusCode, data)
+	}
+
+	out := os.Stdout
+	if args[1] != "-" {
+		file, err := os.Create(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating file:", err)
+			return exitUsage
+		}
+		defer file.Close()
+		out = file
+	}
+
+	// A value that breaks off on the way, e.g. because a chunk was lost, ends with an error here
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading value:", err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// scanPage is a page of the response of /scan
+type scanPage struct {
+	Items []struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	} `json:"items"`
+	Next string `json:"next"`
+}
+
+func scanCommand(args []string) int {
+
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl scan [prefix]")
+		return exitUsage
+	}
+
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	// Follow the pages until the last one
+	items := map[string]json.RawMessage{}
+	var keys []string
+	for token := ""; ; {
+		path := "/scan?limit=1000&prefix=" + url.QueryEscape(prefix) + "&token=" + token
+		status, body, code := request(http.MethodGet, path, nil)
+		if code != exitOK {
+			return code
+		}
+		if status != http.StatusOK {
+			return statusExitCode(status, body)
+		}
+
+		var page scanPage
+		if err := json.Unmarshal(body, &page); err != nil {
+			fmt.Fprintln(os.Stderr, "Error decoding JSON:", err)
+			return exitFailed
+		}
+		for _, item := range page.Items {
+			keys = append(keys, item.Key)
+			items[item.Key] = item.Value
+		}
+		if page.Next == "" {
+			break
+		}
+		token = page.Next
+	}
+
+	if *output == "json" {
+		printJSON(items)
+		return exitOK
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, key := range keys {
+		fmt.Fprintf(table, "%s\t%s\n", key, items[key])
+	}
+	table.Flush()
+	return exitOK
+}
+
+// keyInfo is a key in the response of /keys
+type keyInfo struct {
+	Key     string       `json:"key"`
+	Id      json.Number  `json:"id"`
+	Size    int          `json:"size"`
+	Version int64        `json:"version"`
+	Deleted bool         `json:"deleted,omitempty"`
+	Owner   *json.Number `json:"owner"`
+	Node    string       `json:"node,omitempty"`
+}
+
+func keysCommand(args []string) int {
+
+	if len(args) > 1 || (len(args) == 1 && args[0] != "cluster") {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl keys [cluster]")
+		return exitUsage
+	}
+
+	scope := "local"
+	if len(args) == 1 {
+		scope = "cluster"
+	}
+
+	// Follow the pages until the last one
+	keys := []keyInfo{}
+	for next := ""; ; {
+		status, body, code := request(http.MethodGet, "/keys?limit=1000&scope="+scope+"&token="+next, nil)
+		if code != exitOK {
+			return code
+		}
+		if status != http.StatusOK {
+			return statusExitCode(status, body)
+		}
+
+		var page struct {
+			Keys []keyInfo `json:"keys"`
+			Next string    `json:"next"`
+		}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&page); err != nil {
+			fmt.Fprintln(os.Stderr, "Error decoding JSON:", err)
+			return exitFailed
+		}
+		keys = append(keys, page.Keys...)
+		if page.Next == "" {
+			break
+		}
+		next = page.Next
+	}
+
+	if *output == "json" {
+		printJSON(keys)
+		return exitOK
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NODE\tKEY\tID\tSIZE\tVERSION\tOWNER")
+	for _, key := range keys {
+		address, owner := key.Node, "copy"
+		if address == "" {
+			address = *node
+		}
+		if key.Owner != nil {
+			owner = key.Owner.String()
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%d\t%s\n", address, key.Key, key.Id, key.Size, key.Version, owner)
+	}
+	table.Flush()
+	return exitOK
+}
+
+func deleteCommand(args []string) int {
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl delete <key>")
+		return exitUsage
+	}
+
+	status, body, code := request(http.MethodDelete, storagePath(args[0]), nil)
+	if code != exitOK {
+		return code
+	}
+
+	switch status {
+	case http.StatusOK:
+		printResult("delete", "deleted")
+		return exitOK
+	case http.StatusNotFound:
+		fmt.Fprintf(os.Stderr, "Key %q not found\n", args[0])
+		return exitNotFound
+	}
+	return statusExitCode(status, body)
+}
+
+// nodeAddress is the ID and address of a node, as returned by the node
+type nodeAddress struct {
+	Id      json.Number `json:"id"`
+	Address string      `json:"address"`
+}
+
+func (n *nodeAddress) String() string {
+	if n == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%s (%s)", n.Id, n.Address)
+}
+
+// nodeInfo is the response of /node-info
+type nodeInfo struct {
+	Id          json.Number  `json:"id"`
+	Address     string       `json:"address"`
+	Successor   *nodeAddress `json:"successor"`
+	Predecessor *nodeAddress `json:"predecessor"`
+	Hash        string       `json:"hash"`
+	Bits        int          `json:"bits"`
+	Fingers     []struct {
+		Start     json.Number  `json:"start"`
+		Successor *nodeAddress `json:"successorID"`
+	} `json:"others"`
+	Vnodes []struct {
+		Id          json.Number  `json:"id"`
+		Successor   *nodeAddress `json:"successor"`
+		Predecessor *nodeAddress `json:"predecessor"`
+		Keys        int          `json:"keys"`
+	} `json:"vnodes"`
+}
+
+// fetchNodeInfo returns the node info of a virtual node, or of the node itself if vnode is empty
+func fetchNodeInfo(vnode string) (*nodeInfo, []byte, int) {
+
+	path := "/node-info"
+	if vnode != "" {
+		path += "?vnode=" + vnode
+	}
+
+	status, body, code := request(http.MethodGet, path, nil)
+	if code != exitOK {
+		return nil, nil, code
+	}
+	if status != http.StatusOK {
+		return nil, nil, statusExitCode(status, body)
+	}
+
+	var info nodeInfo
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&info); err != nil {
+		fmt.Fprintln(os.Stderr, "Error decoding JSON:", err)
+		return nil, nil, exitFailed
+	}
+	return &info, body, exitOK
+}
+
+func infoCommand(args []string) int {
+
+	info, body, code := fetchNodeInfo("")
+	if code != exitOK {
+		return code
+	}
+
+	if *output == "json" {
+		os.Stdout.Write(body)
+		fmt.Println()
+		return exitOK
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Node\t%s (%s)\n", info.Id, info.Address)
+	fmt.Fprintf(table, "Successor\t%s\n", info.Successor)
+	fmt.Fprintf(table, "Predecessor\t%s\n", info.Predecessor)
+	if info.Hash != "" {
+		fmt.Fprintf(table, "Hash\t%s, %d bits\n", info.Hash, info.Bits)
+	}
+	table.Flush()
+
+	if len(info.Vnodes) > 0 {
+		fmt.Println()
+		table = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "VNODE\tPREDECESSOR\tSUCCESSOR\tKEYS")
+		for _, vnode := range info.Vnodes {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%d\n", vnode.Id, vnode.Predecessor, vnode.Successor, vnode.Keys)
+		}
+		table.Flush()
+	}
+
+	fmt.Println()
+	table = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "FINGER\tSTART\tSUCCESSOR")
+	for i, finger := range info.Fingers {
+		fmt.Fprintf(table, "%d\t%s\t%s\n", i, finger.Start, finger.Successor)
+	}
+	table.Flush()
+
+	return exitOK
+}
+
+// ringReport is the response of /ring
+type ringReport struct {
+	Members []struct {
+		Id          json.Number  `json:"id"`
+		Address     string       `json:"address"`
+		Successor   *nodeAddress `json:"successor"`
+		Predecessor *nodeAddress `json:"predecessor"`
+	} `json:"members"`
+	Closed     bool `json:"closed"`
+	Consistent bool `json:"consistent"`
+	Problems   []struct {
+		Kind    string `json:"kind"`
+		Message string `json:"message"`
+	} `json:"problems"`
+}
+
+// ringCommand walks the ring from the node and lists its members and inconsistencies.
+// The exit code is exitInconsistent if the node found any.
+func ringCommand(args []string) int {
+
+	path := "/ring"
+	if len(args) == 1 {
+		path += "?vnode=" + url.QueryEscape(args[0])
+	} else if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl ring [vnode]")
+		return exitUsage
+	}
+
+	status, body, code := request(http.MethodGet, path, nil)
+	if code != exitOK {
+		return code
+	}
+	if status != http.StatusOK {
+		return statusExitCode(status, body)
+	}
+
+	var report ringReport
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&report); err != nil {
+		fmt.Fprintln(os.Stderr, "Error decoding JSON:", err)
+		return exitFailed
+	}
+
+	if *output == "json" {
+		os.Stdout.Write(body)
+		fmt.Println()
+	} else {
+		table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "#\tID\tADDRESS\tPREDECESSOR\tSUCCESSOR")
+		for i, member := range report.Members {
+			fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%s\n", i, member.Id, member.Address, member.Predecessor, member.Successor)
+		}
+		table.Flush()
+
+		if len(report.Problems) > 0 {
+			fmt.Println()
+			table = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(table, "PROBLEM\tDETAILS")
+			for _, problem := range report.Problems {
+				fmt.Fprintf(table, "%s\t%s\n", problem.Kind, problem.Message)
+			}
+			table.Flush()
+		}
+	}
+
+	if !report.Consistent {
+		fmt.Fprintf(os.Stderr, "Ring is inconsistent: %d problems found\n", len(report.Problems))
+		return exitInconsistent
+	}
+	return exitOK
+}
+
+// exportCommand writes the ring as drawn by the node, without looking at it
+func exportCommand(args []string) int {
+
+	if len(args) != 1 || (args[0] != "dot" && args[0] != "graph") {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl export <dot|graph>")
+		return exitUsage
+	}
+
+	status, body, code := request(http.MethodGet, "/ring?format="+args[0], nil)
+	if code != exitOK {
+		return code
+	}
+	if status != http.StatusOK {
+		return statusExitCode(status, body)
+	}
+
+	os.Stdout.Write(body)
+	if args[0] == "graph" {
+		fmt.Println()
+	}
+	return exitOK
+}
+
+func joinCommand(args []string) int {
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dhtctl join <address>")
+		return exitUsage
+	}
+
+	status, body, code := request(http.MethodPost, "/join?nprime="+url.QueryEscape(args[0]), nil)
+	if code != exitOK {
+		return code
+	}
+	if status != http.StatusOK {
+		return statusExitCode(status, body)
+	}
+
+	printResult("join", strings.TrimSpace(string(body)))
+	return exitOK
+}
+
+// adminCommand returns a command that posts to an admin endpoint without arguments
+func adminCommand(endpoint string) func(args []string) int {
+	return func(args []string) int {
+
+		if len(args) != 0 {
+			fmt.Fprintf(os.Stderr, "Usage: dhtctl %s\n", endpoint)
+			return exitUsage
+		}
+
+		status, body, code := request(http.MethodPost, "/"+endpoint, nil)
+		if code != exitOK {
+			return code
+		}
+		if status != http.StatusOK {
+			return statusExitCode(status, body)
+		}
+
+		printResult(endpoint, "ok")
+		return exitOK
+	}
+}
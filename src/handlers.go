@@ -1,11 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -13,181 +13,245 @@ import (
 // Endpoints
 
 // GET: Returns HTTP code 200, with value, if <key> exists in the DHT. Returns HTTP code 404, if <key> does not exist in the DHT.
+// HEAD: Like GET, with the metadata of the value as headers but without the value.
 // PUT: Returns HTTP code 200. Assumed that <value> is persisted
-func storageHandler(w http.ResponseWriter, r *http.Request) {
+// DELETE: Returns HTTP code 200 if <key> was removed from the DHT. Returns HTTP code 404, if <key> does not exist in the DHT.
+func (s *Server) storageHandler(w http.ResponseWriter, r *http.Request) {
 
-	s := serverInstance
-
-	if s.crashed {
+	if s.crashed.Load() {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
-	if r.Method == "GET" {
+	level, err := consistencyLevel(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.HasPrefix(strings.TrimPrefix(r.URL.Path, "/storage/"), chunkPrefix) {
+		http.Error(w, "Keys starting with "+chunkPrefix+" are reserved for the chunks of large values", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" || r.Method == "HEAD" {
 
 		key := strings.TrimPrefix(r.URL.Path, "/storage/")
 		keyInt := hash(key)
 
-		// Check if the key is within the valid range
-		if keyInt < 0 || keyInt >= 1<<keyIdentifierSpace || fmt.Sprintf("%T", keyInt) != "int" {
-			w.WriteHeader(http.StatusNotFound)
+		// If one of the virtual nodes on this server is responsible for the key, read it from the replicas
+		if owner := s.ownerOf(keyInt); owner != nil {
+			s.coordinate(w, r, owner, key, level, nil)
 			return
 		}
 
-		// If the current node is the only node in the ring, return the value
-		if s.node.PredecessorID == nil {
-			value, ok := s.storage[key]
-			if ok {
-				w.WriteHeader(http.StatusOK)
-				w.Write([]byte(value))
-			} else {
-				w.WriteHeader(http.StatusNotFound)
-			}
+		// Find the successor node for the given key
+		successor := s.closestNode(keyInt).findSuccessor(keyInt)
+
+		// Forward the request to the successor node, and pass the answer on as it arrives
+		url := nodeURL(successor, "storage/"+key+"?consistency="+level)
+		resp, err := s.stream(r, r.Method, url, nil)
+		if err != nil {
+			http.Error(w, "Error connecting to successor node", http.StatusInternalServerError)
 			return
 		}
+		defer resp.Body.Close()
 
-		curr_node := s.node.Id
-		prev_node := s.node.PredecessorID.Id
+		if resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusNotFound {
+			w.WriteHeader(resp.StatusCode)
+			return
+		}
 
-		// Checking for wrap-around in the ring
-		if prev_node > curr_node {
-			if prev_node < keyInt || keyInt <= curr_node {
+		// Handle the response, which holds siblings with 300 in the vector clock mode
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultipleChoices {
+			http.Error(w, "Error forwarding request to successor node", http.StatusInternalServerError)
+			return
+		}
 
-				// Check local storage
-				value, ok := s.storage[key]
-				if ok {
-					w.WriteHeader(http.StatusOK)
-					w.Write([]byte(value))
-				} else {
-					w.WriteHeader(http.StatusNotFound)
-				}
-				return
+		for _, header := range metadataHeaders {
+			if value := resp.Header.Get(header); value != "" {
+				w.Header().Set(header, value)
 			}
+		}
+		w.WriteHeader(resp.StatusCode)
 
-		} else if prev_node < keyInt && keyInt <= curr_node {
+		// A value that breaks off at the successor breaks off here too, so the client notices
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			fmt.Fprintln(s.log, "Error forwarding response from successor node:", err)
+			panic(http.ErrAbortHandler)
+		}
+		return
 
-			// If the key falls between the current node and its predecessor, return the value
-			value, ok := s.storage[key]
-			if ok {
-				w.WriteHeader(http.StatusOK)
-				w.Write([]byte(value))
-			} else {
-				w.WriteHeader(http.StatusNotFound)
-			}
+	} else if r.Method == "PUT" {
+
+		key := strings.TrimPrefix(r.URL.Path, "/storage/")
+		keyInt := hash(key)
+
+		// Values up to -chunk-size are read whole, larger ones are streamed on
+		body, err := io.ReadAll(io.LimitReader(r.Body, int64(*chunkSize)+1))
+		if err != nil {
+			fmt.Fprintln(s.log, "Error reading body:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+
+		if len(body) > *chunkSize {
+			s.putLarge(w, r, key, level, io.MultiReader(bytes.NewReader(body), r.Body))
+			return
+		}
+
+		// If one of the virtual nodes on this server is responsible for the key, store the value
+		// on the replicas, only if the key is not already present
+		if owner := s.ownerOf(keyInt); owner != nil {
+			s.coordinate(w, r, owner, key, level, body)
 			return
 		}
 
 		// Find the successor node for the given key
-		successor := s.findSuccessor(keyInt)
+		successor := s.closestNode(keyInt).findSuccessor(keyInt)
 
 		// Forward the request to the successor node
-		url := fmt.Sprintf("http://%s/storage/%s", successor.Address, key)
-		client := &http.Client{Timeout: 10 * time.Second}
-		resp, err := client.Get(url)
+		url := nodeURL(successor, "storage/"+key+"?consistency="+level+ttlQuery(r))
+
+		// Forward the request to the given node
+		req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, "Error creating request", http.StatusInternalServerError)
+			return
+		}
 
+		// Pass the client's token on, in case the ring is not using signed requests, the causal context and the content type
+		req.Header.Set("Authorization", r.Header.Get("Authorization"))
+		req.Header.Set(contextHeader, r.Header.Get(contextHeader))
+		req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+
+		// Set the content type and length
+		client := s.newClient(10 * time.Second)
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode == http.StatusServiceUnavailable {
+			// If the owner is down, keep the write as a hint and hand it over once the owner is back
+			if s.isDown(successor) {
+				if err == nil {
+					resp.Body.Close()
+				}
+				s.storeHint(successor, key, body, r.Header.Get("Content-Type"), r.URL.Query().Get("ttl"), level, r.Header.Get(contextHeader), r.Header.Get("Authorization"))
+				w.WriteHeader(http.StatusAccepted)
+				w.Write([]byte("Stored as a hint for " + successor.Address))
+				return
+			}
+		}
 		if err != nil {
 			http.Error(w, "Error connecting to successor node", http.StatusInternalServerError)
 			return
 		}
+		defer resp.Body.Close()
 
-		if resp.StatusCode == http.StatusServiceUnavailable {
-			w.WriteHeader(http.StatusServiceUnavailable)
+		if resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusConflict {
+			w.WriteHeader(resp.StatusCode)
 			return
 		}
 
-		// Handle the response
-		if resp.StatusCode != http.StatusOK {
-			http.Error(w, "Error forwarding request to successor node", http.StatusInternalServerError)
+		// Pass on which limit of the owner the value did not fit into
+		if resp.StatusCode == http.StatusInsufficientStorage {
+			data, _ := io.ReadAll(resp.Body)
+			w.WriteHeader(resp.StatusCode)
+			w.Write(data)
 			return
 		}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, "Error reading response from successor node", http.StatusInternalServerError)
+		// Handle the response
+		if resp.StatusCode != http.StatusOK {
+			http.Error(w, "Error forwarding request to successor node", http.StatusInternalServerError)
 			return
 		}
 
 		w.WriteHeader(http.StatusOK)
-		w.Write(body)
 		return
 
-	} else if r.Method == "PUT" {
+	} else if r.Method == "DELETE" {
 
 		key := strings.TrimPrefix(r.URL.Path, "/storage/")
 		keyInt := hash(key)
 
-		if keyInt < 0 || keyInt >= 1<<keyIdentifierSpace || fmt.Sprintf("%T", keyInt) != "int" {
-			w.WriteHeader(http.StatusNotFound)
+		// If one of the virtual nodes on this server is responsible for the key, delete the value on the replicas
+		if owner := s.ownerOf(keyInt); owner != nil {
+			s.coordinate(w, r, owner, key, level, nil)
 			return
 		}
 
-		body, err := io.ReadAll(r.Body)
+		// Find the successor node for the given key
+		successor := s.closestNode(keyInt).findSuccessor(keyInt)
+
+		// Forward the request to the successor node
+		url := nodeURL(successor, "storage/"+key+"?consistency="+level)
+		req, err := http.NewRequest(http.MethodDelete, url, nil)
 		if err != nil {
-			fmt.Println("Error reading body:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			http.Error(w, "Error creating request", http.StatusInternalServerError)
 			return
 		}
-		defer r.Body.Close()
 
-		value := string(body)
+		// Pass the client's token on, in case the ring is not using signed requests
+		req.Header.Set("Authorization", r.Header.Get("Authorization"))
 
-		// If the current node is the only node in the ring, store the value
-		if s.node.PredecessorID == nil {
-			_, ok := s.storage[key]
-			if ok {
-				w.WriteHeader(http.StatusForbidden)
-			} else {
-				w.WriteHeader(http.StatusOK)
-				s.storage[key] = value
-			}
+		client := s.newClient(10 * time.Second)
+		resp, err := client.Do(req)
+		if err != nil {
+			http.Error(w, "Error connecting to successor node", http.StatusInternalServerError)
 			return
 		}
+		defer resp.Body.Close()
 
-		curr_node := s.node.Id
-		prev_node := s.node.PredecessorID.Id
+		if resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusNotFound {
+			w.WriteHeader(resp.StatusCode)
+			return
+		}
 
-		// Checking for wrap-around in the ring
-		if prev_node > curr_node {
-			if prev_node < keyInt || keyInt <= curr_node {
-				_, ok := s.storage[key]
-				if ok {
-					w.WriteHeader(http.StatusForbidden)
-				} else {
-					// Store the value if the key is not already present
-					w.WriteHeader(http.StatusOK)
-					s.storage[key] = value
-				}
-				return
-			}
+		// Handle the response
+		if resp.StatusCode != http.StatusOK {
+			http.Error(w, "Error forwarding request to successor node", http.StatusInternalServerError)
+			return
+		}
 
-		} else if prev_node < keyInt && keyInt <= curr_node {
-			// If the key falls between the current node and its predecessor, store the value
-			_, ok := s.storage[key]
-			// Store the value only if the key is not already present
-			if ok {
-				w.WriteHeader(http.StatusForbidden)
-			} else {
-				w.WriteHeader(http.StatusOK)
-				s.storage[key] = value
-			}
+		w.WriteHeader(http.StatusOK)
+		return
+
+	} else if r.Method == "POST" {
+
+		key := strings.TrimPrefix(r.URL.Path, "/storage/")
+		keyInt := hash(key)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			fmt.Fprintln(s.log, "Error reading body:", err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		defer r.Body.Close()
 
-		// Find the successor node for the given key
-		successor := s.findSuccessor(keyInt)
+		// If one of the virtual nodes on this server is responsible for the key, apply the operation to its CRDT
+		if owner := s.ownerOf(keyInt); owner != nil {
+			s.updateCRDT(w, r, owner, key, level, body)
+			return
+		}
 
-		// Forward the request to the successor node
-		url := fmt.Sprintf("http://%s/storage/%s", successor.Address, key)
+		// Find the successor node for the given key
+		successor := s.closestNode(keyInt).findSuccessor(keyInt)
 
-		// Forward the request to the given node
-		req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(value))
+		// Forward the request to the successor node, with the type and operation
+		query := r.URL.Query()
+		query.Set("consistency", level)
+		url := nodeURL(successor, "storage/"+key+"?"+query.Encode())
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
 		if err != nil {
 			http.Error(w, "Error creating request", http.StatusInternalServerError)
 			return
 		}
 
-		// Set the content type and length
-		client := &http.Client{Timeout: 10 * time.Second}
+		// Pass the client's token on, in case the ring is not using signed requests
+		req.Header.Set("Authorization", r.Header.Get("Authorization"))
+
+		client := s.newClient(10 * time.Second)
 		resp, err := client.Do(req)
 		if err != nil {
 			http.Error(w, "Error connecting to successor node", http.StatusInternalServerError)
@@ -195,34 +259,62 @@ func storageHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer resp.Body.Close()
 
-		if resp.StatusCode == http.StatusServiceUnavailable {
-			w.WriteHeader(http.StatusServiceUnavailable)
+		// The owner answers with the new value or the reason the operation failed
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			http.Error(w, "Error reading response from successor node", http.StatusInternalServerError)
 			return
 		}
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(data)
+		return
+	}
 
-		// Handle the response
-		if resp.StatusCode != http.StatusOK {
-			http.Error(w, "Error forwarding request to successor node", http.StatusInternalServerError)
-			return
-		}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
 
-		w.WriteHeader(http.StatusOK)
+// putLarge serves a PUT of a value over -chunk-size, which is stored in chunks by the owner of the
+// key. The body is streamed to the owner as it arrives. Unlike small values, it cannot be kept as a
+// hint while the owner is down, since it is not held anywhere.
+func (s *Server) putLarge(w http.ResponseWriter, r *http.Request, key, level string, body io.Reader) {
+
+	keyInt := hash(key)
+	if owner := s.ownerOf(keyInt); owner != nil {
+		s.storeLarge(w, r, owner, key, level, body)
 		return
 	}
-}
 
-func networkHandler(w http.ResponseWriter, r *http.Request) {
+	successor := s.closestNode(keyInt).findSuccessor(keyInt)
+	resp, err := s.stream(r, http.MethodPut, nodeURL(successor, "storage/"+key+"?consistency="+level+ttlQuery(r)), body)
+	if err != nil {
+		http.Error(w, "Error connecting to successor node", http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+
+	// The owner answers with the outcome, or the reason the value was not stored
+	data, _ := io.ReadAll(resp.Body)
+	w.WriteHeader(resp.StatusCode)
+	w.Write(data)
+}
 
-	s := serverInstance
+func (s *Server) networkHandler(w http.ResponseWriter, r *http.Request) {
 
-	if s.crashed {
+	if s.crashed.Load() {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
+	node := s.vnode(r)
+	if node == nil {
+		http.Error(w, "Unknown virtual node", http.StatusNotFound)
+		return
+	}
+
 	if r.Method == "GET" {
 
-		jsonData, err := json.Marshal(serverInstance.node.FingerTable)
+		jsonData, err := json.Marshal(node.fingers())
 
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -243,10 +335,9 @@ func networkHandler(w http.ResponseWriter, r *http.Request) {
 // If the server is crashed, it responds with a 503 Service Unavailable status.
 // If the request method is not GET, it responds with a 405 Method Not Allowed status.
 // If the request method is GET, it responds with a 200 OK status and the server's hostname and port.
-func helloworldHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) helloworldHandler(w http.ResponseWriter, r *http.Request) {
 
-	s := serverInstance
-	if s.crashed {
+	if s.crashed.Load() {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
@@ -257,21 +348,24 @@ func helloworldHandler(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == http.MethodGet {
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(serverInstance.hostname + ":" + serverInstance.port))
+		w.Write([]byte(s.hostname + ":" + s.port))
 	}
 }
 
-func send_node_info(w http.ResponseWriter) {
-
-	s := serverInstance
+func (s *Server) send_node_info(w http.ResponseWriter, node *Node) {
 
 	data := make(map[string]interface{})
-	data["id"] = s.node.Id
-	data["node_hash"] = s.node.Id
-	data["address"] = s.node.Address
-	data["successor"] = s.node.SuccessorID
-	data["predecessor"] = s.node.PredecessorID
-	data["others"] = s.node.FingerTable
+	data["id"] = node.Id
+	data["node_hash"] = node.Id
+	data["address"] = node.Address
+	data["successor"] = node.successor()
+	data["predecessor"] = node.predecessor()
+	data["successors"] = node.replicas()
+	data["others"] = node.fingers()
+	data["vnodes"] = s.virtualNodeInfo()
+	data["hash"] = keyHash.Name()
+	data["bits"] = keyIdentifierSpace
+	data["storage"] = s.storage.usage()
 
 	jsonData, _ := json.MarshalIndent(data, "", "\t")
 
@@ -280,6 +374,28 @@ func send_node_info(w http.ResponseWriter) {
 	w.Write(jsonData)
 }
 
+// virtualNodeInfo lists the virtual nodes on this server together with the number of keys each is responsible for
+func (s *Server) virtualNodeInfo() []map[string]interface{} {
+
+	keyCounts := make(map[ID]int)
+	for _, key := range s.storage.keys() {
+		if owner := s.ownerOf(keyID(key)); owner != nil {
+			keyCounts[owner.Id]++
+		}
+	}
+
+	vnodes := make([]map[string]interface{}, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		vnodes = append(vnodes, map[string]interface{}{
+			"id":          node.Id,
+			"successor":   node.successor(),
+			"predecessor": node.predecessor(),
+			"keys":        keyCounts[node.Id],
+		})
+	}
+	return vnodes
+}
+
 func return_node(w http.ResponseWriter, node *NodeAddress) {
 
 	jsonData, err := json.MarshalIndent(node, "", "\t")
@@ -294,11 +410,9 @@ func return_node(w http.ResponseWriter, node *NodeAddress) {
 	w.Write(jsonData)
 }
 
-func nodeInfoHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) nodeInfoHandler(w http.ResponseWriter, r *http.Request) {
 
-	s := serverInstance
-
-	if s.crashed {
+	if s.crashed.Load() {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
@@ -309,54 +423,58 @@ func nodeInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 	} else if r.Method == http.MethodGet {
 
-		askingId := r.URL.Query().Get("successor")
-		myself := &NodeAddress{
-			Id:      s.node.Id,
-			Address: s.node.Address,
+		node := s.vnode(r)
+		if node == nil {
+			http.Error(w, "Unknown virtual node", http.StatusNotFound)
+			return
 		}
 
+		askingId := r.URL.Query().Get("successor")
+		myself := node.address()
+
 		if askingId != "" {
-			keyInt, err := strconv.Atoi(askingId)
+			keyInt, err := parseID(askingId)
 
-			if err != nil || keyInt < 0 || keyInt >= 1<<keyIdentifierSpace {
+			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
-			curr_node := s.node.Id
-			successor := s.node.SuccessorID.Id
+			curr_node := node.Id
+			successor := node.successor().Id
 
 			// If the current node is the only node in the ring, return it self
-			if successor == curr_node {
+			if successor.Equal(curr_node) {
 				return_node(w, myself)
 				return
 			}
 
 			// If the current node is the only node in the ring, return it self
-			if s.node.PredecessorID == nil {
+			predecessorAddress := node.predecessor()
+			if predecessorAddress == nil {
 				return_node(w, myself)
 				return
 			}
 
-			predecessor := s.node.PredecessorID.Id
+			predecessor := predecessorAddress.Id
 
 			// Checking for wrap-around in the ring
-			if predecessor >= curr_node {
-				if predecessor < keyInt || keyInt <= curr_node {
+			if predecessor.Cmp(curr_node) >= 0 {
+				if predecessor.Cmp(keyInt) < 0 || keyInt.Cmp(curr_node) <= 0 {
 					return_node(w, myself)
 					return
 				}
-			} else if predecessor < keyInt && keyInt <= curr_node {
+			} else if predecessor.Cmp(keyInt) < 0 && keyInt.Cmp(curr_node) <= 0 {
 
 				// If the key falls between the current node and its predecessor, return the value
 				return_node(w, myself)
 				return
 			}
 
-			found_successor := s.findSuccessor(keyInt)
+			found_successor := node.findSuccessor(keyInt)
 
-			nodeInfo := fmt.Sprintf("http://%s/node-info?successor=%d", found_successor.Address, keyInt)
-			resp := get_response(nodeInfo)
+			nodeInfo := nodeURL(found_successor, fmt.Sprintf("node-info?successor=%s", keyInt))
+			resp := s.get_response(nodeInfo)
 
 			if resp == nil {
 				return
@@ -364,18 +482,14 @@ func nodeInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 			// Decode the JSON response
 			var data map[string]interface{}
-			decoder := json.NewDecoder(resp.Body)
-			err = decoder.Decode(&data)
+			err = decodeJSON(resp.Body, &data)
 
 			if err != nil {
 				http.Error(w, "Error decoding JSON", http.StatusInternalServerError)
 				return
 			}
 
-			return_node(w, &NodeAddress{
-				Id:      int(data["id"].(float64)),
-				Address: data["address"].(string),
-			})
+			return_node(w, nodeAddressFrom(data))
 
 			// return_node(w, &NodeAddress{
 			// 	Id:      found_successor.Id,
@@ -433,7 +547,7 @@ func nodeInfoHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		send_node_info(w)
+		s.send_node_info(w, node)
 	}
 }
 
@@ -452,12 +566,18 @@ func nodeInfoHandler(w http.ResponseWriter, r *http.Request) {
 // Response Codes:
 // 200 OK - Success
 // 400 Bad Request - Invalid request method or JSON payload
-func updateSuccessorHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) updateSuccessorHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != http.MethodPut {
 		return
 	}
 
+	target := s.vnode(r)
+	if target == nil {
+		http.Error(w, "Unknown virtual node", http.StatusNotFound)
+		return
+	}
+
 	var node *NodeAddress
 	err := json.NewDecoder(r.Body).Decode(&node)
 	if err != nil {
@@ -473,7 +593,8 @@ func updateSuccessorHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update the successor of the current node
-	serverInstance.node.SuccessorID = node
+	target.setSuccessor(node)
+	s.ringChanged()
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -481,13 +602,20 @@ func updateSuccessorHandler(w http.ResponseWriter, r *http.Request) {
 // updatePredecessorHandler handles HTTP PUT requests to update the predecessor of the current node.
 // It expects a JSON body containing the new predecessor's node address.
 // If the request method is not PUT or the JSON is invalid, it responds with a 400 Bad Request status.
-// On success, it updates the predecessor and responds with a 200 OK status.
-func updatePredecessorHandler(w http.ResponseWriter, r *http.Request) {
+// On success, it updates the predecessor and responds with a 200 OK status. With ?notify=true,
+// the predecessor is only updated if the new one is closer, as Chord's notify does.
+func (s *Server) updatePredecessorHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != http.MethodPut {
 		return
 	}
 
+	target := s.vnode(r)
+	if target == nil {
+		http.Error(w, "Unknown virtual node", http.StatusNotFound)
+		return
+	}
+
 	var node *NodeAddress
 	err := json.NewDecoder(r.Body).Decode(&node)
 	if err != nil {
@@ -502,8 +630,18 @@ func updatePredecessorHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A notify from the stabilization of another node only replaces a predecessor further away
+	if r.URL.Query().Get("notify") == "true" {
+		if target.offerPredecessor(node) {
+			s.ringChanged()
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	// Update the predecessor of the current node
-	serverInstance.node.PredecessorID = node
+	target.setPredecessor(node)
+	s.ringChanged()
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -525,11 +663,9 @@ func updatePredecessorHandler(w http.ResponseWriter, r *http.Request) {
 // - r: *http.Request containing the HTTP request.
 //
 // Note: This handler assumes the existence of several helper functions such as get_response, getNode, updateSuccessor, and updatePredecessor.
-func joinRingHandler(w http.ResponseWriter, r *http.Request) {
-
-	s := serverInstance
+func (s *Server) joinRingHandler(w http.ResponseWriter, r *http.Request) {
 
-	if s.crashed {
+	if s.crashed.Load() {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
@@ -540,80 +676,41 @@ func joinRingHandler(w http.ResponseWriter, r *http.Request) {
 
 	} else if r.Method == http.MethodPost {
 
-		successorID := r.URL.Query().Get("nprime")
-		if successorID == "" {
+		nprime := r.URL.Query().Get("nprime")
+		if nprime == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		// Sending a request to the successor node to get the node info
-		nodeInfo := fmt.Sprintf("http://%s/node-info?successor=%d", successorID, s.node.Id)
-		resp := get_response(nodeInfo)
-
-		if resp == nil {
-			return
-		}
-
-		// Decode the JSON response
-		var data map[string]interface{}
-		decoder := json.NewDecoder(resp.Body)
-		err := decoder.Decode(&data)
-
-		if err != nil {
-			http.Error(w, "Error decoding JSON", http.StatusInternalServerError)
+		// Refuse to join a ring that places keys differently from this node
+		if err := s.checkRingCompatibility(nprime); err != nil {
+			fmt.Fprintln(s.log, "Join rejected:", err)
+			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
 
-		// Update the successor of the current node
-		successorNode := getNode(data["address"].(string))
-
-		// Update the current nodes successor to the successor nodes successor
-		s.node.SuccessorID = &NodeAddress{
-			Id:      int(successorNode["id"].(float64)),
-			Address: successorNode["address"].(string),
+		// Refuse to join if any of the virtual node IDs is already taken in the ring
+		for _, node := range s.nodes {
+			if err := s.checkIDCollision(node, nprime); err != nil {
+				fmt.Fprintln(s.log, "Join rejected:", err)
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
 		}
 
-		my_address := &NodeAddress{
-			Id:      s.node.Id,
-			Address: s.node.Address,
+		// Every virtual node leaves the ring of its own and joins through nprime, one at a time
+		for _, node := range s.nodes {
+			node.reset()
 		}
 
-		if successorNode["predecessor"] == nil {
-
-			// Update the predecessor of the successor node
-			updatePredecessor(*s.node.SuccessorID, my_address)
-
-			// Update the successor of the successor node
-			updateSuccessor(*s.node.SuccessorID, my_address)
-
-			// Update the current nodes predecessor to the successor nodes predecessor
-			s.node.PredecessorID = &NodeAddress{
-				Id:      int(successorNode["id"].(float64)),
-				Address: successorNode["address"].(string),
+		for _, node := range s.nodes {
+			if err := s.joinRing(node, nprime); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
-
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("Node joined the ring"))
-			return
-		}
-
-		successorPredecessorData := successorNode["predecessor"].(map[string]interface{})
-		successorPredecessorAddress := successorPredecessorData["address"].(string)
-
-		// Update the current nodes predecessor to the successor nodes predecessor
-		predecessorData := getNode(successorPredecessorAddress)
-
-		// Update the current nodes predecessor to the successor nodes predecessor
-		s.node.PredecessorID = &NodeAddress{
-			Id:      int(predecessorData["id"].(float64)),
-			Address: predecessorData["address"].(string),
 		}
 
-		// Update my predecessor's successor to me
-		updateSuccessor(*s.node.PredecessorID, my_address)
-
-		// Update the predecessor of the successor node
-		updatePredecessor(*s.node.SuccessorID, my_address)
+		s.ringChanged()
 
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Node joined the ring"))
@@ -627,53 +724,129 @@ func joinRingHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func leaveHandler(w http.ResponseWriter, r *http.Request) {
+// checkIDCollision looks up the ID of node in the ring that nprime is part of,
+// and returns an error if another node in that ring already uses the same ID,
+// or if the ring cannot be asked, since the join cannot be checked then
+func (s *Server) checkIDCollision(node *Node, nprime string) error {
 
-	s := serverInstance
+	resp := s.get_response(fmt.Sprintf("http://%s/node-info?successor=%s", nprime, node.Id))
+	if resp == nil {
+		return fmt.Errorf("error connecting to %s to check node ID %s", nprime, node.Id)
+	}
+	defer resp.Body.Close()
 
-	if s.crashed {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		return
+	var data map[string]interface{}
+	if err := decodeJSON(resp.Body, &data); err != nil || data["id"] == nil {
+		return fmt.Errorf("error decoding the successor of node ID %s from %s", node.Id, nprime)
 	}
 
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+	// The successor of an ID is the node with that ID, if there is one.
+	// Finding ourselves is not a collision, e.g. after a restart or through a stale finger.
+	found := nodeAddressFrom(data)
+	if found.Id != node.Id || found.Address == node.Address {
+		return nil
 	}
 
-	// If the current node is the only node in the ring, the state is already correct
-	if s.node.PredecessorID == nil {
-		w.WriteHeader(http.StatusOK)
-		return
+	return fmt.Errorf("node ID %s is already used by %s", node.Id, found.Address)
+}
+
+// joinRing inserts a single virtual node into the ring that nprime is part of
+func (s *Server) joinRing(node *Node, nprime string) error {
+
+	// Sending a request to the successor node to get the node info
+	nodeInfo := fmt.Sprintf("http://%s/node-info?successor=%s", nprime, node.Id)
+	resp := s.get_response(nodeInfo)
+
+	if resp == nil {
+		return fmt.Errorf("error connecting to %s", nprime)
+	}
+
+	// Decode the JSON response
+	var data map[string]interface{}
+	err := decodeJSON(resp.Body, &data)
+
+	if err != nil {
+		return fmt.Errorf("error decoding JSON")
 	}
 
 	// Update the successor of the current node
-	updateSuccessor(*s.node.PredecessorID, s.node.SuccessorID)
+	successorNode := s.getNode(nodeAddressFrom(data))
+
+	// Update the current nodes successor to the successor nodes successor
+	successor := nodeAddressFrom(successorNode)
+	node.setSuccessor(successor)
+
+	my_address := node.address()
+
+	if successorNode["predecessor"] == nil {
+
+		// Update the predecessor of the successor node
+		s.updatePredecessor(*successor, my_address)
+
+		// Update the successor of the successor node
+		s.updateSuccessor(*successor, my_address)
+
+		// Update the current nodes predecessor to the successor nodes predecessor
+		node.setPredecessor(successor)
+		return nil
+	}
+
+	successorPredecessorData := successorNode["predecessor"].(map[string]interface{})
+
+	// Update the current nodes predecessor to the successor nodes predecessor
+	predecessorData := s.getNode(nodeAddressFrom(successorPredecessorData))
+
+	// Update the current nodes predecessor to the successor nodes predecessor
+	predecessor := nodeAddressFrom(predecessorData)
+	node.setPredecessor(predecessor)
+
+	// Update my predecessor's successor to me
+	s.updateSuccessor(*predecessor, my_address)
 
 	// Update the predecessor of the successor node
-	updatePredecessor(*s.node.SuccessorID, s.node.PredecessorID)
+	s.updatePredecessor(*successor, my_address)
 
-	// Remove the current node from the ring
-	s.node.PredecessorID = nil
+	return nil
+}
+
+func (s *Server) leaveHandler(w http.ResponseWriter, r *http.Request) {
 
-	s.node.SuccessorID = &NodeAddress{
-		Id:      s.node.Id,
-		Address: s.node.Address,
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
 	}
 
-	// Reset the finger table
-	for finger := range s.node.FingerTable {
-		fingerEntry := s.node.FingerTable[finger]
-		fingerEntry.SuccessorID = &NodeAddress{
-			Id:      s.node.Id,
-			Address: s.node.Address,
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	for _, node := range s.nodes {
+
+		// If the node is the only node in the ring, the state is already correct
+		predecessor, successor := node.predecessor(), node.successor()
+		if predecessor == nil {
+			continue
 		}
+
+		// Update the successor of the current node
+		s.updateSuccessor(*predecessor, successor)
+
+		// Update the predecessor of the successor node
+		s.updatePredecessor(*successor, predecessor)
+
+		// Remove the current node from the ring
+		node.reset()
 	}
 
+	// The virtual nodes go back to being a ring of their own
+	s.linkVirtualNodes()
+	s.ringChanged()
+
 	w.WriteHeader(http.StatusOK)
 }
 
-func simulateCrashHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) simulateCrashHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -692,12 +865,12 @@ func simulateCrashHandler(w http.ResponseWriter, r *http.Request) {
 			has left.
 		*/
 
-		serverInstance.crashed = true
+		s.crashed.Store(true)
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func simulateRecoverHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) simulateRecoverHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -712,8 +885,8 @@ func simulateRecoverHandler(w http.ResponseWriter, r *http.Request) {
 			should request to re-join the network via one of its previous neighbors
 		*/
 
-		if serverInstance.crashed {
-			serverInstance.crashed = false
+		if s.crashed.Load() {
+			s.crashed.Store(false)
 			w.WriteHeader(http.StatusOK)
 		}
 	}
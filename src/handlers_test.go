@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestDelete deletes keys through their owner and through the other server, and checks that the key is
+// gone for clients, that a second delete answers 404, and that both replicas keep a tombstone
+func TestDelete(t *testing.T) {
+	fastMaintenance(t)
+
+	servers := []*testServer{startTestServer(t, 1), startTestServer(t, 1)}
+	defer func() {
+		for _, ts := range servers {
+			ts.stop()
+		}
+	}()
+	if status, err := send(http.MethodPost, "http://"+servers[1].address+"/join?nprime="+servers[0].address, ""); err != nil || status != http.StatusOK {
+		t.Fatalf("join: %d %v", status, err)
+	}
+	waitForRing(t, servers[0], 2)
+
+	storage := func(ts *testServer, key, query string) string {
+		return "http://" + ts.address + "/storage/" + key + "?consistency=all" + query
+	}
+
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		ts := servers[i%len(servers)]
+
+		if status, err := send(http.MethodDelete, storage(ts, key, ""), ""); err != nil || status != http.StatusNotFound {
+			t.Errorf("delete of missing %s: %d %v, want 404", key, status, err)
+		}
+		if status, err := send(http.MethodPut, storage(ts, key, ""), "value"); err != nil || status != http.StatusOK {
+			t.Fatalf("put %s: %d %v", key, status, err)
+		}
+		if status, err := send(http.MethodDelete, storage(ts, key, ""), ""); err != nil || status != http.StatusOK {
+			t.Errorf("delete %s: %d %v, want 200", key, status, err)
+		}
+		if status, err := send(http.MethodDelete, storage(ts, key, ""), ""); err != nil || status != http.StatusNotFound {
+			t.Errorf("second delete of %s: %d %v, want 404", key, status, err)
+		}
+
+		for _, other := range servers {
+			if status, err := send(http.MethodGet, storage(other, key, ""), ""); err != nil || status != http.StatusNotFound {
+				t.Errorf("get %s from %s after the delete: %d %v, want 404", key, other.address, status, err)
+			}
+			if record := other.storage.record(key); record == nil || !record.Deleted {
+				t.Errorf("%s holds %+v for %s, want a tombstone", other.address, record, key)
+			}
+		}
+
+		// The tombstone does not keep the key from being created again
+		if status, err := send(http.MethodPut, storage(ts, key, ""), "again"); err != nil || status != http.StatusOK {
+			t.Errorf("put %s after the delete: %d %v, want 200", key, status, err)
+		}
+	}
+}
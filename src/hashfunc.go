@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+	"sort"
+)
+
+// HashFunction places keys and nodes on the identifier circle.
+// All nodes in a ring must use the same hash function and identifier space.
+type HashFunction interface {
+	Name() string
+
+	// Bits is the size of the hash in bits, the largest identifier space the function can fill
+	Bits() int
+
+	Sum(data []byte) []byte
+}
+
+// hashFunctions holds every hash function that can be picked with -hash
+var hashFunctions = map[string]HashFunction{
+	"sha1":     sha1Hash{},
+	"sha256":   sha256Hash{},
+	"xxhash":   xxHash{},
+	"identity": identityHash{},
+	"ordered":  orderedHash{},
+}
+
+// keyHash is the hash function used by this node, chosen with -hash
+var keyHash HashFunction = sha256Hash{}
+
+// hashFunctionNames returns the names of all hash functions, sorted
+func hashFunctionNames() []string {
+	names := make([]string, 0, len(hashFunctions))
+	for name := range hashFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type sha1Hash struct{}
+
+func (sha1Hash) Name() string { return "sha1" }
+func (sha1Hash) Bits() int    { return sha1.Size * 8 }
+
+func (sha1Hash) Sum(data []byte) []byte {
+	sum := sha1.Sum(data)
+	return sum[:]
+}
+
+type sha256Hash struct{}
+
+func (sha256Hash) Name() string { return "sha256" }
+func (sha256Hash) Bits() int    { return sha256.Size * 8 }
+
+func (sha256Hash) Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// identityHash places a numeric key at its own value, which makes placement easy to predict in tests.
+// Other keys are read as a big-endian number.
+type identityHash struct{}
+
+func (identityHash) Name() string { return "identity" }
+func (identityHash) Bits() int    { return maxIdentifierSpace }
+
+func (identityHash) Sum(data []byte) []byte {
+	if value, ok := new(big.Int).SetString(string(data), 10); ok && value.Sign() >= 0 {
+		return value.Bytes()
+	}
+	return data
+}
+
+// orderedHash places keys in the order of their bytes: a key is placed at its first bytes, read as a
+// number as large as the identifier space. Keys that start alike end up next to each other, so a
+// range of keys is a range of the ring, at the cost of an uneven spread of the keys.
+type orderedHash struct{}
+
+func (orderedHash) Name() string { return "ordered" }
+func (orderedHash) Bits() int    { return maxIdentifierSpace }
+
+func (orderedHash) Sum(data []byte) []byte {
+	padded := make([]byte, maxIdentifierSpace/8)
+	copy(padded, data)
+	value := new(big.Int).SetBytes(padded)
+	return value.Rsh(value, uint(maxIdentifierSpace-keyIdentifierSpace)).Bytes()
+}
+
+// nodeHash places nodes on the ring. It is the hash function of the keys, except with ordered
+// placement, where nodes hashed like keys would all end up where their addresses start.
+func nodeHash(input string) ID {
+	if _, ok := keyHash.(orderedHash); ok {
+		return idFromBytes(sha256Hash{}.Sum([]byte(input)))
+	}
+	return hash(input)
+}
+
+// xxHash is the 64 bit xxHash (XXH64) with seed 0. It is much faster than the cryptographic hashes,
+// but only fills identifier spaces of up to 64 bits.
+type xxHash struct{}
+
+func (xxHash) Name() string { return "xxhash" }
+func (xxHash) Bits() int    { return 64 }
+
+func (xxHash) Sum(data []byte) []byte {
+	sum := make([]byte, 8)
+	binary.BigEndian.PutUint64(sum, xxh64(data))
+	return sum
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxh64(data []byte) uint64 {
+	length := uint64(len(data))
+	var seed, h uint64
+
+	if len(data) >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+
+		for len(data) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:32]))
+			data = data[32:]
+		}
+
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+
+	h += length
+
+	for len(data) >= 8 {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data[0:8]))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+		data = data[8:]
+	}
+
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data[0:4])) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, value uint64) uint64 {
+	acc ^= xxRound(0, value)
+	return acc*xxPrime1 + xxPrime4
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestHashFunctions(t *testing.T) {
+
+	tests := []struct {
+		hash  HashFunction
+		input string
+		want  string
+	}{
+		{sha1Hash{}, "abc", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{sha256Hash{}, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{xxHash{}, "", "ef46db3751d8e999"},
+		{xxHash{}, "a", "d24ec4f1a98c6e5b"},
+		{xxHash{}, "abc", "44bc2cf5ad770999"},
+		{xxHash{}, "Nobody inspects the spammish repetition", "fbcea83c8a378bf1"},
+		{identityHash{}, "258", "0102"},
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(test.hash.Sum([]byte(test.input))); got != test.want {
+			t.Errorf("%s(%q) = %s, want %s", test.hash.Name(), test.input, got, test.want)
+		}
+	}
+}
+
+func TestOrderedHashKeepsKeyOrder(t *testing.T) {
+
+	saved := keyHash
+	keyHash = orderedHash{}
+	defer func() { keyHash = saved }()
+
+	bits := keyIdentifierSpace
+	defer func() { keyIdentifierSpace = bits }()
+	for _, space := range []int{16, 64, 160} {
+		keyIdentifierSpace = space
+
+		keys := []string{"", "a", "a0", "ab", "abc", "b", "user/1", "user/2", "users", "\xff\xff"}
+		for i := 1; i < len(keys); i++ {
+			if hash(keys[i-1]).Cmp(hash(keys[i])) > 0 {
+				t.Errorf("%d bits: %q placed after %q", space, keys[i-1], keys[i])
+			}
+		}
+		if hash("user/1") == hash("user/2") && space > 48 {
+			t.Errorf("%d bits: keys that differ in their 7th byte share a place", space)
+		}
+	}
+}
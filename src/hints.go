@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Hint is a write for an owner that was down, kept by another node until the owner is back
+type Hint struct {
+	Key         string       `json:"key"`
+	Value       []byte       `json:"value"`
+	ContentType string       `json:"content_type,omitempty"`
+	TTL         string       `json:"ttl,omitempty"` // Asked for with ?ttl=, counted from when the hint is delivered
+	Consistency string       `json:"consistency"`
+	Context     string       `json:"context,omitempty"` // Causal context of the write in the vector clock mode
+	Credentials string       `json:"-"`                 // Authorization header of the client, for rings without -peer-secret
+	Owner       *NodeAddress `json:"owner"`
+	Created     time.Time    `json:"created"`
+	Expires     time.Time    `json:"expires"`
+}
+
+// hintStore holds the hinted writes of a server until they are handed over or expire
+type hintStore struct {
+	loop  *maintenanceLoop
+	mu    sync.Mutex
+	hints []*Hint
+}
+
+// isDown reports whether the server of address does not answer /helloworld, as crashed servers do
+func (s *Server) isDown(address *NodeAddress) bool {
+	client := s.newClient(5 * time.Second)
+	resp, err := client.Get(nodeURL(address, "helloworld"))
+	if err != nil {
+		return true
+	}
+	resp.Body.Close()
+	return resp.StatusCode != http.StatusOK
+}
+
+// storeHint keeps a write of key for owner until owner can take it. Hints are only kept in
+// memory, so the hints of a server that restarts are lost.
+func (s *Server) storeHint(owner *NodeAddress, key string, value []byte, contentType, ttl, level, context, credentials string) {
+
+	now := s.clock()
+	hint := &Hint{Key: key, Value: value, ContentType: contentType, TTL: ttl, Consistency: level, Context: context, Credentials: credentials, Owner: owner, Created: now, Expires: now.Add(*hintExpiry)}
+
+	s.hints.mu.Lock()
+	s.hints.hints = append(s.hints.hints, hint)
+	s.hints.mu.Unlock()
+
+	metrics.inc("hints_stored")
+	fmt.Fprintln(s.log, "Stored hint for key", key, "owned by", owner.Address)
+}
+
+// pendingHints drops the expired hints and returns the others grouped by the address of their owner
+func (s *Server) pendingHints() map[string][]*Hint {
+
+	s.hints.mu.Lock()
+	defer s.hints.mu.Unlock()
+
+	now := s.clock()
+	pending := make(map[string][]*Hint)
+	kept := s.hints.hints[:0]
+	for _, hint := range s.hints.hints {
+		if now.After(hint.Expires) {
+			metrics.inc("hints_expired")
+			fmt.Fprintln(s.log, "Hint for key", hint.Key, "owned by", hint.Owner.Address, "expired")
+			continue
+		}
+		kept = append(kept, hint)
+		pending[hint.Owner.Address] = append(pending[hint.Owner.Address], hint)
+	}
+	s.hints.hints = kept
+	return pending
+}
+
+// removeHints removes the handed over hints from the store
+func (s *Server) removeHints(done map[*Hint]bool) {
+
+	s.hints.mu.Lock()
+	defer s.hints.mu.Unlock()
+
+	kept := s.hints.hints[:0]
+	for _, hint := range s.hints.hints {
+		if !done[hint] {
+			kept = append(kept, hint)
+		}
+	}
+	s.hints.hints = kept
+}
+
+// deliverHintsRound hands the hints over to the owners that answer /helloworld again.
+// Returns whether any hint was delivered.
+func (s *Server) deliverHintsRound() bool {
+
+	if s.crashed.Load() {
+		return false
+	}
+
+	done := make(map[*Hint]bool)
+	for _, hints := range s.pendingHints() {
+		if s.isDown(hints[0].Owner) {
+			continue
+		}
+		for _, hint := range hints {
+			delivered, err := s.deliverHint(hint)
+			if err != nil {
+				// The owner is gone again, try the rest in a later round
+				fmt.Fprintln(s.log, "Error delivering hint for key", hint.Key, "to", hint.Owner.Address, ":", err)
+				break
+			}
+			done[hint] = true
+			if delivered {
+				metrics.inc("hints_delivered")
+			} else {
+				metrics.inc("hints_conflicts")
+			}
+		}
+	}
+
+	s.removeHints(done)
+	return len(done) > 0
+}
+
+// deliverHint writes a hint to its owner. A write refused because the key was written in the
+// meantime is not delivered, but is done as well, since the storage never overwrites a key.
+func (s *Server) deliverHint(hint *Hint) (delivered bool, err error) {
+
+	endpoint := "storage/" + url.PathEscape(hint.Key) + "?consistency=" + hint.Consistency
+	if hint.TTL != "" {
+		endpoint += "&ttl=" + url.QueryEscape(hint.TTL)
+	}
+	req, err := http.NewRequest(http.MethodPut, nodeURL(hint.Owner, endpoint), bytes.NewReader(hint.Value))
+	if err != nil {
+		return false, err
+	}
+	// Pass the client's token on, as the forwarded write did, in case the ring is not using signed requests
+	req.Header.Set("Authorization", hint.Credentials)
+	req.Header.Set("Content-Type", hint.ContentType)
+	if hint.Context != "" {
+		req.Header.Set(contextHeader, hint.Context)
+	}
+
+	client := s.newClient(10 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		return true, nil
+	case http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("owner answered %d", resp.StatusCode)
+}
+
+// hintsHandler lists the hints this server keeps for owners that were down
+func (s *Server) hintsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.hints.mu.Lock()
+	hints := append([]*Hint{}, s.hints.hints...)
+	s.hints.mu.Unlock()
+
+	writeJSON(w, hints)
+}
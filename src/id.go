@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+)
+
+// ID is a position on the identifier circle, between 0 and 2^keyIdentifierSpace - 1.
+// It is stored as a fixed size big-endian number, so identifier spaces of 160 or 256 bits
+// work the same as small ones, and IDs can be compared with == and used as map keys.
+type ID [maxIdentifierSpace / 8]byte
+
+// maxIdentifierSpace is the largest identifier space supported, the size of a SHA-256 hash
+const maxIdentifierSpace = 256
+
+func newID(value int64) ID {
+	return idFromBig(big.NewInt(value))
+}
+
+// idFromBytes interprets b as a big-endian number and reduces it into the identifier space
+func idFromBytes(b []byte) ID {
+	return idFromBig(new(big.Int).SetBytes(b))
+}
+
+// idFromBig reduces value into the identifier space
+func idFromBig(value *big.Int) ID {
+	var id ID
+	new(big.Int).Mod(value, ringSize()).FillBytes(id[:])
+	return id
+}
+
+// parseID parses a decimal ID and checks that it lies within the identifier space
+func parseID(text string) (ID, error) {
+	value, ok := new(big.Int).SetString(text, 10)
+	if !ok {
+		return ID{}, fmt.Errorf("invalid ID %q", text)
+	}
+	if value.Sign() < 0 || value.Cmp(ringSize()) >= 0 {
+		return ID{}, fmt.Errorf("ID %s outside of the identifier space [0, 2^%d)", text, keyIdentifierSpace)
+	}
+	return idFromBig(value), nil
+}
+
+// ringSize returns the number of IDs on the circle, 2^keyIdentifierSpace
+func ringSize() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(keyIdentifierSpace))
+}
+
+// bigInt returns the value of the ID as a big integer
+func (id ID) bigInt() *big.Int {
+	return new(big.Int).SetBytes(id[:])
+}
+
+// Cmp compares two IDs as numbers and returns -1, 0 or +1
+func (id ID) Cmp(other ID) int {
+	return bytes.Compare(id[:], other[:])
+}
+
+func (id ID) Equal(other ID) bool {
+	return id.Cmp(other) == 0
+}
+
+// addPowerOfTwo returns (id + 2^i) mod 2^keyIdentifierSpace, the start of finger i
+func (id ID) addPowerOfTwo(i int) ID {
+	return idFromBig(new(big.Int).Add(id.bigInt(), new(big.Int).Lsh(big.NewInt(1), uint(i))))
+}
+
+func (id ID) String() string {
+	return id.bigInt().String()
+}
+
+// MarshalJSON writes the ID as a plain JSON number, however many digits it has
+func (id ID) MarshalJSON() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalJSON accepts both a JSON number and a quoted decimal string
+func (id *ID) UnmarshalJSON(data []byte) error {
+	text := string(bytes.Trim(data, `"`))
+
+	value, ok := new(big.Int).SetString(text, 10)
+	if !ok || value.Sign() < 0 || value.BitLen() > maxIdentifierSpace {
+		return fmt.Errorf("invalid ID %s", data)
+	}
+	value.FillBytes(id[:])
+	return nil
+}
+
+// Helper function to check if 'key' is in the interval (n1, n2] with wraparound handling
+func isBetweenInclusive(n1, key, n2 ID) bool {
+	if n1.Cmp(n2) < 0 {
+		return n1.Cmp(key) < 0 && key.Cmp(n2) <= 0
+	}
+	return n1.Cmp(key) < 0 || key.Cmp(n2) <= 0
+}
+
+// Helper function to check if 'key' is in the interval (n1, n2) with wraparound handling
+func isBetween(n1, key, n2 ID) bool {
+	if n1.Cmp(n2) < 0 {
+		return n1.Cmp(key) < 0 && key.Cmp(n2) < 0
+	}
+	return n1.Cmp(key) < 0 || key.Cmp(n2) < 0
+}
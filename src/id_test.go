@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestIDFromBig(t *testing.T) {
+	smallRing(t)
+
+	tests := []struct {
+		value int64
+		want  int64
+	}{
+		{0, 0},
+		{7, 7},
+		{15, 15},
+		{16, 0},
+		{17, 1},
+		{-1, 15},
+		{-16, 0},
+	}
+	for _, test := range tests {
+		if got := idFromBig(big.NewInt(test.value)); got != newID(test.want) {
+			t.Errorf("idFromBig(%d) = %s, want %d", test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsBetween(t *testing.T) {
+	smallRing(t)
+
+	tests := []struct {
+		n1, key, n2        int64
+		between, inclusive bool
+	}{
+		{2, 3, 5, true, true},
+		{2, 2, 5, false, false},
+		{2, 5, 5, false, true},
+		{2, 6, 5, false, false},
+		// Ranges that wrap around zero
+		{12, 13, 4, true, true},
+		{12, 0, 4, true, true},
+		{12, 4, 4, false, true},
+		{12, 12, 4, false, false},
+		{12, 8, 4, false, false},
+		// A range from a node to itself is the whole ring except the node, or with it
+		{5, 6, 5, true, true},
+		{5, 4, 5, true, true},
+		{5, 5, 5, false, true},
+	}
+	for _, test := range tests {
+		n1, key, n2 := newID(test.n1), newID(test.key), newID(test.n2)
+		if got := isBetween(n1, key, n2); got != test.between {
+			t.Errorf("isBetween(%d, %d, %d) = %v, want %v", test.n1, test.key, test.n2, got, test.between)
+		}
+		if got := isBetweenInclusive(n1, key, n2); got != test.inclusive {
+			t.Errorf("isBetweenInclusive(%d, %d, %d) = %v, want %v", test.n1, test.key, test.n2, got, test.inclusive)
+		}
+	}
+}
+
+func TestLargeIDs(t *testing.T) {
+	bits := keyIdentifierSpace
+	keyIdentifierSpace = 160
+	defer func() { keyIdentifierSpace = bits }()
+
+	// 2^160 - 1, the last ID of a 160 bit ring
+	last := "1461501637330902918203684832716283019655932542975"
+
+	id, err := parseID(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.String() != last {
+		t.Errorf("parseID(%s).String() = %s", last, id.String())
+	}
+	if _, err := parseID("1461501637330902918203684832716283019655932542976"); err == nil {
+		t.Errorf("parseID accepted 2^160")
+	}
+
+	// Finger starts wrap around the ring above 64 bits as well
+	if got := id.addPowerOfTwo(0); got != newID(0) {
+		t.Errorf("%s + 1 = %s, want 0", last, got)
+	}
+	if got := newID(1).addPowerOfTwo(100).String(); got != "1267650600228229401496703205377" {
+		t.Errorf("1 + 2^100 = %s", got)
+	}
+
+	var decoded ID
+	if err := json.Unmarshal([]byte(last), &decoded); err != nil || decoded != id {
+		t.Errorf("JSON %s decoded to %s, %v", last, decoded, err)
+	}
+	if data, _ := json.Marshal(id); string(data) != last {
+		t.Errorf("ID encoded to JSON %s, want %s", data, last)
+	}
+}
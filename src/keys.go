@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// KeyInfo describes a key stored on a server
+type KeyInfo struct {
+	Key     string `json:"key"`
+	Id      ID     `json:"id"`
+	Size    int    `json:"size"`
+	Version int64  `json:"version"`
+	Deleted bool   `json:"deleted,omitempty"`
+	// The virtual node of the server that owns the key by the (predecessor, self] rule,
+	// null if the server only keeps a copy
+	Owner *ID    `json:"owner"`
+	Node  string `json:"node,omitempty"` // Address of the server, in listings of the whole ring
+}
+
+// KeysPage is one page of a key listing. Next is the token of the next page, empty on the last page.
+type KeysPage struct {
+	Keys []*KeyInfo `json:"keys"`
+	Next string     `json:"next,omitempty"`
+}
+
+// keysToken is where a listing of the whole ring goes on: after a key on a server
+type keysToken struct {
+	Node  string `json:"node"`
+	After string `json:"after"`
+}
+
+// size returns the number of bytes a record holds
+func (r *Record) size() int {
+	if r.CRDT != nil {
+		return len(r.CRDT.encode())
+	}
+	if r.Manifest != nil {
+		return int(r.Manifest.Size)
+	}
+	size := len(r.Value)
+	for _, sib := range r.Siblings {
+		size += len(sib.Value)
+	}
+	return size
+}
+
+// strictOwner returns the virtual node of this server whose (predecessor, self] range holds id, or nil.
+// Unlike ownerOf, a node that does not know its predecessor owns nothing.
+func (s *Server) strictOwner(id ID) *Node {
+	for _, node := range s.nodes {
+		if node.predecessor() != nil && node.owns(id) {
+			return node
+		}
+	}
+	return nil
+}
+
+// keysHandler lists the keys stored on this server in order, a page at a time:
+// GET /keys?limit=<n>&prefix=<prefix>&token=<next token of the previous page>.
+// Tombstones are listed with ?deleted=true. ?scope=cluster lists the keys of every
+// server instead, following the successor pointers from this node.
+func (s *Server) keysHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := scanLimit(query.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := base64.RawURLEncoding.DecodeString(query.Get("token"))
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusBadRequest)
+		return
+	}
+	prefix, deleted := query.Get("prefix"), query.Get("deleted") == "true"
+
+	switch query.Get("scope") {
+	case "", "local":
+		writeJSON(w, s.localKeys(prefix, string(token), limit, deleted))
+
+	case "cluster":
+		var position keysToken
+		if len(token) > 0 && json.Unmarshal(token, &position) != nil {
+			http.Error(w, "Invalid token", http.StatusBadRequest)
+			return
+		}
+		page, status, err := s.clusterKeys(prefix, position, limit, deleted)
+		if err != nil {
+			fmt.Fprintln(s.log, "Listing the keys of the ring failed:", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, page)
+
+	default:
+		http.Error(w, "Unknown scope, must be local or cluster", http.StatusBadRequest)
+	}
+}
+
+// localKeys returns a page of the keys stored on this server
+func (s *Server) localKeys(prefix, after string, limit int, deleted bool) *KeysPage {
+
+	include := func(key string, record *Record) bool { return deleted || record.live(s.clock()) }
+	keys, records := s.storage.scan(prefix, after, limit, include)
+
+	page := &KeysPage{Keys: make([]*KeyInfo, len(keys))}
+	for i, key := range keys {
+		id := keyID(key)
+		info := &KeyInfo{Key: key, Id: id, Size: records[i].size(), Version: records[i].Version, Deleted: !records[i].live(s.clock())}
+		if owner := s.strictOwner(id); owner != nil {
+			info.Owner = &owner.Id
+		}
+		page.Keys[i] = info
+	}
+	if len(keys) == limit {
+		page.Next = base64.RawURLEncoding.EncodeToString([]byte(keys[limit-1]))
+	}
+	return page
+}
+
+// clusterKeys returns a page of the keys of all servers, server by server in the order of the ring.
+// A ring walk that does not get back to this node could have missed servers, so it fails the page.
+func (s *Server) clusterKeys(prefix string, position keysToken, limit int, deleted bool) (*KeysPage, int, error) {
+
+	report := s.walkRing(s.nodes[0].address())
+	if !report.Closed {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("the ring walk did not get around the ring")
+	}
+
+	var servers []*NodeAddress
+	seen := make(map[string]bool)
+	start := 0
+	for _, member := range report.Members {
+		if seen[member.Address] {
+			continue
+		}
+		seen[member.Address] = true
+		if member.Address == position.Node {
+			start = len(servers)
+		}
+		servers = append(servers, member.address())
+	}
+	if position.Node != "" && !seen[position.Node] {
+		return nil, http.StatusConflict, fmt.Errorf("server %s of the token is not in the ring anymore", position.Node)
+	}
+
+	page := &KeysPage{Keys: []*KeyInfo{}}
+	after := position.After
+	for _, server := range servers[start:] {
+
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		query.Set("limit", strconv.Itoa(limit-len(page.Keys)))
+		query.Set("token", base64.RawURLEncoding.EncodeToString([]byte(after)))
+		if deleted {
+			query.Set("deleted", "true")
+		}
+
+		var local KeysPage
+		if err := s.fetchJSON(nodeURL(server, "keys?"+query.Encode()), &local); err != nil {
+			return nil, http.StatusServiceUnavailable, fmt.Errorf("%s: %v", server.Address, err)
+		}
+		for _, info := range local.Keys {
+			info.Node = server.Address
+			page.Keys = append(page.Keys, info)
+		}
+
+		if len(page.Keys) == limit {
+			last := page.Keys[limit-1]
+			jsonData, _ := json.Marshal(keysToken{Node: last.Node, After: last.Key})
+			page.Next = base64.RawURLEncoding.EncodeToString(jsonData)
+			break
+		}
+		after = ""
+	}
+	return page, http.StatusOK, nil
+}
@@ -2,15 +2,70 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 func main() {
 
-	nodeID, err := strconv.Atoi(os.Args[1])
-	newNode := os.Args[2]
+	flag.Parse()
+
+	hashFunction, ok := hashFunctions[*hashName]
+	if !ok {
+		fmt.Printf("Unknown hash function %q, must be one of %s\n", *hashName, strings.Join(hashFunctionNames(), ", "))
+		return
+	}
+	keyHash = hashFunction
+
+	if *fingersPerRound < 1 {
+		fmt.Println("Fingers per round must be at least 1")
+		return
+	}
+
+	if *merkleDepth < 0 || *merkleDepth > maxMerkleDepth {
+		fmt.Printf("Merkle depth must be between 0 and %d\n", maxMerkleDepth)
+		return
+	}
+
+	if *replicas < 1 {
+		fmt.Println("Number of replicas must be at least 1")
+		return
+	}
+
+	switch *defaultConsistency {
+	case consistencyOne, consistencyQuorum, consistencyAll:
+	default:
+		fmt.Printf("Unknown consistency level %q, must be one, quorum or all\n", *defaultConsistency)
+		return
+	}
+
+	if *conflictMode != conflictLWW && *conflictMode != conflictVectorClock {
+		fmt.Printf("Unknown conflict mode %q, must be lww or vclock\n", *conflictMode)
+		return
+	}
+
+	switch *evictionPolicy {
+	case evictNone, evictLRU, evictTTL:
+	default:
+		fmt.Printf("Unknown eviction policy %q, must be none, lru or ttl\n", *evictionPolicy)
+		return
+	}
+
+	if *chunkSize < 1 {
+		fmt.Println("The chunk size must be at least 1 byte")
+		return
+	}
+
+	if *simulationScript != "" {
+		os.Exit(simulate(*simulationScript, *simulationSeed, *simulationVerbose))
+	}
+
+	var nodeID ID
+	err := nodeID.UnmarshalJSON([]byte(flag.Arg(0)))
+	newNode := flag.Arg(1)
 
 	if err != nil {
 		fmt.Println("Error parsing node ID:", err)
@@ -19,12 +74,22 @@ func main() {
 
 	if newNode == "true" {
 		fmt.Println("Created new node")
-		keyIdentifierSpace, err = strconv.Atoi(os.Args[4])
+		keyIdentifierSpace, err = strconv.Atoi(flag.Arg(3))
 		if err != nil {
 			fmt.Println("Error parsing key identifier space:", err)
 			return
 		}
 
+		if keyIdentifierSpace < 1 || keyIdentifierSpace > keyHash.Bits() {
+			fmt.Printf("Key identifier space must be between 1 and %d bits with the %s hash function\n", keyHash.Bits(), keyHash.Name())
+			return
+		}
+
+		if *vnodeCount < 1 || (keyIdentifierSpace < 31 && *vnodeCount > 1<<keyIdentifierSpace) {
+			fmt.Println("Number of virtual nodes must be between 1 and the size of the identifier space")
+			return
+		}
+
 		createNewNode()
 
 	} else {
@@ -48,7 +113,7 @@ func main() {
 
 		var foundNode *Node
 		for _, node := range nodes {
-			if node.Id == nodeID {
+			if node.Id.Equal(nodeID) {
 				foundNode = node
 				break
 			}
@@ -59,6 +124,11 @@ func main() {
 			return
 		}
 
-		InitServer(foundNode)
+		if len(foundNode.FingerTable) > keyHash.Bits() {
+			fmt.Printf("The %s hash function supports at most %d bits\n", keyHash.Name(), keyHash.Bits())
+			return
+		}
+
+		InitServer([]*Node{foundNode})
 	}
 }
@@ -7,230 +7,326 @@ import (
 	"time"
 )
 
-func periodicUpdateFingerTable() {
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+// adaptiveInterval is the time between two rounds of a maintenance task.
+// It doubles after every round that changed nothing, up to max, and drops back to min after a change.
+type adaptiveInterval struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
 
-	for range ticker.C {
-		stabilize()
-		checkPredecessor()
-		updateFingerTable()
+func newAdaptiveInterval(min, max time.Duration) *adaptiveInterval {
+	if max < min {
+		max = min
 	}
+	return &adaptiveInterval{min: min, max: max, current: min}
 }
 
-func stabilize() {
-
-	// Psudo code
-	// 1. x = successor.predecessor
-	// 2. if x is between current node and successor
-	// 3. 	successor = x
-	// 4. notify successor
+// next returns the time to wait before the next round, given whether the last round changed anything
+func (a *adaptiveInterval) next(changed bool) time.Duration {
+	if changed {
+		a.current = a.min
+	} else if a.current < a.max {
+		a.current = min(2*a.current, a.max)
+	}
+	return a.current
+}
 
-	s := serverInstance
-	successor := s.node.SuccessorID
+// maintenanceLoop runs a maintenance task with an adaptive interval
+type maintenanceLoop struct {
+	interval *adaptiveInterval
+	wake     chan struct{}
+	done     chan struct{}
+}
 
-	// Get the predecessor of the successor node
-	request := fmt.Sprintf("http://%s/node-info?successor=%d", successor.Address, s.node.Id)
+func newMaintenanceLoop(min, max time.Duration) *maintenanceLoop {
+	return &maintenanceLoop{
+		interval: newAdaptiveInterval(min, max),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(request)
+// run calls task until the loop is stopped. The task reports whether it changed the ring.
+func (l *maintenanceLoop) run(task func() bool) {
+	wait := l.interval.current
 
-	if err != nil {
-		return
+	for {
+		select {
+		case <-time.After(wait):
+		case <-l.wake:
+		case <-l.done:
+			return
+		}
+		wait = l.interval.next(task())
 	}
+}
 
-	var data map[string]interface{}
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(&data)
+// stop ends the loop after the round it is running, if any
+func (l *maintenanceLoop) stop() {
+	close(l.done)
+}
 
-	if err != nil {
-		return
+// speedUp makes the loop run its task right away and go back to the shortest interval
+func (l *maintenanceLoop) speedUp() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
 	}
+}
 
-	// Get info about the successor node
-	request = fmt.Sprintf("http://%s/node-info", data["address"].(string))
-	client = &http.Client{Timeout: 10 * time.Second}
-	resp, err = client.Get(request)
+// ringChanged is called when the membership of the ring changed, e.g. after a join or leave,
+// so the maintenance loops repair the ring and the replicas quickly
+func (s *Server) ringChanged() {
+	s.stabilizeLoop.speedUp()
+	s.fingerLoop.speedUp()
+	s.antiEntropy.loop.speedUp()
+	s.hints.loop.speedUp()
+
+	// Watches find the owners of their keys again, here and at the servers that relay from this one
+	s.relays.ringChanged()
+	s.watches.publish(&WatchEvent{Type: "ring", Node: s.nodes[0].Address, Time: s.clock()})
+}
 
-	if err != nil {
-		return
+// maintenanceTask is a maintenance loop together with the round it runs
+type maintenanceTask struct {
+	loop  *maintenanceLoop
+	round func() bool
+}
+
+// maintenanceTasks returns the background tasks of the server, each of which runs in a loop of its own
+func (s *Server) maintenanceTasks() []maintenanceTask {
+	return []maintenanceTask{
+		{loop: s.stabilizeLoop, round: s.stabilizeRound},
+		{loop: s.fingerLoop, round: s.fixFingersRound},
+		{loop: s.antiEntropy.loop, round: s.antiEntropyRound},
+		{loop: s.hints.loop, round: s.deliverHintsRound},
+		{loop: s.expiryLoop, round: s.expireRound},
+		{loop: s.chunkGCLoop, round: s.chunkGCRound},
 	}
+}
 
-	decoder = json.NewDecoder(resp.Body)
-	err = decoder.Decode(&data)
+// stabilizeRound stabilizes every virtual node, checks its predecessor and refreshes its successor list once.
+// Returns whether a successor, predecessor or the successor list changed.
+func (s *Server) stabilizeRound() bool {
+	changed := false
+	for _, node := range s.nodes {
+		successor, predecessor := node.successor(), node.predecessor()
 
-	if err != nil {
-		return
+		s.stabilize(node)
+		s.checkPredecessor(node)
+
+		if !sameNode(successor, node.successor()) || !sameNode(predecessor, node.predecessor()) {
+			changed = true
+		}
+
+		if s.updateSuccessors(node) {
+			changed = true
+		}
 	}
+	return changed
+}
 
-	if data["predecessor"] == nil {
-		notify(successor.Address)
-		return
+// fixFingersRound refreshes the next few fingers of every virtual node. Returns whether a finger changed.
+func (s *Server) fixFingersRound() bool {
+	changed := false
+	for _, node := range s.nodes {
+		if s.fixFingers(node, *fingersPerRound) {
+			changed = true
+		}
 	}
+	return changed
+}
 
-	predecessorData := data["predecessor"].(map[string]interface{})
-	predecessorAddress := predecessorData["address"].(string)
+func (s *Server) stabilize(node *Node) {
 
-	// Get the predecessor of the successor node
-	request = fmt.Sprintf("http://%s/node-info", predecessorAddress)
-	client = &http.Client{Timeout: 10 * time.Second}
-	resp, err = client.Get(request)
+	// Psudo code
+	// 1. x = successor.predecessor
+	// 2. if x is between current node and successor
+	// 3. 	successor = x
+	// 4. notify successor
+
+	successor := node.successor()
+
+	// The successor is notified however the lookup goes, so it learns of this node even if its
+	// predecessor is stale or cannot be reached
+	defer s.notify(node)
+
+	// Get info about the successor node
+	request := nodeURL(successor, "node-info")
+	client := s.newClient(10 * time.Second)
+	resp, err := client.Get(request)
 
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
+
+	// A crashed successor answers with an error
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
 
-	decoder = json.NewDecoder(resp.Body)
-	err = decoder.Decode(&data)
+	var data map[string]interface{}
+	err = decodeJSON(resp.Body, &data)
 
 	if err != nil {
 		return
 	}
 
-	predecessor := data
-
-	// Check if the predecessor of the successor node is between the current node and the successor
-	if isBetween(s.node.Id, int(predecessor["id"].(float64)), successor.Id) {
-		s.node.SuccessorID = &NodeAddress{
-			Id:      int(predecessor["id"].(float64)),
-			Address: predecessor["address"].(string),
-		}
+	predecessorData, ok := data["predecessor"].(map[string]interface{})
+	if !ok {
+		return
 	}
+	predecessor := nodeAddressFrom(predecessorData)
 
-	// Notify the successor node
-	notify(successor.Address)
+	// Check if the predecessor of the successor node is between the current node and the successor.
+	// The successor may have been changed by a handler in the meantime, then that one is kept.
+	node.mu.Lock()
+	if sameNode(node.SuccessorID, successor) && isBetween(node.Id, predecessor.Id, successor.Id) {
+		node.SuccessorID = predecessor
+	}
+	node.mu.Unlock()
 }
 
-func updateFingerTable() {
+// fixFingers refreshes count fingers of the node, continuing in rotating order from where the last round stopped.
+// A finger that cannot be refreshed keeps its old value. Returns whether any finger changed.
+func (s *Server) fixFingers(node *Node, count int) bool {
 	// Psudo code
 	// next = next + 1
 	// if next > m
 	// 	next = 1
 	// finger[next].node = find_successor(n + 2^(next-1))
 
-	s := serverInstance
+	changed := false
+
+	fingers := node.fingers()
+	for k := 0; k < count && k < len(fingers); k++ {
 
-	for i := 0; i < keyIdentifierSpace; i++ {
+		node.mu.Lock()
+		i := node.nextFinger
+		node.nextFinger = (node.nextFinger + 1) % len(node.FingerTable)
+		node.mu.Unlock()
 
 		// Calculate the next finger entry
-		next := (s.node.Id + 1<<i) % (1 << keyIdentifierSpace)
-		finger := s.node.FingerTable[i]
+		next := node.Id.addPowerOfTwo(i)
+		finger := fingers[i]
 
-		successor := s.findSuccessor(next)
+		successor := node.findSuccessor(next)
 
 		// Get the successor node for the next finger entry
-		url := fmt.Sprintf("http://%s/node-info?successor=%d", successor.Address, next)
-		client := &http.Client{Timeout: 10 * time.Second}
+		url := nodeURL(successor, fmt.Sprintf("node-info?successor=%s", next))
+		client := s.newClient(10 * time.Second)
 		resp, err := client.Get(url)
 
-		if err != nil || resp.StatusCode != http.StatusOK {
-			return
+		if err != nil {
+			metrics.inc("finger_fix_errors")
+			continue
 		}
 
 		var data map[string]interface{}
-		decoder := json.NewDecoder(resp.Body)
-		err = decoder.Decode(&data)
+		err = decodeJSON(resp.Body, &data)
+		resp.Body.Close()
 
-		if err != nil {
-			return
+		if resp.StatusCode != http.StatusOK || err != nil {
+			metrics.inc("finger_fix_errors")
+			continue
 		}
 
-		url = fmt.Sprintf("http://%s/node-info", data["address"].(string))
-		client = &http.Client{Timeout: 10 * time.Second}
-		resp, err = client.Get(url)
-
-		if err != nil || resp.StatusCode != http.StatusOK {
-			return
+		found := nodeAddressFrom(data)
+		if !sameNode(finger.SuccessorID, found) {
+			changed = true
 		}
 
-		decoder = json.NewDecoder(resp.Body)
-		err = decoder.Decode(&data)
-
-		if err != nil {
-			return
-		}
-
-		finger.SuccessorID = &NodeAddress{
-			Id:      int(data["id"].(float64)),
-			Address: data["address"].(string),
-		}
+		node.setFinger(i, found)
 	}
+
+	return changed
 }
 
-func checkPredecessor() {
+func (s *Server) checkPredecessor(node *Node) {
 	// Psudo code
 	// if predecessor has failed
 	// 	predecessor = nil
 
-	s := serverInstance
-
-	if s.node.PredecessorID == nil {
+	predecessor := node.predecessor()
+	if predecessor == nil {
 		return
 	}
 
-	request := fmt.Sprintf("http://%s/node-info", s.node.PredecessorID.Address)
-	client := &http.Client{Timeout: 10 * time.Second}
+	if !s.predecessorAlive(node, predecessor) {
+		// A handler may have set another predecessor in the meantime, which is kept
+		node.mu.Lock()
+		if sameNode(node.PredecessorID, predecessor) {
+			node.PredecessorID = nil
+		}
+		node.mu.Unlock()
+	}
+}
+
+// predecessorAlive reports whether predecessor answers and still has node as its successor
+func (s *Server) predecessorAlive(node *Node, predecessor *NodeAddress) bool {
+
+	request := nodeURL(predecessor, "node-info")
+	client := s.newClient(10 * time.Second)
 	resp, err := client.Get(request)
 
 	if err != nil {
-		s.node.PredecessorID = nil
-		return
+		return false
 	}
+	defer resp.Body.Close()
 
-	// If the predecessor node has crashed, set the predecessor to nil
+	// A crashed predecessor answers with an error
 	if resp.StatusCode != http.StatusOK {
-		s.node.PredecessorID = nil
-		return
+		return false
 	}
 
 	var data map[string]interface{}
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(&data)
+	err = decodeJSON(resp.Body, &data)
 
 	if err != nil {
-		s.node.PredecessorID = nil
-		return
+		return false
 	}
 
-	successorData := data["successor"].(map[string]interface{})
-	successorAddress := successorData["address"].(string)
-
-	if successorAddress != s.node.Address {
-		s.node.PredecessorID = nil
+	// Virtual nodes share an address, so the ID has to match as well
+	successorData, ok := data["successor"].(map[string]interface{})
+	if !ok {
+		return false
 	}
+	successor := nodeAddressFrom(successorData)
+
+	return successor.Address == node.Address && successor.Id == node.Id
 }
 
-func notify(address string) {
+// notify tells the successor of node that node may be its predecessor, see offerPredecessor
+func (s *Server) notify(node *Node) {
 	// Psudo code
-	// if predecessor is nil or n' is between predecessor and n
-	// 	predecessor = n'
-
-	s := serverInstance
-
-	request := fmt.Sprintf("http://%s/node-info", address)
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(request)
-
-	if err != nil {
-		return
-	}
+	// successor.notify(n)
 
-	if resp.StatusCode != http.StatusOK {
-		return
-	}
+	request := nodeURL(node.successor(), "update-predecessor?notify=true")
+	jsonData, _ := json.Marshal(node.address())
+	s.deliver(func() {
+		if resp := s.put_request(request, jsonData); resp != nil {
+			resp.Body.Close()
+		}
+	})
+}
 
-	var data map[string]interface{}
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(&data)
+// offerPredecessor is the receiving side of notify: candidate becomes the predecessor of the node
+// if the node has none, or if candidate lies between the predecessor and the node.
+// Returns whether the predecessor changed.
+func (n *Node) offerPredecessor(candidate *NodeAddress) bool {
+	// Psudo code
+	// if predecessor is nil or n' is between predecessor and n
+	// 	predecessor = n'
 
-	if err != nil {
-		return
-	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	if s.node.PredecessorID == nil || isBetween(s.node.PredecessorID.Id, int(data["id"].(float64)), s.node.Id) {
-		s.node.PredecessorID = &NodeAddress{
-			Id:      int(data["id"].(float64)),
-			Address: data["address"].(string),
-		}
+	// A node alone in its ring notifies itself and becomes its own predecessor
+	if n.PredecessorID != nil && !isBetween(n.PredecessorID.Id, candidate.Id, n.Id) {
+		return false
 	}
+	n.PredecessorID = candidate
+	return true
 }
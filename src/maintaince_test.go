@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is a server on a loopback port with its maintenance loops running on their own
+// goroutines, as on a real machine, so `go test -race` sees them next to the handlers
+type testServer struct {
+	*Server
+	address string
+	loops   sync.WaitGroup
+}
+
+func startTestServer(t *testing.T, vnodes int) *testServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := newNodes(listener.Addr().String(), vnodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{Server: newServer(nodes, nil), address: listener.Addr().String()}
+	ts.server = &http.Server{Handler: ts.handler}
+	go ts.server.Serve(listener)
+
+	for _, task := range ts.maintenanceTasks() {
+		ts.loops.Add(1)
+		go func(task maintenanceTask) {
+			defer ts.loops.Done()
+			task.loop.run(task.round)
+		}(task)
+	}
+	return ts
+}
+
+// stop shuts the server down and waits for its maintenance loops to end
+func (ts *testServer) stop() {
+	ts.shutdownServer()
+	ts.loops.Wait()
+}
+
+// smallRing sets a 4 bit identifier space, IDs 0 to 15, for the rest of the test
+func smallRing(t *testing.T) {
+	bits := keyIdentifierSpace
+	keyIdentifierSpace = 4
+	t.Cleanup(func() { keyIdentifierSpace = bits })
+}
+
+// fastMaintenance shortens the maintenance intervals for the servers started by a test
+func fastMaintenance(t *testing.T) {
+	intervals := []*time.Duration{stabilizeInterval, maxStabilizeInterval, fixFingersInterval, maxFixFingersInterval, antiEntropyInterval, maxAntiEntropyInterval, hintInterval, expiryInterval, chunkGCInterval}
+	saved := make([]time.Duration, len(intervals))
+	for i, interval := range intervals {
+		saved[i] = *interval
+		*interval = 20 * time.Millisecond
+	}
+
+	bits := keyIdentifierSpace
+	keyIdentifierSpace = 16
+
+	t.Cleanup(func() {
+		for i, interval := range intervals {
+			*interval = saved[i]
+		}
+		keyIdentifierSpace = bits
+	})
+}
+
+func send(method, url, body string) (int, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// TestConcurrentMaintenance joins servers into a ring while clients read the ring state and store
+// keys, so the maintenance loops and the handlers change the nodes at the same time
+func TestConcurrentMaintenance(t *testing.T) {
+	fastMaintenance(t)
+
+	servers := []*testServer{startTestServer(t, 1), startTestServer(t, 2), startTestServer(t, 1), startTestServer(t, 1)}
+	defer func() {
+		for _, ts := range servers {
+			ts.stop()
+		}
+	}()
+
+	done := make(chan struct{})
+	var clients sync.WaitGroup
+	for c, ts := range servers {
+		clients.Add(1)
+		go func(c int, address string) {
+			defer clients.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key-%d-%d", c, i)
+				send(http.MethodPut, "http://"+address+"/storage/"+key, "value")
+				send(http.MethodGet, "http://"+address+"/storage/"+key, "")
+				send(http.MethodGet, "http://"+address+"/node-info", "")
+				send(http.MethodGet, "http://"+address+"/network", "")
+				send(http.MethodGet, "http://"+address+"/ring", "")
+			}
+		}(c, ts.address)
+	}
+
+	// Every server waits for the ring to take in the one before it
+	members := len(servers[0].nodes)
+	for _, ts := range servers[1:] {
+		status, err := send(http.MethodPost, "http://"+ts.address+"/join?nprime="+servers[0].address, "")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("join of %s: %d %v", ts.address, status, err)
+		}
+		members += len(ts.nodes)
+		waitForRing(t, servers[0], members)
+	}
+
+	close(done)
+	clients.Wait()
+}
+
+// waitForRing waits until the ring walked from ts is consistent and has the given number of members
+func waitForRing(t *testing.T, ts *testServer, members int) {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		report := ts.walkRing(ts.nodes[0].address())
+		if report.Consistent && len(report.Members) == members {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, problem := range report.Problems {
+				t.Log(problem.Kind + ": " + problem.Message)
+			}
+			t.Fatalf("ring did not converge: %d of %d members, %d problems", len(report.Members), members, len(report.Problems))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
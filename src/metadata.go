@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Headers that carry the metadata of a value, besides Content-Type, Content-Length and Last-Modified
+const (
+	checksumHeader = "X-Checksum-Sha256"
+	createdHeader  = "X-Created"
+	modifiedHeader = "X-Modified"
+	expiresHeader  = "X-Expires"
+)
+
+// metadataHeaders are passed on when a GET or HEAD is forwarded to the owner of a key
+var metadataHeaders = []string{"Content-Type", "Content-Length", "Last-Modified", checksumHeader, createdHeader, modifiedHeader, expiresHeader, contextHeader}
+
+// Metadata describes a stored value. The checksum is the sha256 of the value, and is checked
+// whenever the value is read, so a copy that got corrupted is not handed out.
+type Metadata struct {
+	ContentType string     `json:"content_type,omitempty"`
+	Length      int64      `json:"length"`
+	Checksum    string     `json:"checksum,omitempty"`
+	Created     time.Time  `json:"created"`
+	Modified    time.Time  `json:"modified"`
+	Expires     *time.Time `json:"expires,omitempty"` // Set by a PUT with ?ttl=, the value is gone afterwards
+}
+
+func checksum(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// newMetadata returns the metadata of a value written at the time now. A value that replaces another
+// keeps its creation time, a value of a new key is created now.
+func newMetadata(contentType string, value []byte, replaced *Metadata, now time.Time) *Metadata {
+	now = now.UTC()
+	meta := &Metadata{ContentType: contentType, Length: int64(len(value)), Checksum: checksum(value), Created: now, Modified: now}
+	if replaced != nil {
+		meta.Created = replaced.Created
+	}
+	return meta
+}
+
+// expired reports whether the TTL of the value ran out by now
+func (meta *Metadata) expired(now time.Time) bool {
+	return meta != nil && meta.Expires != nil && now.After(*meta.Expires)
+}
+
+// matches reports whether value is the one the metadata was written for
+func (meta *Metadata) matches(value []byte) bool {
+	return meta == nil || meta.Checksum == "" || checksum(value) == meta.Checksum
+}
+
+// intact reports whether the value of the record, or of every sibling, still matches its checksum.
+// A large value is checked chunk by chunk as it is read instead.
+func (r *Record) intact() bool {
+	if r == nil || r.Manifest != nil {
+		return true
+	}
+	for _, sib := range r.Siblings {
+		if !sib.Meta.matches(sib.Value) {
+			return false
+		}
+	}
+	return r.Meta.matches(r.Value)
+}
+
+// replacedMetadata returns the metadata of the oldest live sibling that a write with context
+// replaces, so the new value keeps its creation time. Returns nil if it replaces none.
+func (r *Record) replacedMetadata(context VectorClock) *Metadata {
+	if r == nil {
+		return nil
+	}
+
+	var oldest *Metadata
+	for _, sib := range r.Siblings {
+		if sib.Deleted || sib.Meta == nil || context[sib.Node] < sib.Counter {
+			continue
+		}
+		if oldest == nil || sib.Meta.Created.Before(oldest.Created) {
+			oldest = sib.Meta
+		}
+	}
+	return oldest
+}
+
+// intactCopy looks for a copy of key whose value matches its checksum among the replicas of owner,
+// and puts it in place of the local one. Returns nil if no replica has one.
+func (s *Server) intactCopy(owner *Node, key string) *Record {
+	for _, replica := range owner.replicas() {
+		remote, err := s.fetchReplica(replica, key)
+		if err != nil || remote == nil || !remote.intact() {
+			continue
+		}
+		s.storage.apply(key, remote)
+		metrics.inc("checksum_repairs")
+		return remote
+	}
+	return nil
+}
+
+// writeMetadata sets the headers of the metadata of a value. Values without a content type are
+// returned as application/octet-stream.
+func writeMetadata(w http.ResponseWriter, meta *Metadata) {
+	if meta == nil {
+		return
+	}
+
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Length, 10))
+	w.Header().Set("Last-Modified", meta.Modified.Format(http.TimeFormat))
+	w.Header().Set(createdHeader, meta.Created.Format(time.RFC3339Nano))
+	w.Header().Set(modifiedHeader, meta.Modified.Format(time.RFC3339Nano))
+	if meta.Checksum != "" {
+		w.Header().Set(checksumHeader, meta.Checksum)
+	}
+	if meta.Expires != nil {
+		w.Header().Set(expiresHeader, meta.Expires.Format(time.RFC3339Nano))
+	}
+}
+
+// displayValue returns a value for a JSON answer: as text, or base64 encoded if it is not valid UTF-8
+func displayValue(value []byte) interface{} {
+	if utf8.Valid(value) {
+		return string(value)
+	}
+	return value
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+
+	binary := []byte{0x00, 0xff, 0xfe, 'a', 0x80}
+	created := time.Date(2020, time.May, 1, 12, 0, 0, 0, time.UTC)
+	now := created.Add(time.Hour)
+
+	meta := newMetadata("image/png", binary, nil, now)
+	if meta.Length != 5 || meta.ContentType != "image/png" || !meta.Created.Equal(now) || !meta.Modified.Equal(now) {
+		t.Errorf("metadata of a new value: %+v", meta)
+	}
+	if replaced := newMetadata("", binary, &Metadata{Created: created}, now); !replaced.Created.Equal(created) || !replaced.Modified.Equal(now) {
+		t.Errorf("a value that replaces another was created %s and modified %s, want %s and %s", replaced.Created, replaced.Modified, created, now)
+	}
+
+	// A copy whose bytes changed no longer matches its checksum
+	record := &Record{Value: binary, Version: 1, Meta: meta}
+	if !record.intact() {
+		t.Errorf("a record that holds the value it was written with is not intact")
+	}
+	corrupt := &Record{Value: []byte{0x00, 0xff, 0xfe, 'b', 0x80}, Version: 1, Meta: meta}
+	if corrupt.intact() {
+		t.Errorf("a record whose value changed is intact")
+	}
+
+	// Binary values survive the JSON that replicas exchange, and are shown base64 encoded
+	var decoded Record
+	data, _ := json.Marshal(record)
+	if err := json.Unmarshal(data, &decoded); err != nil || string(decoded.Value) != string(binary) || !decoded.intact() {
+		t.Errorf("binary value changed on its way through JSON: %v %v", decoded.Value, err)
+	}
+	if shown, _ := json.Marshal(displayValue(binary)); string(shown) != `"AP/+YYA="` {
+		t.Errorf("binary value shown as %s, want base64", shown)
+	}
+	if shown, _ := json.Marshal(displayValue([]byte("text"))); string(shown) != `"text"` {
+		t.Errorf("text value shown as %s", shown)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Metrics is a set of named counters that can be read through /metrics
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+var metrics = &Metrics{counters: make(map[string]int64)}
+
+// inc increases the counter with the given name by one
+func (m *Metrics) inc(name string) {
+	m.add(name, 1)
+}
+
+// add increases the counter with the given name by delta
+func (m *Metrics) add(name string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+// snapshot returns a copy of all counters
+func (m *Metrics) snapshot() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters := make(map[string]int64, len(m.counters))
+	for name, value := range m.counters {
+		counters[name] = value
+	}
+	return counters
+}
+
+// metricsHandler returns all counters as a JSON object
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonData, err := json.MarshalIndent(metrics.snapshot(), "", "\t")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error encoding JSON"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
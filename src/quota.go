@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Eviction policies: which keys of the cache namespaces make room for a write once a node is full
+const (
+	evictNone = "none" // Nothing is evicted, writes over the limits fail
+	evictLRU  = "lru"  // The key read or written least recently first
+	evictTTL  = "ttl"  // The key whose TTL runs out first, then the others least recently used first
+)
+
+var errStorageFull = errors.New("storage full")
+
+// usage returns the keys and bytes a record of key takes up. Tombstones are not counted as keys,
+// so deleting keys makes room, but their key still takes up bytes. A large value takes up the
+// digests of its chunks here, the chunks are counted under their own keys.
+func usage(key string, record *Record) (int, int64) {
+	if record == nil {
+		return 0, 0
+	}
+	if !record.holdsValue() {
+		return 0, int64(len(key))
+	}
+	if record.Manifest != nil {
+		return 1, int64(len(key) + 2*sha256.Size*len(record.Manifest.Chunks))
+	}
+	return 1, int64(len(key) + record.size())
+}
+
+// admit checks whether storing record under key keeps the storage within -max-keys and -max-bytes.
+// A write that adds no key and no bytes is always admitted, so deletes and smaller values still
+// work on a full node. The writes check again under the lock, see applyWithin and update.
+func (st *Storage) admit(key string, record *Record) error {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.fits(key, record)
+}
+
+// fits is admit with the lock held
+func (st *Storage) fits(key string, record *Record) error {
+	oldKeys, oldBytes := usage(key, st.records[key])
+	newKeys, newBytes := usage(key, record)
+
+	if *maxKeys > 0 && newKeys > oldKeys && st.keyCount+newKeys-oldKeys > *maxKeys {
+		return fmt.Errorf("%w: the node holds %d keys, at most %d are allowed", errStorageFull, st.keyCount, *maxKeys)
+	}
+	if *maxBytes > 0 && newBytes > oldBytes && st.bytes+newBytes-oldBytes > *maxBytes {
+		return fmt.Errorf("%w: the node holds %d bytes, %d more would exceed the limit of %d", errStorageFull, st.bytes, newBytes-oldBytes, *maxBytes)
+	}
+	return nil
+}
+
+// touch marks key as used now, for LRU eviction
+func (st *Storage) touch(key string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.used[key] = st.clock()
+}
+
+// StorageUsage is what the storage of a server takes up, reported by /node-info
+type StorageUsage struct {
+	Keys        int     `json:"keys"`
+	Bytes       int64   `json:"bytes"`
+	MaxKeys     int     `json:"max_keys,omitempty"`
+	MaxBytes    int64   `json:"max_bytes,omitempty"`
+	Utilization float64 `json:"utilization"` // The larger share of either limit that is used, 0 without limits
+	Eviction    string  `json:"eviction"`
+}
+
+func (st *Storage) usage() *StorageUsage {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	report := &StorageUsage{Keys: st.keyCount, Bytes: st.bytes, MaxKeys: *maxKeys, MaxBytes: *maxBytes, Eviction: *evictionPolicy}
+	if *maxKeys > 0 {
+		report.Utilization = float64(st.keyCount) / float64(*maxKeys)
+	}
+	if *maxBytes > 0 {
+		report.Utilization = max(report.Utilization, float64(st.bytes)/float64(*maxBytes))
+	}
+	return report
+}
+
+// cacheKey reports whether key is in one of the namespaces given with -cache-prefixes, whose keys may be evicted
+func cacheKey(key string) bool {
+	for _, prefix := range splitList(*cachePrefixes) {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// makeRoom checks that record fits under key, and if it does not, evicts keys owned by this
+// server until it does: keys whose TTL ran out, then keys of the cache namespaces as far as the
+// eviction policy allows. Returns an error wrapping errStorageFull if the record still does not fit.
+func (s *Server) makeRoom(key string, record *Record) error {
+
+	err := s.storage.admit(key, record)
+	if err == nil {
+		return nil
+	}
+
+	for _, candidate := range s.evictionCandidates(key) {
+		s.evict(candidate)
+		if err = s.storage.admit(key, record); err == nil {
+			return nil
+		}
+	}
+	metrics.inc("quota_rejections")
+	return err
+}
+
+// evictionCandidates returns the keys that this server owns and may evict to make room for key, in the
+// order the eviction policy picks them. Keys whose TTL ran out come first, whatever their namespace.
+func (s *Server) evictionCandidates(key string) []string {
+
+	type candidate struct {
+		key     string
+		expires *time.Time
+		used    time.Time
+	}
+
+	now := s.clock()
+	s.storage.mu.RLock()
+	var candidates []candidate
+	for k, record := range s.storage.records {
+		evictable := record.Meta.expired(now) || (*evictionPolicy != evictNone && cacheKey(k))
+		if k != key && record.holdsValue() && evictable && s.ownerOf(keyID(k)) != nil {
+			c := candidate{key: k, used: s.storage.used[k]}
+			if record.Meta != nil {
+				c.expires = record.Meta.Expires
+			}
+			candidates = append(candidates, c)
+		}
+	}
+	s.storage.mu.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		aExpired, bExpired := a.expires != nil && a.expires.Before(now), b.expires != nil && b.expires.Before(now)
+		if aExpired != bExpired {
+			return aExpired
+		}
+		if *evictionPolicy == evictTTL && (a.expires != nil) != (b.expires != nil) {
+			return a.expires != nil
+		}
+		if *evictionPolicy == evictTTL && a.expires != nil && !a.expires.Equal(*b.expires) {
+			return a.expires.Before(*b.expires)
+		}
+		return a.used.Before(b.used)
+	})
+
+	keys := make([]string, len(candidates))
+	for i, c := range candidates {
+		keys[i] = c.key
+	}
+	return keys
+}
+
+// evict makes room by removing the value of key, see expire
+func (s *Server) evict(key string) {
+	if s.expire(key, func(*Record) bool { return true }) {
+		metrics.inc("evictions")
+	}
+}
+
+// expire replaces the value of key with a tombstone marked as expired, on this server and its replicas,
+// so watchers get an expire event and replicas give up their copies as well. The value is only replaced
+// if this server owns key and remove accepts the record, checked under the lock of the storage, so a
+// value written in the meantime stays. Returns whether the value was replaced.
+func (s *Server) expire(key string, remove func(record *Record) bool) bool {
+
+	owner := s.ownerOf(keyID(key))
+	if owner == nil {
+		return false
+	}
+
+	tombstone, _ := s.storage.update(key, func(current *Record) *Record {
+		if !current.holdsValue() || !remove(current) {
+			return nil
+		}
+		var record *Record
+		if vectorClocks() && current.CRDT == nil {
+			record = s.newSibling(owner, nil, true, current, current.context())
+		} else {
+			record = s.newRecord(nil, true, current)
+		}
+		record.Expired = true
+		return record
+	})
+	if tombstone == nil {
+		return false
+	}
+
+	// A tombstone never takes up more than the value it replaces, so it always fits
+	s.writeRecord(owner, key, tombstone, consistencyOne)
+	return true
+}
+
+// expireRound replaces the values whose TTL ran out with expired tombstones, for the keys this
+// server owns. Replicas wait for the tombstone of the owner. Returns whether a value expired.
+func (s *Server) expireRound() bool {
+
+	if s.crashed.Load() {
+		return false
+	}
+
+	expired := 0
+	for _, key := range s.storage.expired() {
+		if !s.expire(key, func(record *Record) bool { return record.Meta.expired(s.clock()) }) {
+			continue
+		}
+		metrics.inc("ttl_expirations")
+		expired++
+	}
+	return expired > 0
+}
+
+// expired returns the keys whose values had a TTL that ran out
+func (st *Storage) expired() []string {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var keys []string
+	for key, record := range st.records {
+		if record.holdsValue() && record.Meta.expired(st.clock()) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeStorageFull answers a write that does not fit into the storage of a server
+func writeStorageFull(w http.ResponseWriter, err error) {
+	http.Error(w, "Insufficient storage: "+err.Error(), http.StatusInsufficientStorage)
+}
+
+// requestTTL returns how long a PUT asks its value to live with ?ttl=, 0 if it does not
+func requestTTL(r *http.Request) (time.Duration, error) {
+
+	text := r.URL.Query().Get("ttl")
+	if text == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(text)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("ttl must be a positive duration, e.g. 30s or 10m")
+	}
+	if vectorClocks() {
+		return 0, fmt.Errorf("TTLs are only supported with -conflict-mode lww")
+	}
+	return ttl, nil
+}
+
+// ttlQuery returns the ?ttl= of a PUT to pass on when it is forwarded, or nothing
+func ttlQuery(r *http.Request) string {
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		return "&ttl=" + url.QueryEscape(ttl)
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentWritesStayWithinQuota(t *testing.T) {
+
+	limit := *maxKeys
+	*maxKeys = 10
+	defer func() { *maxKeys = limit }()
+
+	st := newStorage()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored, full := 0, 0
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i)
+			record := &Record{Value: []byte("value"), Version: 1}
+			_, err := st.applyWithin(key, record)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				stored++
+			case errors.Is(err, errStorageFull):
+				full++
+			default:
+				t.Errorf("%s: %v", key, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if usage := st.usage(); usage.Keys != 10 || stored != 10 || full != 90 {
+		t.Errorf("storage holds %d keys after %d writes were stored and %d refused, want 10, 10 and 90", usage.Keys, stored, full)
+	}
+
+	// Updates are limited the same way
+	if _, err := st.update("key-new", func(*Record) *Record { return &Record{Value: []byte("v"), Version: 1} }); !errors.Is(err, errStorageFull) {
+		t.Errorf("update of a new key on a full storage: %v, want storage full", err)
+	}
+}
+
+func TestExpireRound(t *testing.T) {
+	smallRing(t)
+
+	nodes, err := newNodes("127.0.0.1:1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(nodes, nil)
+	s.log = io.Discard
+
+	var events []string
+	s.storage.changed = func(key string, record *Record) {
+		events = append(events, fmt.Sprintf("%s expired=%v", key, record.Expired))
+	}
+
+	past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+	s.storage.apply("gone", &Record{Value: []byte("v"), Version: 1, Meta: &Metadata{Expires: &past}})
+	s.storage.apply("kept", &Record{Value: []byte("v"), Version: 1, Meta: &Metadata{Expires: &future}})
+	s.storage.apply("plain", &Record{Value: []byte("v"), Version: 1})
+	events = nil
+
+	if !s.expireRound() {
+		t.Errorf("expireRound found nothing to expire")
+	}
+	if record := s.storage.record("gone"); record.holdsValue() || !record.Expired {
+		t.Errorf("record of an expired value is %+v, want an expired tombstone", record)
+	}
+	for _, key := range []string{"kept", "plain"} {
+		if !s.storage.record(key).holdsValue() {
+			t.Errorf("%s was removed before its TTL ran out", key)
+		}
+	}
+	if len(events) != 1 || events[0] != "gone expired=true" {
+		t.Errorf("storage reported the changes %v, want the expired tombstone of gone", events)
+	}
+
+	if s.expireRound() {
+		t.Errorf("a second round expired a value again")
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Consistency levels of storage requests: how many replicas have to answer
+const (
+	consistencyOne    = "one"
+	consistencyQuorum = "quorum"
+	consistencyAll    = "all"
+)
+
+// consistencyLevel returns the level asked for with ?consistency=, or the default level of the node
+func consistencyLevel(r *http.Request) (string, error) {
+
+	level := r.URL.Query().Get("consistency")
+	if level == "" {
+		level = *defaultConsistency
+	}
+
+	switch level {
+	case consistencyOne, consistencyQuorum, consistencyAll:
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown consistency level %q, must be one, quorum or all", level)
+}
+
+// required returns how many of n replicas have to answer for the level
+func required(level string, n int) int {
+	switch level {
+	case consistencyAll:
+		return n
+	case consistencyQuorum:
+		return n/2 + 1
+	}
+	return 1
+}
+
+// updateSuccessors refreshes the successor list of node: its successor, followed by the successor list
+// of the successor, keeping only the first replicas-1 distinct servers other than this one.
+// Returns whether the list changed.
+func (s *Server) updateSuccessors(node *Node) bool {
+
+	var successors []*NodeAddress
+
+	successor := node.successor()
+	if successor.Address != node.Address {
+		request := nodeURL(successor, "node-info")
+		client := s.newClient(10 * time.Second)
+		resp, err := client.Get(request)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+
+		var data struct {
+			Successors []*NodeAddress `json:"successors"`
+		}
+		if resp.StatusCode != http.StatusOK || decodeJSON(resp.Body, &data) != nil {
+			return false
+		}
+		successors = append([]*NodeAddress{successor}, data.Successors...)
+	}
+
+	list := []*NodeAddress{}
+	seen := map[string]bool{node.Address: true}
+	for _, successor := range successors {
+		if len(list) == *replicas-1 {
+			break
+		}
+		if successor == nil || seen[successor.Address] {
+			continue
+		}
+		seen[successor.Address] = true
+		list = append(list, successor)
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	changed := len(list) != len(node.Successors)
+	for i := 0; !changed && i < len(list); i++ {
+		changed = !sameNode(list[i], node.Successors[i])
+	}
+	node.Successors = list
+	return changed
+}
+
+// replicaHandler serves the copies of records this server stores for other nodes.
+// GET returns the record of a key, PUT stores a record if it is newer than the one stored.
+func (s *Server) replicaHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/replica/")
+
+	switch r.Method {
+	case http.MethodGet:
+		record := s.storage.record(key)
+		if record == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		jsonData, _ := json.Marshal(record)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonData)
+
+	case http.MethodPut:
+		var record Record
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			http.Error(w, "Error decoding record", http.StatusBadRequest)
+			return
+		}
+		if err := s.makeRoom(key, &record); err != nil {
+			writeStorageFull(w, err)
+			return
+		}
+		applied, err := s.storage.applyWithin(key, &record)
+		if err != nil {
+			metrics.inc("quota_rejections")
+			writeStorageFull(w, err)
+			return
+		}
+		if applied {
+			metrics.inc("replica_writes_applied")
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// fetchReplica asks a replica for its record of key. A replica without one answers with nil.
+func (s *Server) fetchReplica(replica *NodeAddress, key string) (*Record, error) {
+
+	client := s.newClient(10 * time.Second)
+	resp, err := client.Get(nodeURL(replica, "replica/"+url.PathEscape(key)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, nil
+	case http.StatusOK:
+		var record Record
+		if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+			return nil, err
+		}
+		return &record, nil
+	}
+	return nil, fmt.Errorf("replica %s answered %d", replica.Address, resp.StatusCode)
+}
+
+// storeReplica sends a record of key to a replica
+func (s *Server) storeReplica(replica *NodeAddress, key string, record *Record) error {
+
+	jsonData, _ := json.Marshal(record)
+	req, err := http.NewRequest(http.MethodPut, nodeURL(replica, "replica/"+url.PathEscape(key)), bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+
+	client := s.newClient(10 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("replica %s answered %d", replica.Address, resp.StatusCode)
+	}
+	return nil
+}
+
+// background runs task without waiting for it, as a one-way message on simulated servers
+func (s *Server) background(task func()) {
+	if s.send != nil {
+		s.send(task)
+		return
+	}
+	go task()
+}
+
+// fanOut calls ask for every replica until needed calls have succeeded, and returns how many did.
+// The calls that are not waited for go on in the background, so every replica is still asked.
+func (s *Server) fanOut(replicas []*NodeAddress, needed int, ask func(replica *NodeAddress) bool) int {
+
+	if needed <= 0 {
+		for _, replica := range replicas {
+			replica := replica
+			s.background(func() { ask(replica) })
+		}
+		return 0
+	}
+
+	// Simulated servers answer one request at a time, so the replicas are asked in order
+	// and the rest are sent as one-way messages
+	if s.send != nil {
+		succeeded := 0
+		for i, replica := range replicas {
+			if succeeded == needed {
+				return succeeded + s.fanOut(replicas[i:], 0, ask)
+			}
+			if ask(replica) {
+				succeeded++
+			}
+		}
+		return succeeded
+	}
+
+	results := make(chan bool, len(replicas))
+	for _, replica := range replicas {
+		go func(replica *NodeAddress) { results <- ask(replica) }(replica)
+	}
+
+	succeeded := 0
+	for range replicas {
+		if <-results {
+			succeeded++
+			if succeeded == needed {
+				break
+			}
+		}
+	}
+	return succeeded
+}
+
+// replicaAnswer is the record a replica returned for a read, nil if it had none
+type replicaAnswer struct {
+	replica *NodeAddress
+	record  *Record
+}
+
+// readRecord reads key from this server and the replicas of owner until the level is met,
+// and returns the newest record among the answers. ok is false if too few replicas answered.
+// With repair, copies that turned out to be older than the newest are repaired in the background.
+func (s *Server) readRecord(owner *Node, key, level string, repair bool) (record *Record, ok bool) {
+
+	local := s.storage.record(key)
+	replicas := owner.replicas()
+	needed := required(level, 1+len(replicas)) - 1
+
+	if needed == 0 {
+		return local, true
+	}
+
+	answers := make(chan replicaAnswer, len(replicas))
+	answered := s.fanOut(replicas, needed, func(replica *NodeAddress) bool {
+		remote, err := s.fetchReplica(replica, key)
+		if err != nil {
+			metrics.inc("replica_read_errors")
+			return false
+		}
+		answers <- replicaAnswer{replica: replica, record: remote}
+		return true
+	})
+
+	record = local
+	received := make([]replicaAnswer, 0, answered)
+	for i := 0; i < answered; i++ {
+		answer := <-answers
+		if !answer.record.intact() {
+			// A copy whose value no longer matches its checksum is repaired like a missing one
+			metrics.inc("checksum_failures")
+			answer.record = nil
+		}
+		received = append(received, answer)
+		record = record.merge(answer.record)
+	}
+
+	if repair && record != nil {
+		s.readRepair(key, record, local, received)
+	}
+	return record, answered >= needed
+}
+
+// readRepair writes the newest record of key back to this server and to the replicas whose answer was
+// missing it or older, so replicas that missed writes, e.g. while they were crashed, catch up
+func (s *Server) readRepair(key string, newest, local *Record, answers []replicaAnswer) {
+
+	stale := 0
+	if newest.newerThan(local) {
+		s.storage.apply(key, newest)
+		metrics.inc("read_repairs")
+		stale++
+	}
+
+	for _, answer := range answers {
+		if !newest.newerThan(answer.record) {
+			continue
+		}
+		stale++
+
+		replica := answer.replica
+		s.background(func() {
+			if err := s.storeReplica(replica, key, newest); err != nil {
+				metrics.inc("read_repair_errors")
+				return
+			}
+			metrics.inc("read_repairs")
+		})
+	}
+
+	if stale > 0 {
+		metrics.inc("divergent_reads")
+	}
+}
+
+// writeRecord stores the record on this server and sends it to the replicas of owner.
+// Returns whether enough replicas acknowledged it for the level, or an error wrapping
+// errStorageFull if it does not fit into the storage of this server.
+func (s *Server) writeRecord(owner *Node, key string, record *Record, level string) (bool, error) {
+
+	if _, err := s.storage.applyWithin(key, record); err != nil {
+		metrics.inc("quota_rejections")
+		return false, err
+	}
+	replicas := owner.replicas()
+	needed := required(level, 1+len(replicas)) - 1
+
+	acknowledged := s.fanOut(replicas, needed, func(replica *NodeAddress) bool {
+		if err := s.storeReplica(replica, key, record); err != nil {
+			metrics.inc("replica_write_errors")
+			return false
+		}
+		return true
+	})
+	return acknowledged >= needed, nil
+}
+
+// newRecord returns a record of key that is newer than latest
+func (s *Server) newRecord(value []byte, deleted bool, latest *Record) *Record {
+
+	version := s.clock().UnixNano()
+	if latest != nil && version <= latest.Version {
+		version = latest.Version + 1
+	}
+	return &Record{Value: value, Version: version, Writer: s.nodes[0].Address, Deleted: deleted}
+}
+
+// coordinate serves a storage request for a key owned by one of the virtual nodes of this server,
+// reading from and writing to as many replicas as the consistency level asks for
+func (s *Server) coordinate(w http.ResponseWriter, r *http.Request, owner *Node, key, level string, body []byte) {
+
+	// Reads before a write keep the rules of the storage: a PUT does not overwrite and a DELETE needs a value.
+	// Only GETs repair stale replicas, a write brings them up to date anyway.
+	record, ok := s.readRecord(owner, key, level, r.Method == http.MethodGet)
+	if !ok {
+		metrics.inc("consistency_failures")
+		http.Error(w, "Not enough replicas answered", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !record.live(s.clock()) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.storage.touch(key)
+		if !record.intact() {
+			metrics.inc("checksum_failures")
+			fmt.Fprintln(s.log, "The value of", key, "does not match its checksum, looking for an intact copy")
+			if record = s.intactCopy(owner, key); !record.live(s.clock()) {
+				http.Error(w, "The stored value does not match its checksum, and no replica has an intact copy", http.StatusInternalServerError)
+				return
+			}
+		}
+		if record.CRDT != nil {
+			writeCRDT(w, record.CRDT)
+			return
+		}
+		if record.Manifest != nil {
+			s.writeLarge(w, r, record, level)
+			return
+		}
+		if vectorClocks() {
+			writeSiblings(w, record)
+			return
+		}
+		writeMetadata(w, record.Meta)
+		w.WriteHeader(http.StatusOK)
+		w.Write(record.Value)
+		return
+
+	case http.MethodPut:
+		if record.live(s.clock()) && record.CRDT != nil {
+			http.Error(w, "Key holds a "+record.CRDT.Type+", change it with POST", http.StatusConflict)
+			return
+		}
+		if !vectorClocks() {
+			if record.live(s.clock()) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			ttl, err := requestTTL(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			record = s.newRecord(body, false, record)
+			record.Meta = newMetadata(r.Header.Get("Content-Type"), body, nil, s.clock())
+			if ttl > 0 {
+				expires := record.Meta.Modified.Add(ttl)
+				record.Meta.Expires = &expires
+			}
+			break
+		}
+
+		// With a context, the value replaces the siblings the client has seen. Without one, PUT
+		// still does not overwrite a key, and the value replaces only tombstones.
+		context, err := requestContext(r)
+		if err == nil {
+			_, err = requestTTL(r)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if context == nil {
+			if record.live(s.clock()) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			context = record.context()
+		}
+		replaced := record.replacedMetadata(context)
+		record = s.newSibling(owner, body, false, record, context)
+		record.Siblings[0].Meta = newMetadata(r.Header.Get("Content-Type"), body, replaced, s.clock())
+
+	case http.MethodDelete:
+		if !record.live(s.clock()) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if vectorClocks() && record.CRDT == nil {
+			record = s.newSibling(owner, nil, true, record, record.context())
+			break
+		}
+		record = s.newRecord(nil, true, record)
+	}
+
+	if err := s.makeRoom(key, record); err != nil {
+		writeStorageFull(w, err)
+		return
+	}
+	acknowledged, err := s.writeRecord(owner, key, record, level)
+	if err != nil {
+		writeStorageFull(w, err)
+		return
+	}
+	if !acknowledged {
+		metrics.inc("consistency_failures")
+		http.Error(w, "Not enough replicas acknowledged the write", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// maxRingWalk bounds the number of nodes visited by one ring walk
+const maxRingWalk = 4096
+
+// RingMember is a node found while walking the ring
+type RingMember struct {
+	Id          ID             `json:"id"`
+	Address     string         `json:"address"`
+	Successor   *NodeAddress   `json:"successor"`
+	Predecessor *NodeAddress   `json:"predecessor"`
+	Fingers     []*FingerEntry `json:"fingers"`
+}
+
+func (m *RingMember) address() *NodeAddress {
+	return &NodeAddress{Id: m.Id, Address: m.Address}
+}
+
+// RingProblem is an inconsistency found by the ring walker.
+// Kind is one of unreachable, no-successor, cycle, order, predecessor, finger or not-in-ring.
+type RingProblem struct {
+	Kind    string       `json:"kind"`
+	Node    *NodeAddress `json:"node"`
+	Message string       `json:"message"`
+}
+
+// RingReport is the result of walking the successor pointers around the ring
+type RingReport struct {
+	Start      *NodeAddress   `json:"start"`
+	Members    []*RingMember  `json:"members"`
+	Closed     bool           `json:"closed"`
+	Consistent bool           `json:"consistent"`
+	Problems   []*RingProblem `json:"problems"`
+	Hash       string         `json:"hash"`
+	Bits       int            `json:"bits"`
+
+	// servers holds the virtual node IDs each visited server reported
+	servers map[string][]ID
+}
+
+func (report *RingReport) problem(kind string, node *NodeAddress, format string, args ...interface{}) {
+	report.Problems = append(report.Problems, &RingProblem{Kind: kind, Node: node, Message: fmt.Sprintf(format, args...)})
+}
+
+// ringHandler walks the ring from this node and reports its members and any inconsistencies.
+// ?format=graph returns nodes and links for D3 instead, ?format=dot a Graphviz graph.
+func (s *Server) ringHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	node := s.vnode(r)
+	if node == nil {
+		http.Error(w, "Unknown virtual node", http.StatusNotFound)
+		return
+	}
+
+	report := s.walkRing(node.address())
+
+	var jsonData []byte
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		jsonData, _ = json.MarshalIndent(report, "", "\t")
+	case "graph":
+		jsonData, _ = json.MarshalIndent(report.graph(), "", "\t")
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(report.graph().dot()))
+		return
+	default:
+		http.Error(w, "Unknown format, must be json, graph or dot", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// walkRing follows the successor pointers from start until it gets back to start, then checks
+// the predecessors and fingers of all members against the ring it found
+func (s *Server) walkRing(start *NodeAddress) *RingReport {
+
+	report := &RingReport{
+		Start:    start,
+		Members:  []*RingMember{},
+		Problems: []*RingProblem{},
+		Hash:     keyHash.Name(),
+		Bits:     keyIdentifierSpace,
+		servers:  make(map[string][]ID),
+	}
+	visited := make(map[NodeAddress]bool)
+
+	for current := start; len(report.Members) < maxRingWalk; {
+
+		visited[*current] = true
+		member, err := s.fetchRingMember(current, report)
+		if err != nil {
+			report.problem("unreachable", current, "%s (%s) could not be reached: %v", current.Id, current.Address, err)
+			break
+		}
+		report.Members = append(report.Members, member)
+
+		next := member.Successor
+		if next == nil {
+			report.problem("no-successor", current, "%s (%s) has no successor", current.Id, current.Address)
+			break
+		}
+		if sameNode(next, start) {
+			report.Closed = true
+			break
+		}
+		if visited[*next] {
+			report.problem("cycle", next, "successor pointers loop back to %s (%s) without reaching the start node", next.Id, next.Address)
+			break
+		}
+		current = next
+	}
+
+	if report.Closed {
+		checkRingOrder(report)
+		checkPredecessors(report)
+		checkFingers(report)
+	}
+	s.checkUnvisitedNodes(report, visited)
+
+	report.Consistent = report.Closed && len(report.Problems) == 0
+	return report
+}
+
+// fetchRingMember returns the pointers and fingers of a node, reading them directly if the node is hosted here
+func (s *Server) fetchRingMember(address *NodeAddress, report *RingReport) (*RingMember, error) {
+
+	for _, node := range s.nodes {
+		if sameNode(node.address(), address) {
+			ids := make([]ID, 0, len(s.nodes))
+			for _, vnode := range s.nodes {
+				ids = append(ids, vnode.Id)
+			}
+			report.servers[node.Address] = ids
+
+			return &RingMember{
+				Id:          node.Id,
+				Address:     node.Address,
+				Successor:   node.successor(),
+				Predecessor: node.predecessor(),
+				Fingers:     node.fingers(),
+			}, nil
+		}
+	}
+
+	resp := s.get_response(nodeURL(address, "node-info"))
+	if resp == nil {
+		return nil, fmt.Errorf("no response")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var info struct {
+		Id          ID             `json:"id"`
+		Address     string         `json:"address"`
+		Successor   *NodeAddress   `json:"successor"`
+		Predecessor *NodeAddress   `json:"predecessor"`
+		Fingers     []*FingerEntry `json:"others"`
+		Vnodes      []struct {
+			Id ID `json:"id"`
+		} `json:"vnodes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+
+	if len(info.Vnodes) > 0 {
+		ids := make([]ID, 0, len(info.Vnodes))
+		for _, vnode := range info.Vnodes {
+			ids = append(ids, vnode.Id)
+		}
+		report.servers[info.Address] = ids
+	}
+
+	// Use the address the node was reached at, even if it advertises another one
+	return &RingMember{
+		Id:          info.Id,
+		Address:     address.Address,
+		Successor:   info.Successor,
+		Predecessor: info.Predecessor,
+		Fingers:     info.Fingers,
+	}, nil
+}
+
+// checkRingOrder checks that the successor pointers go around the circle exactly once
+func checkRingOrder(report *RingReport) {
+
+	wraps := 0
+	members := report.Members
+	for i, member := range members {
+		next := members[(i+1)%len(members)]
+		if next.Id.Cmp(member.Id) <= 0 {
+			wraps++
+		}
+	}
+
+	if wraps > 1 {
+		report.problem("order", report.Start, "successor pointers go around the circle %d times instead of once", wraps)
+	}
+}
+
+// checkPredecessors checks that the successor of every member points back to it
+func checkPredecessors(report *RingReport) {
+
+	members := report.Members
+	for i, member := range members {
+		next := members[(i+1)%len(members)]
+
+		if next.Predecessor == nil {
+			report.problem("predecessor", next.address(), "predecessor of %s (%s) is unset, expected %s (%s)", next.Id, next.Address, member.Id, member.Address)
+		} else if !sameNode(next.Predecessor, member.address()) {
+			report.problem("predecessor", next.address(), "predecessor of %s (%s) is %s (%s), expected %s (%s)",
+				next.Id, next.Address, next.Predecessor.Id, next.Predecessor.Address, member.Id, member.Address)
+		}
+	}
+}
+
+// checkFingers compares every finger with the real successor of its start
+func checkFingers(report *RingReport) {
+
+	sorted := make([]*RingMember, len(report.Members))
+	copy(sorted, report.Members)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Id.Cmp(sorted[j].Id) < 0 })
+
+	successorOf := func(key ID) *RingMember {
+		i := sort.Search(len(sorted), func(i int) bool { return sorted[i].Id.Cmp(key) >= 0 })
+		return sorted[i%len(sorted)]
+	}
+
+	for _, member := range report.Members {
+		for i, finger := range member.Fingers {
+			expected := successorOf(finger.Start)
+
+			if finger.SuccessorID == nil {
+				report.problem("finger", member.address(), "finger %d of %s (%s) is unset, expected %s (%s)", i, member.Id, member.Address, expected.Id, expected.Address)
+			} else if !sameNode(finger.SuccessorID, expected.address()) {
+				report.problem("finger", member.address(), "finger %d of %s (%s) is %s (%s), expected %s (%s)",
+					i, member.Id, member.Address, finger.SuccessorID.Id, finger.SuccessorID.Address, expected.Id, expected.Address)
+			}
+		}
+	}
+}
+
+// checkUnvisitedNodes looks at the nodes the members refer to, or that share a server with a member,
+// but that were not reached by following successor pointers. A reachable one means the successor
+// cycle is shorter than the ring. Those are only reported if the walk got back to its start.
+func (s *Server) checkUnvisitedNodes(report *RingReport, visited map[NodeAddress]bool) {
+
+	var referenced []*NodeAddress
+	seen := make(map[NodeAddress]bool)
+	refer := func(address *NodeAddress) {
+		if address != nil && !visited[*address] && !seen[*address] {
+			seen[*address] = true
+			referenced = append(referenced, address)
+		}
+	}
+
+	for _, member := range report.Members {
+		refer(member.Predecessor)
+		for _, finger := range member.Fingers {
+			refer(finger.SuccessorID)
+		}
+	}
+	for _, member := range report.Members {
+		for _, id := range report.servers[member.Address] {
+			refer(&NodeAddress{Id: id, Address: member.Address})
+		}
+	}
+
+	for _, address := range referenced {
+		if _, err := s.fetchRingMember(address, report); err != nil {
+			report.problem("unreachable", address, "%s (%s) is referenced by the ring but could not be reached: %v", address.Id, address.Address, err)
+		} else if report.Closed {
+			report.problem("not-in-ring", address, "%s (%s) is alive but not reached by following successor pointers", address.Id, address.Address)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ringRadius is the radius in inches of the circle the nodes are drawn on
+const ringRadius = 4.0
+
+// RingGraph is the ring as nodes and links, in the shape D3 force and chord layouts expect
+type RingGraph struct {
+	Nodes    []*GraphNode   `json:"nodes"`
+	Links    []*GraphLink   `json:"links"`
+	Problems []*RingProblem `json:"problems"`
+	Hash     string         `json:"hash"`
+	Bits     int            `json:"bits"`
+}
+
+// GraphNode is a member of the ring, placed on the unit circle by its ID.
+// Angle is in radians, clockwise from the top, like the ring is usually drawn.
+type GraphNode struct {
+	Id      string  `json:"id"`
+	Address string  `json:"address"`
+	Angle   float64 `json:"angle"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+}
+
+// GraphLink is a pointer from one node to another. Type is successor, predecessor or finger.
+// Finger links to the same node are merged and list the finger indices.
+type GraphLink struct {
+	Source  string `json:"source"`
+	Target  string `json:"target"`
+	Type    string `json:"type"`
+	Fingers []int  `json:"fingers,omitempty"`
+}
+
+// ringAngle returns the position of id on the circle in radians, clockwise from the top
+func ringAngle(id ID) float64 {
+	fraction, _ := new(big.Rat).SetFrac(id.bigInt(), ringSize()).Float64()
+	return 2 * math.Pi * fraction
+}
+
+// graph turns the report into nodes and links. Nodes that members point to but that were
+// not visited are included as well, so broken pointers show up in the drawing.
+func (report *RingReport) graph() *RingGraph {
+
+	graph := &RingGraph{
+		Nodes:    []*GraphNode{},
+		Links:    []*GraphLink{},
+		Problems: report.Problems,
+		Hash:     report.Hash,
+		Bits:     report.Bits,
+	}
+
+	known := make(map[string]bool)
+	addNode := func(address *NodeAddress) string {
+		key := address.Id.String()
+		if !known[key] {
+			known[key] = true
+			angle := ringAngle(address.Id)
+			graph.Nodes = append(graph.Nodes, &GraphNode{
+				Id:      key,
+				Address: address.Address,
+				Angle:   angle,
+				X:       math.Sin(angle),
+				Y:       math.Cos(angle),
+			})
+		}
+		return key
+	}
+
+	for _, member := range report.Members {
+		addNode(member.address())
+	}
+
+	for _, member := range report.Members {
+		source := member.Id.String()
+
+		if member.Successor != nil {
+			graph.Links = append(graph.Links, &GraphLink{Source: source, Target: addNode(member.Successor), Type: "successor"})
+		}
+		if member.Predecessor != nil {
+			graph.Links = append(graph.Links, &GraphLink{Source: source, Target: addNode(member.Predecessor), Type: "predecessor"})
+		}
+
+		fingers := make(map[string]*GraphLink)
+		for i, finger := range member.Fingers {
+			if finger.SuccessorID == nil {
+				continue
+			}
+			target := addNode(finger.SuccessorID)
+			if target == source {
+				continue
+			}
+			if link, ok := fingers[target]; ok {
+				link.Fingers = append(link.Fingers, i)
+				continue
+			}
+			fingers[target] = &GraphLink{Source: source, Target: target, Type: "finger", Fingers: []int{i}}
+			graph.Links = append(graph.Links, fingers[target])
+		}
+	}
+
+	return graph
+}
+
+// dot renders the graph in the Graphviz DOT language. The nodes have fixed positions on a circle,
+// so the output is meant for neato, e.g. neato -Tpng ring.dot > ring.png
+func (graph *RingGraph) dot() string {
+
+	var b strings.Builder
+
+	b.WriteString("digraph ring {\n")
+	fmt.Fprintf(&b, "\tlabel=%q;\n", fmt.Sprintf("%s, %d bits, %d problems", graph.Hash, graph.Bits, len(graph.Problems)))
+	b.WriteString("\tlayout=neato;\n")
+	b.WriteString("\tnode [shape=circle, fontsize=10];\n")
+
+	problems := make(map[string]bool)
+	for _, problem := range graph.Problems {
+		if problem.Node != nil {
+			problems[problem.Node.Id.String()] = true
+		}
+	}
+
+	nodes := make([]*GraphNode, len(graph.Nodes))
+	copy(nodes, graph.Nodes)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Angle < nodes[j].Angle })
+
+	for _, node := range nodes {
+		color := "black"
+		if problems[node.Id] {
+			color = "red"
+		}
+		fmt.Fprintf(&b, "\t%q [label=%q, pos=\"%s,%s!\", color=%s];\n",
+			node.Id, node.Id+"\n"+node.Address, formatInches(node.X), formatInches(node.Y), color)
+	}
+
+	for _, link := range graph.Links {
+		switch link.Type {
+		case "successor":
+			fmt.Fprintf(&b, "\t%q -> %q [style=solid, penwidth=2];\n", link.Source, link.Target)
+		case "predecessor":
+			fmt.Fprintf(&b, "\t%q -> %q [style=dashed, color=blue];\n", link.Source, link.Target)
+		case "finger":
+			indices := make([]string, len(link.Fingers))
+			for i, finger := range link.Fingers {
+				indices[i] = strconv.Itoa(finger)
+			}
+			fmt.Fprintf(&b, "\t%q -> %q [style=dotted, color=gray, fontsize=8, fontcolor=gray, label=%q];\n",
+				link.Source, link.Target, strings.Join(indices, ","))
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// formatInches scales a coordinate on the unit circle to the drawing
+func formatInches(value float64) string {
+	return strconv.FormatFloat(value*ringRadius, 'f', 3, 64)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Headers every node adds to its requests, so a node from a ring with other parameters is caught
+const (
+	hashHeader = "X-Chord-Hash"
+	bitsHeader = "X-Chord-Bits"
+)
+
+// setRingParameters adds the hash function and identifier space of this node to a request
+func setRingParameters(req *http.Request) {
+	req.Header.Set(hashHeader, keyHash.Name())
+	req.Header.Set(bitsHeader, strconv.Itoa(keyIdentifierSpace))
+}
+
+// checkRingParameters rejects requests from nodes that place keys with another hash function
+// or identifier space than this node. Requests from clients carry no parameters and pass through.
+func (s *Server) checkRingParameters(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		hashName := r.Header.Get(hashHeader)
+		bits := r.Header.Get(bitsHeader)
+
+		if err := compareRingParameters(hashName, bits); err != nil {
+			fmt.Fprintf(s.log, "Rejected %s %s from %s: %s\n", r.Method, r.URL.Path, r.RemoteAddr, err)
+			metrics.inc("ring_parameter_mismatch")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// compareRingParameters returns an error if the given hash function or identifier space differ from ours.
+// Empty values are not compared.
+func compareRingParameters(hashName, bits string) error {
+
+	if hashName != "" && hashName != keyHash.Name() {
+		return fmt.Errorf("hash function %s does not match the %s used by this ring", hashName, keyHash.Name())
+	}
+
+	if bits != "" && bits != strconv.Itoa(keyIdentifierSpace) {
+		return fmt.Errorf("identifier space of %s bits does not match the %d bits used by this ring", bits, keyIdentifierSpace)
+	}
+
+	return nil
+}
+
+// checkRingCompatibility asks the node at address for its ring parameters
+// and returns an error if a node with our parameters cannot join its ring
+func (s *Server) checkRingCompatibility(address string) error {
+
+	resp := s.get_response(fmt.Sprintf("http://%s/node-info", address))
+	if resp == nil {
+		return fmt.Errorf("error connecting to %s", address)
+	}
+	defer resp.Body.Close()
+
+	// The node rejected our own parameters
+	if resp.StatusCode == http.StatusConflict {
+		reason, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", address, strings.TrimSpace(string(reason)))
+	}
+
+	var data map[string]interface{}
+	if err := decodeJSON(resp.Body, &data); err != nil {
+		return fmt.Errorf("error decoding JSON from %s", address)
+	}
+
+	hashName, _ := data["hash"].(string)
+	bits := ""
+	if data["bits"] != nil {
+		bits = fmt.Sprint(data["bits"])
+	}
+
+	if err := compareRingParameters(hashName, bits); err != nil {
+		return fmt.Errorf("%s: %s", address, err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckRingParameters(t *testing.T) {
+
+	bits := keyIdentifierSpace
+	keyIdentifierSpace = 16
+	defer func() { keyIdentifierSpace = bits }()
+
+	nodes, err := newNodes("127.0.0.1:1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(nodes, nil)
+	s.log = io.Discard
+	handler := s.checkRingParameters(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		hash   string
+		bits   string
+		status int
+	}{
+		{"client without parameters", "", "", http.StatusOK},
+		{"same parameters", keyHash.Name(), "16", http.StatusOK},
+		{"other hash function", "xxhash", "16", http.StatusConflict},
+		{"other identifier space", keyHash.Name(), "17", http.StatusConflict},
+		{"other identifier space only", "", "160", http.StatusConflict},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/node-info", nil)
+		if test.hash != "" {
+			r.Header.Set(hashHeader, test.hash)
+		}
+		if test.bits != "" {
+			r.Header.Set(bitsHeader, test.bits)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: answered %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+func TestCheckRingCompatibility(t *testing.T) {
+
+	bits := keyIdentifierSpace
+	keyIdentifierSpace = 16
+	defer func() { keyIdentifierSpace = bits }()
+
+	nodes, err := newNodes("127.0.0.1:1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(nodes, nil)
+	s.log = io.Discard
+
+	// nodeInfo starts a node that answers /node-info with info, or with 409 if info is nil
+	nodeInfo := func(info map[string]interface{}) string {
+		node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if info == nil {
+				http.Error(w, "hash function "+keyHash.Name()+" does not match the xxhash used by this ring", http.StatusConflict)
+				return
+			}
+			json.NewEncoder(w).Encode(info)
+		}))
+		t.Cleanup(node.Close)
+		return strings.TrimPrefix(node.URL, "http://")
+	}
+
+	tests := []struct {
+		name   string
+		info   map[string]interface{}
+		refuse string
+	}{
+		{"same parameters", map[string]interface{}{"hash": keyHash.Name(), "bits": keyIdentifierSpace}, ""},
+		{"other hash function", map[string]interface{}{"hash": "xxhash", "bits": keyIdentifierSpace}, "hash function xxhash"},
+		{"other identifier space", map[string]interface{}{"hash": keyHash.Name(), "bits": keyIdentifierSpace + 1}, "identifier space"},
+		{"node rejects our parameters", nil, "does not match the xxhash"},
+	}
+	for _, test := range tests {
+		err := s.checkRingCompatibility(nodeInfo(test.info))
+		switch {
+		case test.refuse == "" && err != nil:
+			t.Errorf("%s: join refused: %s", test.name, err)
+		case test.refuse != "" && err == nil:
+			t.Errorf("%s: join allowed", test.name)
+		case test.refuse != "" && !strings.Contains(err.Error(), test.refuse):
+			t.Errorf("%s: join refused with %q, want the reason %q", test.name, err, test.refuse)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Number of keys in a page of a scan, if the client does not ask for another number, and at most
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// ScanItem is a key found by a scan, with what it holds
+type ScanItem struct {
+	Key     string      `json:"key"`
+	Value   interface{} `json:"value"`
+	Version int64       `json:"version,omitempty"`
+}
+
+// ScanPage is one page of a scan. Next is the token of the next page, empty on the last page.
+type ScanPage struct {
+	Items []*ScanItem `json:"items"`
+	Next  string      `json:"next,omitempty"`
+}
+
+// scanInterval is a part [from, to] of the ring owned by one virtual node, which does not wrap around zero
+type scanInterval struct {
+	node *NodeAddress
+	from ID
+	to   ID
+}
+
+// ringIntervals splits the ring into the parts owned by its members, sorted by where they start
+func ringIntervals(members []*RingMember) []scanInterval {
+
+	last := idFromBig(new(big.Int).Sub(ringSize(), big.NewInt(1)))
+
+	var intervals []scanInterval
+	for i, member := range members {
+		previous := members[(i+len(members)-1)%len(members)]
+		from := previous.Id.addPowerOfTwo(0)
+
+		if previous.Id.Cmp(member.Id) < 0 {
+			intervals = append(intervals, scanInterval{node: member.address(), from: from, to: member.Id})
+			continue
+		}
+
+		// The part of the first node wraps around zero, and so does the whole ring of a single node
+		if previous.Id.Cmp(last) < 0 {
+			intervals = append(intervals, scanInterval{node: member.address(), from: from, to: last})
+		}
+		intervals = append(intervals, scanInterval{node: member.address(), from: ID{}, to: member.Id})
+	}
+
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].from.Cmp(intervals[j].from) < 0 })
+	return intervals
+}
+
+func orderedPlacement() bool {
+	_, ok := keyHash.(orderedHash)
+	return ok
+}
+
+// scanHandler lists the keys that start with a prefix in order, a page at a time:
+// GET /scan?prefix=<prefix>&limit=<n>&token=<next token of the previous page>
+func (s *Server) scanHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := scanLimit(query.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	after, err := base64.RawURLEncoding.DecodeString(query.Get("token"))
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusBadRequest)
+		return
+	}
+
+	page, err := s.scan(query.Get("prefix"), string(after), limit)
+	if err != nil {
+		fmt.Fprintln(s.log, "Scan failed:", err)
+		http.Error(w, "Scan failed: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, page)
+}
+
+func scanLimit(text string) (int, error) {
+	if text == "" {
+		return defaultScanLimit, nil
+	}
+	limit, err := strconv.Atoi(text)
+	if err != nil || limit < 1 || limit > maxScanLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxScanLimit)
+	}
+	return limit, nil
+}
+
+// scan returns the first limit keys after after that start with prefix. With ordered placement, the
+// parts of the ring that can hold such keys are visited in order, starting at the owner of the first
+// key, until the page is full. With hashed placement, the keys of a prefix are spread over the ring,
+// so every server is asked for its first keys and the answers are merged.
+func (s *Server) scan(prefix, after string, limit int) (*ScanPage, error) {
+
+	report := s.walkRing(s.nodes[0].address())
+	if !report.Closed {
+		return nil, fmt.Errorf("the ring walk did not get around the ring")
+	}
+
+	var items []*ScanItem
+
+	if orderedPlacement() {
+		start := max(prefix, after)
+		first, last := hash(start), hash(prefix+strings.Repeat("\xff", maxIdentifierSpace/8))
+
+		for _, interval := range ringIntervals(report.Members) {
+			if interval.to.Cmp(first) < 0 {
+				continue
+			}
+			if interval.from.Cmp(last) > 0 || len(items) == limit {
+				break
+			}
+			found, err := s.scanNode(interval, prefix, after, limit-len(items))
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, found...)
+		}
+
+	} else {
+		whole := scanInterval{to: idFromBig(new(big.Int).Sub(ringSize(), big.NewInt(1)))}
+		asked := make(map[string]bool)
+		seen := make(map[string]bool)
+
+		for _, member := range report.Members {
+			if asked[member.Address] {
+				continue
+			}
+			asked[member.Address] = true
+
+			whole.node = member.address()
+			found, err := s.scanNode(whole, prefix, after, limit)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range found {
+				if !seen[item.Key] {
+					seen[item.Key] = true
+					items = append(items, item)
+				}
+			}
+		}
+
+		sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+		if len(items) > limit {
+			items = items[:limit]
+		}
+	}
+
+	page := &ScanPage{Items: items}
+	if page.Items == nil {
+		page.Items = []*ScanItem{}
+	}
+	if len(items) == limit {
+		page.Next = base64.RawURLEncoding.EncodeToString([]byte(items[limit-1].Key))
+	}
+	return page, nil
+}
+
+// scanNode asks the server of a virtual node for its keys in an interval
+func (s *Server) scanNode(interval scanInterval, prefix, after string, limit int) ([]*ScanItem, error) {
+
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("after", after)
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("from", interval.from.String())
+	query.Set("to", interval.to.String())
+
+	var items []*ScanItem
+	if err := s.fetchJSON(nodeURL(interval.node, "scan/local?"+query.Encode()), &items); err != nil {
+		return nil, fmt.Errorf("%s: %v", interval.node.Address, err)
+	}
+	return items, nil
+}
+
+// scanLocalHandler returns the first keys owned by this server that a scan asks for
+func (s *Server) scanLocalHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := scanLimit(query.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseID(query.Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseID(query.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	include := func(key string, record *Record) bool {
+		id := hash(key)
+		return record.live(s.clock()) && !strings.HasPrefix(key, chunkPrefix) && id.Cmp(from) >= 0 && id.Cmp(to) <= 0 && s.ownerOf(id) != nil
+	}
+	keys, records := s.storage.scan(query.Get("prefix"), query.Get("after"), limit, include)
+
+	items := make([]*ScanItem, len(keys))
+	for i, key := range keys {
+		items[i] = &ScanItem{Key: key, Value: records[i].contents(), Version: records[i].Version}
+	}
+	writeJSON(w, items)
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSimulatedDepth bounds how many requests can be nested inside each other, e.g. a lookup
+// forwarded around a broken ring. A real node would time out instead.
+const maxSimulatedDepth = 64
+
+// simulationEpoch is the time on the virtual clock when a simulation starts. The servers read
+// their clock from the simulator, so versions and timestamps are the same in every run.
+var simulationEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Simulator runs many servers in one process. Requests between them are handler calls through
+// an in-memory transport, and a virtual clock drives the maintenance rounds, so minutes of ring
+// activity take about a second, and a run goes the same way every time for the same script and seed.
+type Simulator struct {
+	now     time.Duration
+	rng     *rand.Rand
+	events  eventQueue
+	seq     int
+	servers map[string]*simulatedServer
+	order   []string // Addresses of the servers in the order they were started
+
+	minLatency time.Duration
+	maxLatency time.Duration
+
+	depth    int
+	requests int
+	failures int
+	out      io.Writer // The simulation log
+	nodeLog  io.Writer // Where the servers report what they do
+}
+
+// simulatedServer is a server in the simulation with its pending maintenance rounds
+type simulatedServer struct {
+	server  *Server
+	stopped bool
+	member  bool                                 // Joined a ring, or was joined through, and has not left since
+	pending map[*maintenanceLoop]*simulatedEvent // The next round of every maintenance loop
+}
+
+type simulatedEvent struct {
+	at        time.Duration
+	priority  int64 // Random, orders events at the same time
+	seq       int
+	action    func()
+	cancelled bool
+}
+
+// eventQueue orders events by time, then by their random priority
+type eventQueue []*simulatedEvent
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*simulatedEvent)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	event := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return event
+}
+
+func newSimulator(seed int64, out, nodeLog io.Writer) *Simulator {
+	return &Simulator{
+		rng:     rand.New(rand.NewSource(seed)),
+		servers: make(map[string]*simulatedServer),
+		out:     out,
+		nodeLog: nodeLog,
+	}
+}
+
+// simulatedTransport delivers a request by calling the handler of the server it is addressed to
+type simulatedTransport struct {
+	sim *Simulator
+}
+
+func (t *simulatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	target, ok := t.sim.servers[req.URL.Host]
+	if !ok || target.stopped {
+		return nil, fmt.Errorf("dial tcp %s: connection refused", req.URL.Host)
+	}
+
+	if t.sim.depth >= maxSimulatedDepth {
+		return nil, fmt.Errorf("request to %s nested more than %d requests deep", req.URL.Host, maxSimulatedDepth)
+	}
+
+	req = req.Clone(req.Context())
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+	req.RemoteAddr = "simulation"
+	req.RequestURI = req.URL.RequestURI()
+
+	t.sim.depth++
+	t.sim.requests++
+	defer func() { t.sim.depth-- }()
+
+	recorder := httptest.NewRecorder()
+	target.server.handler.ServeHTTP(recorder, req)
+	return recorder.Result(), nil
+}
+
+// schedule runs action after the given delay of virtual time
+func (sim *Simulator) schedule(delay time.Duration, action func()) *simulatedEvent {
+	sim.seq++
+	event := &simulatedEvent{at: sim.now + delay, priority: sim.rng.Int63(), seq: sim.seq, action: action}
+	heap.Push(&sim.events, event)
+	return event
+}
+
+// latency returns a random delay for a one-way message. Messages sent one after another
+// can arrive in another order.
+func (sim *Simulator) latency() time.Duration {
+	if sim.maxLatency <= sim.minLatency {
+		return sim.minLatency
+	}
+	return sim.minLatency + time.Duration(sim.rng.Int63n(int64(sim.maxLatency-sim.minLatency)+1))
+}
+
+// jitter adds up to a tenth to a maintenance interval, so the rounds of different servers
+// interleave differently for every seed, as they do on real machines
+func (sim *Simulator) jitter(interval time.Duration) time.Duration {
+	if interval < 10 {
+		return interval
+	}
+	return interval + time.Duration(sim.rng.Int63n(int64(interval/10)))
+}
+
+func (sim *Simulator) logf(format string, args ...interface{}) {
+	fmt.Fprintf(sim.out, "%10s  %s\n", sim.now, fmt.Sprintf(format, args...))
+}
+
+func (sim *Simulator) fail(format string, args ...interface{}) {
+	sim.failures++
+	sim.logf("FAIL "+format, args...)
+}
+
+// start creates a server with count virtual nodes at address, alone in its own ring
+func (sim *Simulator) start(address string, count int) error {
+
+	if existing, ok := sim.servers[address]; ok && !existing.stopped {
+		return fmt.Errorf("%s is already running", address)
+	}
+
+	nodes, err := newNodes(address, count)
+	if err != nil {
+		return err
+	}
+
+	simulated := &simulatedServer{server: newServer(nodes, &simulatedTransport{sim: sim}), pending: make(map[*maintenanceLoop]*simulatedEvent)}
+	simulated.server.log = sim.nodeLog
+	simulated.server.clock = func() time.Time { return simulationEpoch.Add(sim.now) }
+	// Without latency, one-way messages are sent right away, like the real nodes do
+	simulated.server.send = func(message func()) {
+		if sim.maxLatency <= 0 {
+			message()
+			return
+		}
+		sim.schedule(sim.latency(), message)
+	}
+
+	if _, ok := sim.servers[address]; !ok {
+		sim.order = append(sim.order, address)
+	}
+	sim.servers[address] = simulated
+
+	for _, task := range simulated.server.maintenanceTasks() {
+		sim.scheduleRound(simulated, task, sim.jitter(task.loop.interval.current))
+	}
+	return nil
+}
+
+// scheduleRound replaces the pending round of a maintenance task of a server with one after delay
+func (sim *Simulator) scheduleRound(simulated *simulatedServer, task maintenanceTask, delay time.Duration) {
+	if pending := simulated.pending[task.loop]; pending != nil {
+		pending.cancelled = true
+	}
+	simulated.pending[task.loop] = sim.schedule(delay, func() {
+		delete(simulated.pending, task.loop)
+		if simulated.stopped {
+			return
+		}
+		changed := task.round()
+		sim.scheduleRound(simulated, task, sim.jitter(task.loop.interval.next(changed)))
+	})
+}
+
+// wakeLoops runs the maintenance rounds right away on servers whose ring changed,
+// like the real loops do when they are woken up
+func (sim *Simulator) wakeLoops() {
+	for _, address := range sim.order {
+		simulated := sim.servers[address]
+		for _, task := range simulated.server.maintenanceTasks() {
+			select {
+			case <-task.loop.wake:
+				sim.scheduleRound(simulated, task, 0)
+			default:
+			}
+		}
+	}
+}
+
+// runUntil processes all events up to the given virtual time
+func (sim *Simulator) runUntil(until time.Duration) {
+	for sim.events.Len() > 0 && sim.events[0].at <= until {
+		event := heap.Pop(&sim.events).(*simulatedEvent)
+		if event.cancelled {
+			continue
+		}
+		sim.now = event.at
+		event.action()
+		sim.wakeLoops()
+	}
+	sim.now = until
+}
+
+// request sends a client request to the server at address and returns the status and body
+func (sim *Simulator) request(method, address, path, body string) (int, string) {
+
+	req, _ := http.NewRequest(method, "http://"+address+path, strings.NewReader(body))
+	if tokens := splitList(*adminToken); len(tokens) > 0 {
+		req.Header.Set("Authorization", "Bearer "+tokens[0])
+	}
+
+	client := &http.Client{Transport: &simulatedTransport{sim: sim}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	sim.wakeLoops()
+	return resp.StatusCode, strings.TrimSpace(string(data))
+}
+
+// members returns the servers that should be part of the ring: those that joined it,
+// or that others joined through, and are running and not crashed
+func (sim *Simulator) members() []*simulatedServer {
+	var servers []*simulatedServer
+	for _, address := range sim.order {
+		simulated := sim.servers[address]
+		if simulated.member && !simulated.stopped && !simulated.server.crashed.Load() {
+			servers = append(servers, simulated)
+		}
+	}
+	return servers
+}
+
+// server returns the running server at address
+func (sim *Simulator) server(address string) (*simulatedServer, error) {
+	simulated, ok := sim.servers[address]
+	if !ok || simulated.stopped {
+		return nil, fmt.Errorf("no server running at %s", address)
+	}
+	return simulated, nil
+}
+
+// converged walks the ring from the given server. It reports whether the ring is
+// consistent and contains every member, and the problems otherwise.
+func (sim *Simulator) converged(simulated *simulatedServer) (bool, []string) {
+
+	report := simulated.server.walkRing(simulated.server.nodes[0].address())
+
+	var problems []string
+	for _, problem := range report.Problems {
+		problems = append(problems, problem.Kind+": "+problem.Message)
+	}
+
+	inRing := make(map[string]bool)
+	for _, member := range report.Members {
+		inRing[member.Address] = true
+	}
+	for _, member := range sim.members() {
+		for _, node := range member.server.nodes {
+			if !inRing[node.Address] {
+				problems = append(problems, fmt.Sprintf("missing: %s is not in the ring", node.Address))
+				break
+			}
+		}
+	}
+
+	if !report.Consistent && len(problems) == 0 {
+		problems = append(problems, fmt.Sprintf("walk: the ring walk did not get back to its start within %d nodes", maxRingWalk))
+	}
+	return len(problems) == 0, problems
+}
+
+// checkPlacement checks that every member only stores keys that its virtual nodes own in the ring
+// made of all members, or that it holds replicas of, being one of the next servers after the owner
+func (sim *Simulator) checkPlacement() []string {
+
+	var nodes []*Node
+	for _, member := range sim.members() {
+		nodes = append(nodes, member.server.nodes...)
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id.Cmp(nodes[j].Id) < 0 })
+
+	var problems []string
+	for _, member := range sim.members() {
+		keys := member.server.storage.keys()
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			id := keyID(key)
+			i := sort.Search(len(nodes), func(i int) bool { return nodes[i].Id.Cmp(id) >= 0 })
+			owner := nodes[i%len(nodes)]
+
+			// The owner and the next distinct servers after it store the key
+			replicaSet := make(map[string]bool)
+			for j := 0; j < len(nodes) && len(replicaSet) < *replicas; j++ {
+				replicaSet[nodes[(i+j)%len(nodes)].Address] = true
+			}
+
+			if !replicaSet[member.server.nodes[0].Address] {
+				problems = append(problems, fmt.Sprintf("key %q (%s) is stored on %s, but owned by %s (%s)",
+					key, id, member.server.nodes[0].Address, owner.Id, owner.Address))
+			}
+		}
+	}
+	return problems
+}
+
+// runSimulation runs a simulation script and returns the number of failed checks,
+// or an error if the script could not be run
+func runSimulation(script io.Reader, seed int64, out, nodeLog io.Writer) (int, error) {
+
+	sim := newSimulator(seed, out, nodeLog)
+	keyIdentifierSpace = 16
+
+	scanner := bufio.NewScanner(script)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+
+		if err := sim.execute(strings.Fields(line)); err != nil {
+			return sim.failures, fmt.Errorf("line %d: %s: %v", lineNumber, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return sim.failures, err
+	}
+
+	sim.logf("done: %d requests, %d failed checks", sim.requests, sim.failures)
+	return sim.failures, nil
+}
+
+// execute runs a single command of a simulation script
+func (sim *Simulator) execute(args []string) error {
+
+	command, args := args[0], args[1:]
+
+	argCount := map[string][2]int{
+		"bits": {1, 1}, "latency": {2, 2}, "start": {1, 2}, "stop": {1, 1},
+		"join": {2, 2}, "leave": {1, 1}, "crash": {1, 1}, "recover": {1, 1},
+		"put": {3, 3}, "get": {2, 3}, "delete": {2, 2},
+		"run": {1, 1}, "converge": {1, 2}, "check": {1, 2}, "show": {0, 0},
+	}
+	limits, ok := argCount[command]
+	if !ok {
+		return fmt.Errorf("unknown command %q", command)
+	}
+	if len(args) < limits[0] || len(args) > limits[1] {
+		return fmt.Errorf("%s takes %d to %d arguments", command, limits[0], limits[1])
+	}
+
+	switch command {
+	case "bits":
+		bits, err := strconv.Atoi(args[0])
+		if err != nil || bits < 1 || bits > keyHash.Bits() {
+			return fmt.Errorf("identifier space must be between 1 and %d bits", keyHash.Bits())
+		}
+		if len(sim.servers) > 0 {
+			return fmt.Errorf("bits must be set before the first server is started")
+		}
+		keyIdentifierSpace = bits
+
+	case "latency":
+		minLatency, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		maxLatency, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		sim.minLatency, sim.maxLatency = minLatency, maxLatency
+
+	case "start":
+		count := 1
+		if len(args) == 2 {
+			var err error
+			if count, err = strconv.Atoi(args[1]); err != nil || count < 1 {
+				return fmt.Errorf("invalid number of virtual nodes %q", args[1])
+			}
+		}
+		if err := sim.start(args[0], count); err != nil {
+			return err
+		}
+		sim.logf("start %s with %d virtual nodes", args[0], count)
+
+	case "stop":
+		simulated, err := sim.server(args[0])
+		if err != nil {
+			return err
+		}
+		simulated.stopped = true
+		sim.logf("stop %s", args[0])
+
+	case "join":
+		status, body := sim.request(http.MethodPost, args[0], "/join?nprime="+args[1], "")
+		sim.logf("join %s via %s: %d %s", args[0], args[1], status, body)
+		if status == http.StatusOK {
+			for _, address := range args {
+				if simulated, ok := sim.servers[address]; ok {
+					simulated.member = true
+				}
+			}
+		}
+
+	case "leave", "crash", "recover":
+		endpoint := map[string]string{"leave": "/leave", "crash": "/sim-crash", "recover": "/sim-recover"}[command]
+		status, body := sim.request(http.MethodPost, args[0], endpoint, "")
+		sim.logf("%s %s: %d %s", command, args[0], status, body)
+		if command == "leave" && status == http.StatusOK {
+			sim.servers[args[0]].member = false
+		}
+
+	case "put":
+		status, body := sim.request(http.MethodPut, args[0], "/storage/"+args[1], args[2])
+		sim.logf("put %s=%s at %s: %d %s", args[1], args[2], args[0], status, body)
+
+	case "get":
+		status, body := sim.request(http.MethodGet, args[0], "/storage/"+args[1], "")
+		sim.logf("get %s at %s: %d %s", args[1], args[0], status, body)
+		if len(args) == 3 && args[2] == "-" && status != http.StatusNotFound {
+			sim.fail("get %s: expected no value, got %d %q", args[1], status, body)
+		} else if len(args) == 3 && args[2] != "-" && (status != http.StatusOK || body != args[2]) {
+			sim.fail("get %s: expected %q, got %d %q", args[1], args[2], status, body)
+		}
+
+	case "delete":
+		status, body := sim.request(http.MethodDelete, args[0], "/storage/"+args[1], "")
+		sim.logf("delete %s at %s: %d %s", args[1], args[0], status, body)
+
+	case "run":
+		duration, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		sim.runUntil(sim.now + duration)
+		sim.logf("ran %s", duration)
+
+	case "converge":
+		simulated, err := sim.server(args[0])
+		if err != nil {
+			return err
+		}
+		limit := 5 * time.Minute
+		if len(args) == 2 {
+			if limit, err = time.ParseDuration(args[1]); err != nil {
+				return err
+			}
+		}
+
+		started := sim.now
+		for {
+			ok, problems := sim.converged(simulated)
+			if ok {
+				sim.logf("converged after %s", sim.now-started)
+				break
+			}
+			if sim.now-started >= limit {
+				sim.fail("ring did not converge within %s, %d problems, first: %s", limit, len(problems), problems[0])
+				break
+			}
+			sim.runUntil(sim.now + 100*time.Millisecond)
+		}
+
+	case "show":
+		for _, address := range sim.order {
+			simulated := sim.servers[address]
+			state := "running"
+			if simulated.stopped {
+				state = "stopped"
+			} else if simulated.server.crashed.Load() {
+				state = "crashed"
+			}
+			for _, node := range simulated.server.nodes {
+				sim.logf("show %s (%s, %s): predecessor %s, successor %s", node.Id, node.Address, state, describe(node.predecessor()), describe(node.successor()))
+			}
+		}
+
+	case "check":
+		switch args[0] {
+		case "ring":
+			if len(args) != 2 {
+				return fmt.Errorf("check ring takes the address to walk the ring from")
+			}
+			simulated, err := sim.server(args[1])
+			if err != nil {
+				return err
+			}
+			if ok, problems := sim.converged(simulated); ok {
+				sim.logf("check ring: consistent")
+			} else {
+				for _, problem := range problems {
+					sim.fail("check ring: %s", problem)
+				}
+			}
+
+		case "placement":
+			problems := sim.checkPlacement()
+			if len(problems) == 0 {
+				sim.logf("check placement: every key is on its owner or its replicas")
+			}
+			for _, problem := range problems {
+				sim.fail("check placement: %s", problem)
+			}
+
+		default:
+			return fmt.Errorf("unknown check %q, must be ring or placement", args[0])
+		}
+	}
+
+	return nil
+}
+
+// simulate runs the script in the given file, see runSimulation. Output of the nodes is
+// hidden unless verbose is set. Returns the exit code.
+func simulate(path string, seed int64, verbose bool) int {
+
+	script, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Error opening simulation script:", err)
+		return 2
+	}
+	defer script.Close()
+
+	nodeLog := io.Discard
+	if verbose {
+		nodeLog = os.Stdout
+	}
+
+	fmt.Printf("Simulating %s with seed %d\n", path, seed)
+	failures, err := runSimulation(script, seed, os.Stdout, nodeLog)
+	if err != nil {
+		fmt.Println("Error in simulation script:", err)
+		return 2
+	}
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+// describe formats a node address for the simulation log
+func describe(address *NodeAddress) string {
+	if address == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s (%s)", address.Id, address.Address)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// simulationSeeds are the seeds every simulation script is run with, -short runs the first only
+var simulationSeeds = []int64{1, 2, 3}
+
+// runScript runs a simulation script with the output of the nodes discarded and returns the simulation log
+func runScript(t *testing.T, path string, seed int64) (string, int) {
+	t.Helper()
+
+	script, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer script.Close()
+
+	var log bytes.Buffer
+	failures, err := runSimulation(script, seed, &log, io.Discard)
+	if err != nil {
+		t.Fatalf("seed %d: %v\n%s", seed, err, log.String())
+	}
+	return log.String(), failures
+}
+
+func TestSimulations(t *testing.T) {
+
+	scripts, err := filepath.Glob("simulations/*.sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) == 0 {
+		t.Fatal("no simulation scripts found")
+	}
+
+	seeds := simulationSeeds
+	if testing.Short() {
+		seeds = seeds[:1]
+	}
+
+	bits := keyIdentifierSpace
+	t.Cleanup(func() { keyIdentifierSpace = bits })
+
+	for _, path := range scripts {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			for _, seed := range seeds {
+				log, failures := runScript(t, path, seed)
+				if failures > 0 {
+					for _, line := range strings.Split(log, "\n") {
+						if strings.Contains(line, "FAIL") {
+							t.Errorf("seed %d: %s", seed, strings.TrimSpace(line))
+						}
+					}
+					continue
+				}
+
+				// A simulation runs the same way every time for the same script and seed
+				if again, _ := runScript(t, path, seed); again != log {
+					t.Errorf("seed %d: a second run logged something else than the first", seed)
+				}
+			}
+		})
+	}
+}
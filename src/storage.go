@@ -0,0 +1,298 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is a stored value together with its version. A deleted key keeps its record as a
+// tombstone, so a replica that missed the delete cannot bring the old value back.
+// In the vector clock conflict mode, a record holds the concurrent versions of the key as
+// siblings instead, and the other fields are unused. A record with a CRDT holds a typed
+// value, which replicas merge. A record with a manifest holds a large value, stored in chunks.
+// Values are bytes, so any value survives the JSON between replicas.
+type Record struct {
+	Value    []byte     `json:"value"`
+	Version  int64      `json:"version"`
+	Writer   string     `json:"writer"` // Address of the node that wrote the version, breaks ties
+	Deleted  bool       `json:"deleted,omitempty"`
+	Expired  bool       `json:"expired,omitempty"` // The tombstone was written because the value was evicted or its TTL ran out
+	Siblings []*Sibling `json:"siblings,omitempty"`
+	CRDT     *CRDT      `json:"crdt,omitempty"`
+	Manifest *Manifest  `json:"manifest,omitempty"`
+	Meta     *Metadata  `json:"meta,omitempty"`
+}
+
+// newerThan reports whether r is a later version than other. Every record is newer than nil.
+// With vector clocks or CRDTs of the same type, r is newer if merging it into other changes other.
+func (r *Record) newerThan(other *Record) bool {
+	if other == nil {
+		return true
+	}
+	if r.sameType(other) {
+		if other.CRDT.merge(r.CRDT).encode() != other.CRDT.encode() {
+			return true
+		}
+	} else if vectorClocks() && r.CRDT == nil && other.CRDT == nil {
+		merged := mergeSiblings(other.Siblings, r.Siblings)
+		if len(merged) != len(other.Siblings) {
+			return true
+		}
+		for i, sib := range merged {
+			if !sib.sameWrite(other.Siblings[i]) {
+				return true
+			}
+		}
+		return false
+	}
+	if r.Version != other.Version {
+		return r.Version > other.Version
+	}
+	return r.Writer > other.Writer
+}
+
+// sameType reports whether both records hold CRDTs of the same type
+func (r *Record) sameType(other *Record) bool {
+	return r.CRDT != nil && other.CRDT != nil && r.CRDT.Type == other.CRDT.Type
+}
+
+// merge returns the record that replicas holding r and other settle on
+func (r *Record) merge(other *Record) *Record {
+	if other == nil || (r != nil && !other.newerThan(r)) {
+		return r
+	}
+	if r == nil {
+		return other
+	}
+	if r.sameType(other) {
+		merged := *other
+		if r.Version > other.Version || (r.Version == other.Version && r.Writer > other.Writer) {
+			merged.Version, merged.Writer = r.Version, r.Writer
+		}
+		merged.CRDT = r.CRDT.merge(other.CRDT)
+		return &merged
+	}
+	if !vectorClocks() || r.CRDT != nil || other.CRDT != nil {
+		return other
+	}
+	return &Record{Siblings: mergeSiblings(r.Siblings, other.Siblings)}
+}
+
+// live reports whether the record holds a value that clients can see at now: it exists, is not a
+// tombstone and its TTL, if it has one, has not run out
+func (r *Record) live(now time.Time) bool {
+	return r.holdsValue() && !r.Meta.expired(now)
+}
+
+// holdsValue reports whether the record holds a value, i.e. exists and is not a tombstone
+func (r *Record) holdsValue() bool {
+	if r == nil {
+		return false
+	}
+	if vectorClocks() && r.CRDT == nil {
+		for _, sib := range r.Siblings {
+			if !sib.Deleted {
+				return true
+			}
+		}
+		return false
+	}
+	return !r.Deleted
+}
+
+// contents returns what a live record holds for clients: the value, the value of its CRDT,
+// the manifest of a large value, or the values of its siblings in the vector clock mode
+func (r *Record) contents() interface{} {
+	switch {
+	case r.CRDT != nil:
+		return r.CRDT.value()
+	case r.Manifest != nil:
+		return r.Manifest
+	case vectorClocks():
+		values := []interface{}{}
+		for _, sib := range r.Siblings {
+			if !sib.Deleted {
+				values = append(values, displayValue(sib.Value))
+			}
+		}
+		return values
+	}
+	return displayValue(r.Value)
+}
+
+// Storage is the key-value store shared by all virtual nodes of a server
+type Storage struct {
+	mu      sync.RWMutex
+	records map[string]*Record
+	changed func(key string, record *Record) // Called after the record of a key changed, if set
+
+	// What the records take up, checked against -max-keys and -max-bytes
+	keyCount int
+	bytes    int64
+
+	// When every key was last read or written on this server, for LRU eviction
+	used map[string]time.Time
+
+	// clock tells the time of these uses and of the TTLs that run out, the clock of the server
+	clock func() time.Time
+}
+
+func newStorage() *Storage {
+	return &Storage{records: make(map[string]*Record), used: make(map[string]time.Time), clock: time.Now}
+}
+
+// set stores record under key and keeps the usage up to date. The lock must be held.
+func (st *Storage) set(key string, record *Record) {
+	oldKeys, oldBytes := usage(key, st.records[key])
+	newKeys, newBytes := usage(key, record)
+	st.keyCount += newKeys - oldKeys
+	st.bytes += newBytes - oldBytes
+
+	st.records[key] = record
+	st.used[key] = st.clock()
+}
+
+// record returns the record of key, including tombstones, or nil if there is none
+func (st *Storage) record(key string) *Record {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if record, ok := st.records[key]; ok {
+		copy := *record
+		return &copy
+	}
+	return nil
+}
+
+// apply stores record under key if it is newer than the stored one, merged with it.
+// It reports whether the record was stored. The limits of the storage do not apply, see applyWithin.
+func (st *Storage) apply(key string, record *Record) bool {
+	stored, _ := st.store(key, record, false)
+	return stored
+}
+
+// applyWithin is apply for writes, which must keep the storage within -max-keys and -max-bytes.
+// It returns an error wrapping errStorageFull if the merged record does not fit.
+func (st *Storage) applyWithin(key string, record *Record) (bool, error) {
+	return st.store(key, record, true)
+}
+
+// store is apply, checking the limits under the same lock as the write if limited is set,
+// so concurrent writes cannot exceed them together
+func (st *Storage) store(key string, record *Record, limited bool) (bool, error) {
+	st.mu.Lock()
+
+	stored := st.records[key]
+	switch {
+	case !stored.intact() && record.intact():
+		// An intact copy replaces one whose value got corrupted, whatever their versions
+		stored = nil
+	case !record.newerThan(stored):
+		st.mu.Unlock()
+		return false, nil
+	}
+	copy := *stored.merge(record)
+	if limited {
+		if err := st.fits(key, &copy); err != nil {
+			st.mu.Unlock()
+			return false, err
+		}
+	}
+	st.set(key, &copy)
+	st.mu.Unlock()
+
+	st.notify(key, &copy)
+	return true, nil
+}
+
+func (st *Storage) notify(key string, record *Record) {
+	if st.changed != nil {
+		st.changed(key, record)
+	}
+}
+
+// update replaces the record of key with the one change returns for the current record,
+// unless it returns nil. Returns the new record, or an error wrapping errStorageFull if the
+// new record does not fit within -max-keys and -max-bytes.
+func (st *Storage) update(key string, change func(current *Record) *Record) (*Record, error) {
+	st.mu.Lock()
+
+	var current *Record
+	if stored, ok := st.records[key]; ok {
+		copy := *stored
+		current = &copy
+	}
+
+	record := change(current)
+	if record == nil {
+		st.mu.Unlock()
+		return nil, nil
+	}
+	copy := *record
+	if err := st.fits(key, &copy); err != nil {
+		st.mu.Unlock()
+		return nil, err
+	}
+	st.set(key, &copy)
+	st.mu.Unlock()
+
+	st.notify(key, &copy)
+	return record, nil
+}
+
+// inRange returns copies of the records, tombstones included, whose keys hash into kr
+func (st *Storage) inRange(kr keyRange) map[string]*Record {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	records := make(map[string]*Record)
+	for key, record := range st.records {
+		if kr.contains(keyID(key)) {
+			copy := *record
+			records[key] = &copy
+		}
+	}
+	return records
+}
+
+// scan returns up to limit records, tombstones included, with keys after after that start with prefix
+// and that include accepts, sorted by key
+func (st *Storage) scan(prefix, after string, limit int, include func(key string, record *Record) bool) ([]string, []*Record) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var keys []string
+	for key, record := range st.records {
+		if strings.HasPrefix(key, prefix) && key > after && include(key, record) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	records := make([]*Record, len(keys))
+	for i, key := range keys {
+		copy := *st.records[key]
+		records[i] = &copy
+	}
+	return keys, records
+}
+
+// keys returns all keys in the store that hold a value
+func (st *Storage) keys() []string {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	keys := make([]string, 0, len(st.records))
+	for key, record := range st.records {
+		if record.live(st.clock()) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestRecordNewerThan(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		r     *Record
+		other *Record
+		want  bool
+	}{
+		{"anything is newer than nothing", &Record{Version: 1}, nil, true},
+		{"higher version", &Record{Version: 2, Writer: "a"}, &Record{Version: 1, Writer: "b"}, true},
+		{"lower version", &Record{Version: 1, Writer: "b"}, &Record{Version: 2, Writer: "a"}, false},
+		{"same version, higher writer", &Record{Version: 1, Writer: "b"}, &Record{Version: 1, Writer: "a"}, true},
+		{"same version and writer", &Record{Version: 1, Writer: "a"}, &Record{Version: 1, Writer: "a"}, false},
+		{"tombstone with a higher version", &Record{Version: 2, Deleted: true}, &Record{Version: 1, Value: []byte("v")}, true},
+	}
+	for _, test := range tests {
+		if got := test.r.newerThan(test.other); got != test.want {
+			t.Errorf("%s: newerThan = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRecordMerge(t *testing.T) {
+
+	old := &Record{Value: []byte("old"), Version: 1, Writer: "a"}
+	updated := &Record{Value: []byte("new"), Version: 2, Writer: "a"}
+
+	if got := old.merge(updated); got != updated {
+		t.Errorf("merging a newer record kept %+v", got)
+	}
+	if got := updated.merge(old); got != updated {
+		t.Errorf("merging an older record gave %+v", got)
+	}
+	if got := (*Record)(nil).merge(old); got != old {
+		t.Errorf("merging into no record gave %+v", got)
+	}
+	if got := old.merge(nil); got != old {
+		t.Errorf("merging no record gave %+v", got)
+	}
+
+	// In the vector clock mode, concurrent writes are kept as siblings
+	mode := *conflictMode
+	*conflictMode = conflictVectorClock
+	defer func() { *conflictMode = mode }()
+
+	left := &Record{Siblings: []*Sibling{{Node: "a", Counter: 1, Value: []byte("left")}}}
+	right := &Record{Siblings: []*Sibling{{Node: "b", Counter: 1, Value: []byte("right")}}}
+	if got := writes(left.merge(right).Siblings); got != "a:1 b:1" {
+		t.Errorf("merged concurrent writes to %q, want \"a:1 b:1\"", got)
+	}
+	if left.newerThan(left.merge(right)) {
+		t.Errorf("a record is newer than a merge that includes it")
+	}
+	replacing := &Record{Siblings: []*Sibling{{Node: "b", Counter: 2, Clock: VectorClock{"a": 1, "b": 1}}}}
+	if got := writes(left.merge(right).merge(replacing).Siblings); got != "b:2" {
+		t.Errorf("a write that saw both siblings left %q, want \"b:2\"", got)
+	}
+}
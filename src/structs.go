@@ -1,33 +1,111 @@
 package main
 
-import "net/http"
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
+// Node is a virtual node. Its successor, predecessor, successor list and fingers change while the
+// maintenance loops and the handlers run, so they are only read and written through the methods
+// below, under mu. The addresses and finger entries are replaced, never changed in place, so what
+// the methods return can be used after the lock is released.
 type Node struct {
-	Id            int            `json:"id"`
+	mu            sync.RWMutex
+	Id            ID             `json:"id"`
 	FingerTable   []*FingerEntry `json:"finger_table"`
 	SuccessorID   *NodeAddress   `json:"successorID"`
 	PredecessorID *NodeAddress   `json:"predecessorID"`
 	Address       string         `json:"address"`
+	Successors    []*NodeAddress `json:"successors"` // The next servers in the ring, which store replicas of the keys of the node
+	nextFinger    int            // The finger fixFingers refreshes next
+}
+
+func (n *Node) successor() *NodeAddress {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.SuccessorID
+}
+
+func (n *Node) setSuccessor(successor *NodeAddress) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.SuccessorID = successor
+}
+
+func (n *Node) predecessor() *NodeAddress {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.PredecessorID
+}
+
+func (n *Node) setPredecessor(predecessor *NodeAddress) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.PredecessorID = predecessor
+}
+
+// replicas returns the successor list of the node
+func (n *Node) replicas() []*NodeAddress {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.Successors
+}
+
+// fingers returns a copy of the finger table
+func (n *Node) fingers() []*FingerEntry {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return append([]*FingerEntry{}, n.FingerTable...)
+}
+
+func (n *Node) setFinger(i int, successor *NodeAddress) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.FingerTable[i] = &FingerEntry{Start: n.Id.addPowerOfTwo(i), SuccessorID: successor}
 }
 
 type FingerEntry struct {
-	Start       int          `json:"start"`
+	Start       ID           `json:"start"`
 	SuccessorID *NodeAddress `json:"successorID"`
 }
 
 type NodeAddress struct {
-	Id      int    `json:"id"`
+	Id      ID     `json:"id"`
 	Address string `json:"address"`
 }
 
 type Server struct {
 	hostname string
 	port     string
-	node     *Node
+	nodes    []*Node // Virtual nodes hosted by this server, sorted by ID
 	server   *http.Server
-	storage  map[string]string
-	crashed  bool
+	handler  http.Handler
+	storage  *Storage
+	crashed  atomic.Bool // Set while a simulated crash lasts, read by every handler and maintenance loop
+
+	// transport carries requests to other nodes, normally over the network
+	transport http.RoundTripper
+
+	// send delivers a one-way message to another node. Messages are sent right away if it is nil.
+	send func(message func())
+
+	// log is where the server reports what it does, and clock tells the time of new versions.
+	// A simulation replaces both, to hide the output of its servers and run on virtual time.
+	log   io.Writer
+	clock func() time.Time
+
+	stabilizeLoop *maintenanceLoop
+	fingerLoop    *maintenanceLoop
+	antiEntropy   *antiEntropy
+	hints         *hintStore
+	expiryLoop    *maintenanceLoop
+	chunkGCLoop   *maintenanceLoop
+	chunkUses     *chunkUses
+	watches       *watchHub // Watches of the keys owned by this server, for relays
+	relays        *relayHub // Watches that clients opened on this server
 }
 
-var serverInstance *Server
 var keyIdentifierSpace int
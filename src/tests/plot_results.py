@@ -2,7 +2,9 @@
 """
 
 from collections import defaultdict
+import csv
 import os
+import sys
 import matplotlib.pyplot as plt
 
 
@@ -111,8 +113,104 @@ def make_plot(
     plt.close()
 
 
+def read_benchmark(file: str) -> dict:
+    """Reads the CSV results of the Go load generator (src/LoadGenerator).
+    Several runs with the same number of nodes are averaged.
+
+    Args:
+        file (str): Path to the CSV file.
+
+    Returns:
+        dict: For each operation (put, get, all), a dictionary from the number of nodes
+        to the averaged throughput and latency percentiles.
+    """
+    columns = ["throughput", "p50_ms", "p95_ms", "p99_ms", "errors"]
+    runs = defaultdict(list)
+
+    with open(file, "r", encoding="utf-8") as f:
+        for row in csv.DictReader(f):
+            if row["nodes"] == "nodes":
+                continue
+            runs[(row["operation"], int(row["nodes"]))].append(row)
+
+    results = defaultdict(dict)
+    for (operation, nodes), rows in runs.items():
+        results[operation][nodes] = {
+            column: round(sum(float(row[column]) for row in rows) / len(rows), 2)
+            for column in columns
+        }
+
+    return results
+
+
+def make_benchmark_plot(results: dict, filename: str = "benchmark_plot.pdf") -> None:
+    """Plots the throughput and the p50/p95/p99 latency of every operation
+    against the number of nodes. Plots are saved in a PDF file.
+
+    Args:
+        results (dict): The results as returned by read_benchmark.
+        filename (str, optional): Where to store plot. Defaults to 'benchmark_plot.pdf'.
+
+    Raises:
+        ValueError: If there is no data to plot.
+    """
+    if len(results) == 0:
+        print("No data to plot.")
+        raise ValueError("No data to plot.")
+
+    colors = {"put": "orange", "get": "blue", "all": "gray"}
+    _, (throughput_ax, latency_ax) = plt.subplots(1, 2, figsize=(12, 5))
+
+    for operation, stats in results.items():
+        nodes = sorted(stats)
+        color = colors.get(operation, "black")
+
+        throughput_ax.plot(
+            nodes,
+            [stats[node]["throughput"] for node in nodes],
+            "-o",
+            color=color,
+            label=operation.upper(),
+        )
+
+        if operation == "all":
+            continue
+        for column, style in [("p50_ms", "-o"), ("p95_ms", "--s"), ("p99_ms", ":^")]:
+            latency_ax.plot(
+                nodes,
+                [stats[node][column] for node in nodes],
+                style,
+                color=color,
+                label=f"{operation.upper()} {column.split('_')[0]}",
+            )
+
+    throughput_ax.set_xlabel("Number of nodes")
+    throughput_ax.set_ylabel("Throughput (requests/s)")
+    throughput_ax.set_title("Throughput")
+    throughput_ax.grid()
+    throughput_ax.legend()
+
+    latency_ax.set_xlabel("Number of nodes")
+    latency_ax.set_ylabel("Latency (ms)")
+    latency_ax.set_title("Latency percentiles")
+    latency_ax.grid()
+    latency_ax.legend()
+
+    plt.tight_layout()
+    plt.savefig(filename, format="pdf")
+    plt.close()
+
+
 if __name__ == "__main__":
 
+    # Results of the Go load generator, e.g. python plot_results.py results.csv
+    if len(sys.argv) > 1:
+        benchmark = read_benchmark(sys.argv[1])
+        for op, op_stats in benchmark.items():
+            print(f"{op.upper()}: {dict(op_stats)}")
+        make_benchmark_plot(benchmark)
+        sys.exit(0)
+
     PUT_LOG_FILE = "tests/PUT_ALL_log.txt"
     GET_LOG_FILE = "tests/GET_ALL_log.txt"
 
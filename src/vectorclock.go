@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Conflict modes: how replicas settle concurrent writes of a key
+const (
+	conflictLWW         = "lww"    // The write with the highest version wins
+	conflictVectorClock = "vclock" // Concurrent writes are kept as siblings
+)
+
+// contextHeader carries the causal context of a key between clients and nodes
+const contextHeader = "X-Context"
+
+func vectorClocks() bool {
+	return *conflictMode == conflictVectorClock
+}
+
+// VectorClock counts the writes of a key seen from every node, by node ID
+type VectorClock map[string]int64
+
+// join returns a clock that has seen everything either clock has seen
+func (vc VectorClock) join(other VectorClock) VectorClock {
+	joined := make(VectorClock, len(vc)+len(other))
+	for node, counter := range vc {
+		joined[node] = counter
+	}
+	for node, counter := range other {
+		if counter > joined[node] {
+			joined[node] = counter
+		}
+	}
+	return joined
+}
+
+// Sibling is one version of a key in the vector clock mode. It was written by Node as its
+// Counter-th write, and replaces the versions seen by Clock, the context the client sent.
+type Sibling struct {
+	Value   []byte      `json:"value"`
+	Meta    *Metadata   `json:"meta,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+	Node    string      `json:"node"`
+	Counter int64       `json:"counter"`
+	Clock   VectorClock `json:"clock,omitempty"`
+}
+
+// supersededBy reports whether other was written by a client that had seen sib
+func (sib *Sibling) supersededBy(other *Sibling) bool {
+	return other.Clock[sib.Node] >= sib.Counter
+}
+
+func (sib *Sibling) sameWrite(other *Sibling) bool {
+	return sib.Node == other.Node && sib.Counter == other.Counter
+}
+
+// mergeSiblings returns the siblings of a and b that no other sibling supersedes, each write once, in a fixed order
+func mergeSiblings(a, b []*Sibling) []*Sibling {
+
+	all := append(append([]*Sibling{}, a...), b...)
+	merged := []*Sibling{}
+
+	for i, sib := range all {
+		keep := true
+		for j, other := range all {
+			if sib.supersededBy(other) || (j < i && sib.sameWrite(other)) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			merged = append(merged, sib)
+		}
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].Node != merged[j].Node {
+			return merged[i].Node < merged[j].Node
+		}
+		return merged[i].Counter < merged[j].Counter
+	})
+	return merged
+}
+
+// context returns the clock of everything the record has seen: the writes of its siblings and what they replaced
+func (r *Record) context() VectorClock {
+	clock := VectorClock{}
+	if r == nil {
+		return clock
+	}
+	for _, sib := range r.Siblings {
+		clock = clock.join(sib.Clock).join(VectorClock{sib.Node: sib.Counter})
+	}
+	return clock
+}
+
+func encodeContext(clock VectorClock) string {
+	jsonData, _ := json.Marshal(clock)
+	return base64.RawURLEncoding.EncodeToString(jsonData)
+}
+
+// requestContext returns the causal context sent with a request, or nil if there is none
+func requestContext(r *http.Request) (VectorClock, error) {
+
+	encoded := r.Header.Get(contextHeader)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	jsonData, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %v", contextHeader, err)
+	}
+	var clock VectorClock
+	if err := json.Unmarshal(jsonData, &clock); err != nil {
+		return nil, fmt.Errorf("invalid %s header: %v", contextHeader, err)
+	}
+	return clock, nil
+}
+
+// newSibling returns a record with one new sibling of key written by owner, which replaces the versions seen by context
+func (s *Server) newSibling(owner *Node, value []byte, deleted bool, latest *Record, context VectorClock) *Record {
+
+	node := owner.Id.String()
+
+	// Counters are unique per node even if the owner missed some of its own writes, like versions in newRecord
+	counter := s.clock().UnixNano()
+	if known := latest.context().join(context)[node]; counter <= known {
+		counter = known + 1
+	}
+
+	sib := &Sibling{Value: value, Deleted: deleted, Node: node, Counter: counter, Clock: context}
+	return &Record{Siblings: []*Sibling{sib}}
+}
+
+// writeSiblings answers a GET in the vector clock mode. A single value is returned as is, several
+// concurrent values with 300 Multiple Choices and a JSON list. Both carry the causal context in
+// the X-Context header, which a PUT sends back to replace the values it has seen.
+func writeSiblings(w http.ResponseWriter, record *Record) {
+
+	context := encodeContext(record.context())
+	w.Header().Set(contextHeader, context)
+
+	var live []*Sibling
+	for _, sib := range record.Siblings {
+		if !sib.Deleted {
+			live = append(live, sib)
+		}
+	}
+
+	if len(live) == 1 {
+		writeMetadata(w, live[0].Meta)
+		w.WriteHeader(http.StatusOK)
+		w.Write(live[0].Value)
+		return
+	}
+
+	// Values are shown as text, or base64 encoded if they are binary
+	type siblingValue struct {
+		Value interface{} `json:"value"`
+		*Sibling
+	}
+	data := struct {
+		Context  string          `json:"context"`
+		Siblings []*siblingValue `json:"siblings"`
+	}{Context: context}
+	for _, sib := range live {
+		data.Siblings = append(data.Siblings, &siblingValue{Value: displayValue(sib.Value), Sibling: sib})
+	}
+
+	jsonData, _ := json.MarshalIndent(data, "", "\t")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultipleChoices)
+	w.Write(jsonData)
+}
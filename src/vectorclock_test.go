@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// writes describes siblings as node:counter, in order
+func writes(siblings []*Sibling) string {
+	description := ""
+	for i, sib := range siblings {
+		if i > 0 {
+			description += " "
+		}
+		description += fmt.Sprintf("%s:%d", sib.Node, sib.Counter)
+	}
+	return description
+}
+
+func TestMergeSiblings(t *testing.T) {
+
+	a1 := &Sibling{Node: "a", Counter: 1}
+	a2 := &Sibling{Node: "a", Counter: 2, Clock: VectorClock{"a": 1}}
+	b1 := &Sibling{Node: "b", Counter: 1}
+	b2 := &Sibling{Node: "b", Counter: 2, Clock: VectorClock{"a": 2, "b": 1}}
+	c1 := &Sibling{Node: "c", Counter: 1, Clock: VectorClock{"a": 1}}
+
+	tests := []struct {
+		name string
+		a, b []*Sibling
+		want string
+	}{
+		{"empty", nil, nil, ""},
+		{"one side", []*Sibling{a1}, nil, "a:1"},
+		{"concurrent writes are kept", []*Sibling{b1}, []*Sibling{a1}, "a:1 b:1"},
+		{"a write replaces what its client had seen", []*Sibling{a1}, []*Sibling{a2}, "a:2"},
+		{"a write replaces several siblings", []*Sibling{a2, b1}, []*Sibling{b2}, "b:2"},
+		{"only the seen sibling is replaced", []*Sibling{a1, b1}, []*Sibling{c1}, "b:1 c:1"},
+		{"the same write is kept once", []*Sibling{a1, b1}, []*Sibling{b1, a1}, "a:1 b:1"},
+	}
+	for _, test := range tests {
+		if got := writes(mergeSiblings(test.a, test.b)); got != test.want {
+			t.Errorf("%s: mergeSiblings(%s, %s) = %q, want %q", test.name, writes(test.a), writes(test.b), got, test.want)
+		}
+		if got := writes(mergeSiblings(test.b, test.a)); got != test.want {
+			t.Errorf("%s: mergeSiblings(%s, %s) = %q, want %q", test.name, writes(test.b), writes(test.a), got, test.want)
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchBuffer is how many events a watcher may fall behind before its stream is closed
+const watchBuffer = 256
+
+// WatchEvent is a change of a watched key. Type is put, delete or expire for changes,
+// and owner when the watch starts following another server. Relays also get ring events,
+// when the ring changed at the server they read from, which are not passed on to clients.
+type WatchEvent struct {
+	Type    string      `json:"type"`
+	Key     string      `json:"key,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+	Version int64       `json:"version,omitempty"`
+	Node    string      `json:"node"` // Address of the server that owns the key
+	Time    time.Time   `json:"time"`
+}
+
+// watcher receives the events of one key, or of all keys with a prefix
+type watcher struct {
+	key    string
+	prefix bool
+	events chan *WatchEvent
+}
+
+func (wt *watcher) matches(key string) bool {
+	if wt.prefix {
+		return strings.HasPrefix(key, wt.key)
+	}
+	return key == wt.key
+}
+
+// watchHub holds the watchers of the keys owned by this server
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+}
+
+func (hub *watchHub) subscribe(key string, prefix bool) *watcher {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	wt := &watcher{key: key, prefix: prefix, events: make(chan *WatchEvent, watchBuffer)}
+	hub.watchers[wt] = true
+	return wt
+}
+
+func (hub *watchHub) unsubscribe(wt *watcher) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.watchers[wt] {
+		delete(hub.watchers, wt)
+		close(wt.events)
+	}
+}
+
+// publish sends an event to the matching watchers, or to every watcher for a ring event
+func (hub *watchHub) publish(event *WatchEvent) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for wt := range hub.watchers {
+		if event.Type == "ring" || wt.matches(event.Key) {
+			hub.send(wt, event)
+		}
+	}
+}
+
+// send passes an event to a watcher. A watcher that fell too far behind is dropped, which ends
+// its stream, so the client can reconnect instead of missing events. The lock must be held.
+func (hub *watchHub) send(wt *watcher, event *WatchEvent) {
+	select {
+	case wt.events <- event:
+	default:
+		delete(hub.watchers, wt)
+		close(wt.events)
+		metrics.inc("watch_overflows")
+	}
+}
+
+func (hub *watchHub) empty() bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return len(hub.watchers) == 0
+}
+
+// watchEvent returns the event of a change of key to record, seen by this server
+func (s *Server) watchEvent(key string, record *Record) *WatchEvent {
+
+	event := &WatchEvent{Type: "delete", Key: key, Version: record.Version, Node: s.nodes[0].Address, Time: s.clock()}
+	if record.live(s.clock()) {
+		event.Type = "put"
+		event.Value = record.contents()
+	} else if record.Expired {
+		event.Type = "expire"
+	}
+	return event
+}
+
+// keyChanged is called by the storage after the record of key changed, and tells the
+// watchers if one of the virtual nodes of this server owns the key
+func (s *Server) keyChanged(key string, record *Record) {
+
+	if s.watches.empty() || strings.HasPrefix(key, chunkPrefix) || s.ownerOf(hash(key)) == nil {
+		return
+	}
+	s.watches.publish(s.watchEvent(key, record))
+}
+
+// missedEvents returns the events of the watched keys owned by this server whose records are newer
+// than since, for a relay that resumes where the relay from another owner stopped. Versions are
+// only ordered in the LWW conflict mode, so nothing is resumed in the vector clock mode.
+func (s *Server) missedEvents(key string, prefix bool, since int64) []*WatchEvent {
+
+	include := func(k string, record *Record) bool {
+		return (k == key || prefix) && record.Version > since && !strings.HasPrefix(k, chunkPrefix) && s.ownerOf(hash(k)) != nil
+	}
+	keys, records := s.storage.scan(key, "", math.MaxInt, include)
+
+	events := make([]*WatchEvent, len(keys))
+	for i, k := range keys {
+		events[i] = s.watchEvent(k, records[i])
+	}
+	return events
+}
+
+// writeEvent writes an event to a stream of Server-Sent Events
+func writeEvent(w http.ResponseWriter, event *WatchEvent) {
+	jsonData, _ := json.Marshal(event)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, jsonData)
+}
+
+// watchHandler streams the changes of a key, GET /watch/<key>, or of all keys with a prefix,
+// GET /watch?prefix=<prefix>, as Server-Sent Events. The node the client talks to relays the
+// events from the servers that own the keys, see relayWatch. With ?local=true, only the events of
+// keys owned by this server are sent, which is what the relays ask for. ?since=<version> first
+// sends the current records of those keys that are newer than version.
+func (s *Server) watchHandler(w http.ResponseWriter, r *http.Request) {
+
+	if s.crashed.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/watch"), "/")
+	prefix := query.Get("prefix")
+	if key != "" && prefix != "" {
+		http.Error(w, "Watch either a key or a prefix", http.StatusBadRequest)
+		return
+	}
+	watchPrefix := key == ""
+	if watchPrefix {
+		key = prefix
+	}
+
+	var since int64
+	if text := query.Get("since"); text != "" {
+		var err error
+		if since, err = strconv.ParseInt(text, 10, 64); err != nil {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var events <-chan *WatchEvent
+	var missed []*WatchEvent
+	ctx := r.Context()
+
+	if query.Get("local") == "true" {
+		// Subscribed first, so no change is lost between the missed events and the stream
+		wt := s.watches.subscribe(key, watchPrefix)
+		defer s.watches.unsubscribe(wt)
+		events = wt.events
+		if query.Has("since") {
+			missed = s.missedEvents(key, watchPrefix, since)
+		}
+	} else {
+		group, wt := s.relays.subscribe(s, watchTarget{key: key, prefix: watchPrefix}, r.Header.Get("Authorization"))
+		defer s.relays.unsubscribe(group, wt)
+		events = wt.events
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range missed {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	metrics.inc("watches_started")
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			writeEvent(w, event)
+		}
+		flusher.Flush()
+	}
+}
+
+// watchTarget is what a watch follows: a key, or all keys with a prefix
+type watchTarget struct {
+	key    string
+	prefix bool
+}
+
+// relayHub holds the watches that clients opened on this server. The watches of the same key or
+// prefix form a group, which gets the events from one relay per server that owns the keys.
+type relayHub struct {
+	mu     sync.Mutex
+	groups map[watchTarget]*relayGroup
+}
+
+// relayGroup is the watches of one key or prefix, together with what their relays have passed on
+type relayGroup struct {
+	target   watchTarget
+	watchers *watchHub
+	cancel   context.CancelFunc
+	resolve  chan struct{} // Asks for the owners to be found again after the ring changed
+
+	mu    sync.Mutex
+	owner string           // The server that owns a watched key, for the owner event of new watches
+	seen  map[string]int64 // The latest version passed on of every key
+	since int64            // The latest version passed on of any key, where a new relay resumes
+}
+
+// subscribe adds a watch of target to its group, and starts the relays of the group if it is new.
+// The relays pass on the token of the client that started the group, every client of the group
+// was let in by this server already.
+func (hub *relayHub) subscribe(s *Server, target watchTarget, credentials string) (*relayGroup, *watcher) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	group := hub.groups[target]
+	if group == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		group = &relayGroup{
+			target:   target,
+			watchers: &watchHub{watchers: make(map[*watcher]bool)},
+			cancel:   cancel,
+			resolve:  make(chan struct{}, 1),
+			seen:     make(map[string]int64),
+			since:    s.clock().UnixNano(),
+		}
+		hub.groups[target] = group
+		go s.relayWatch(ctx, group, credentials)
+	}
+
+	wt := group.watchers.subscribe(target.key, target.prefix)
+	group.mu.Lock()
+	if group.owner != "" {
+		wt.events <- &WatchEvent{Type: "owner", Key: target.key, Node: group.owner, Time: s.clock()}
+	}
+	group.mu.Unlock()
+	return group, wt
+}
+
+// unsubscribe removes a watch from its group, and stops the relays of the group with its last watch
+func (hub *relayHub) unsubscribe(group *relayGroup, wt *watcher) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	group.watchers.unsubscribe(wt)
+	if group.watchers.empty() && hub.groups[group.target] == group {
+		group.cancel()
+		delete(hub.groups, group.target)
+	}
+}
+
+// ringChanged asks every group to find the owners of its keys again
+func (hub *relayHub) ringChanged() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for _, group := range hub.groups {
+		group.ringChanged()
+	}
+}
+
+func (group *relayGroup) ringChanged() {
+	select {
+	case group.resolve <- struct{}{}:
+	default:
+	}
+}
+
+// relay passes an event on to the watches of the group, unless it was passed on already, e.g. by
+// the relay from the previous owner of the key or by a relay that resumed
+func (group *relayGroup) relay(event *WatchEvent) {
+	group.mu.Lock()
+	if event.Version != 0 && event.Version <= group.seen[event.Key] {
+		group.mu.Unlock()
+		return
+	}
+	group.seen[event.Key] = event.Version
+	group.since = max(group.since, event.Version)
+	group.mu.Unlock()
+
+	group.watchers.publish(event)
+}
+
+// follow tells the watches of a key that another server owns it
+func (group *relayGroup) follow(address string, now time.Time) {
+	group.mu.Lock()
+	group.owner = address
+	group.mu.Unlock()
+
+	group.watchers.publish(&WatchEvent{Type: "owner", Key: group.target.key, Node: address, Time: now})
+}
+
+// resumeFrom returns the version a new relay of the group resumes after
+func (group *relayGroup) resumeFrom() int64 {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	return group.since
+}
+
+// relayWatch relays the events of the watched keys of a group from the servers that own them, until
+// ctx is done. The owners are found again when the ring changes here or at one of the owners, and
+// while the ring is still settling after that, less often the longer the owners stay the same.
+// A relay from a new owner resumes where the group left off, so the writes made while the watch
+// switches owners are passed on as well.
+func (s *Server) relayWatch(ctx context.Context, group *relayGroup, credentials string) {
+
+	relays := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range relays {
+			cancel()
+		}
+	}()
+
+	ended := make(chan string, 1)
+	backoff := newAdaptiveInterval(time.Second, *maxStabilizeInterval)
+	changed := true
+
+	for {
+		owners, settled := s.watchOwners(group.target.key, group.target.prefix)
+
+		for address, cancel := range relays {
+			if !owners[address] {
+				cancel()
+				delete(relays, address)
+				changed = true
+			}
+		}
+		for address := range owners {
+			if relays[address] != nil {
+				continue
+			}
+			changed = true
+			relayCtx, cancel := context.WithCancel(ctx)
+			relays[address] = cancel
+			if !group.target.prefix {
+				group.follow(address, s.clock())
+			}
+			go func(address string) {
+				s.relayFrom(relayCtx, group, address, credentials)
+				select {
+				case ended <- address:
+				case <-relayCtx.Done():
+				}
+			}(address)
+		}
+
+		var retry <-chan time.Time
+		if !settled {
+			retry = time.After(backoff.next(changed))
+		}
+		changed = false
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-group.resolve:
+			changed = true
+		case <-retry:
+		case address := <-ended:
+			// The server went away or dropped the stream, so its relay is started again after checking the owners
+			if cancel := relays[address]; cancel != nil {
+				cancel()
+				delete(relays, address)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// watchOwners returns the addresses of the servers that own the watched keys: the owner of
+// the key, or every server of the ring for a prefix, since the keys of a prefix are spread over the ring.
+// Also reports whether the ring walk found the ring settled where the watched keys are, see settledWithin.
+func (s *Server) watchOwners(key string, prefix bool) (map[string]bool, bool) {
+
+	owners := make(map[string]bool)
+	report := s.walkRing(s.nodes[0].address())
+	members := report.Members
+
+	if prefix {
+		for _, member := range members {
+			owners[member.Address] = true
+		}
+		return owners, report.settledWithin(keyRange{})
+	}
+
+	id := hash(key)
+	for i, member := range members {
+		previous := members[(i+len(members)-1)%len(members)]
+		if len(members) == 1 || isBetweenInclusive(previous.Id, id, member.Id) {
+			owners[member.Address] = true
+			return owners, report.settledWithin(keyRange{start: previous.Id, end: member.Id})
+		}
+	}
+	return owners, false
+}
+
+// settledWithin reports whether the ring walk found the ring closed and the nodes in kr without
+// wrong predecessors or joining nodes, so the owners of the keys in kr are known. Problems elsewhere
+// on the ring do not count, nor do fingers or dead nodes the closed ring no longer reaches,
+// since they do not decide who owns a key.
+func (report *RingReport) settledWithin(kr keyRange) bool {
+
+	if !report.Closed {
+		return false
+	}
+	for _, problem := range report.Problems {
+		switch problem.Kind {
+		case "finger", "unreachable":
+		case "order":
+			return false
+		default:
+			if problem.Node == nil || kr.contains(problem.Node.Id) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// relayFrom reads the local events of a server, resuming after the latest version the group has
+// passed on, and relays them to the group until the stream ends or ctx is done
+func (s *Server) relayFrom(ctx context.Context, group *relayGroup, address, credentials string) {
+
+	key, since := group.target.key, strconv.FormatInt(group.resumeFrom(), 10)
+	endpoint := "watch/" + url.PathEscape(key) + "?local=true&since=" + since
+	if group.target.prefix {
+		endpoint = "watch?local=true&since=" + since + "&prefix=" + url.QueryEscape(key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+"/"+endpoint, nil)
+	if err != nil {
+		return
+	}
+
+	// Pass the client's token on, in case the ring is not using signed requests
+	req.Header.Set("Authorization", credentials)
+
+	resp, err := s.newClient(0).Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event WatchEvent
+		if json.Unmarshal([]byte(data), &event) != nil {
+			continue
+		}
+		if event.Type == "ring" {
+			group.ringChanged()
+			continue
+		}
+		group.relay(&event)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
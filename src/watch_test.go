@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of a watch that is not an owner event
+func nextEvent(t *testing.T, wt *watcher) *WatchEvent {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event, ok := <-wt.events:
+			if !ok {
+				t.Fatal("watch closed")
+			}
+			if event.Type != "owner" {
+				return event
+			}
+		case <-timeout:
+			t.Fatal("no event within 10s")
+		}
+	}
+}
+
+func TestRelayGroupDropsEventsPassedOn(t *testing.T) {
+
+	group := &relayGroup{watchers: &watchHub{watchers: make(map[*watcher]bool)}, seen: make(map[string]int64)}
+	wt := group.watchers.subscribe("", true)
+
+	for _, event := range []*WatchEvent{
+		{Type: "put", Key: "a", Version: 2},
+		{Type: "put", Key: "a", Version: 2}, // Again from the relay of the next owner
+		{Type: "put", Key: "a", Version: 1}, // Older, from a relay that resumed
+		{Type: "put", Key: "b", Version: 1},
+		{Type: "delete", Key: "a", Version: 3},
+		{Type: "put", Key: "c", Version: 0}, // Versions of the vector clock mode are not ordered
+		{Type: "put", Key: "c", Version: 0},
+	} {
+		group.relay(event)
+	}
+
+	var got []string
+	for len(wt.events) > 0 {
+		event := <-wt.events
+		got = append(got, event.Type+" "+event.Key)
+	}
+	want := []string{"put a", "put b", "delete a", "put c", "put c"}
+	if len(got) != len(want) {
+		t.Fatalf("relayed %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("relayed %v, want %v", got, want)
+		}
+	}
+	if since := group.resumeFrom(); since != 3 {
+		t.Errorf("a new relay resumes after %d, want 3", since)
+	}
+}
+
+func TestWatchesShareRelays(t *testing.T) {
+	fastMaintenance(t)
+
+	ts := startTestServer(t, 1)
+	defer ts.stop()
+	waitForRing(t, ts, 1)
+
+	target := watchTarget{key: "shared"}
+	first, a := ts.relays.subscribe(ts.Server, target, "")
+	second, b := ts.relays.subscribe(ts.Server, target, "")
+	if first != second {
+		t.Fatalf("two watches of the same key got different relay groups")
+	}
+
+	// The relay connects in the background, so the key is written until it arrives
+	for {
+		send(http.MethodDelete, "http://"+ts.address+"/storage/shared", "")
+		send(http.MethodPut, "http://"+ts.address+"/storage/shared", "value")
+		select {
+		case event := <-a.events:
+			if event.Type == "owner" {
+				continue
+			}
+		case <-time.After(100 * time.Millisecond):
+			continue
+		}
+		break
+	}
+
+	event := nextEvent(t, b)
+	if event.Key != "shared" {
+		t.Errorf("second watch got %+v", event)
+	}
+
+	ts.relays.unsubscribe(first, a)
+	ts.relays.unsubscribe(second, b)
+	ts.relays.mu.Lock()
+	defer ts.relays.mu.Unlock()
+	if len(ts.relays.groups) != 0 {
+		t.Errorf("%d relay groups left after the last watch ended", len(ts.relays.groups))
+	}
+}
+
+func TestSettledWithin(t *testing.T) {
+
+	bits := keyIdentifierSpace
+	keyIdentifierSpace = 16
+	defer func() { keyIdentifierSpace = bits }()
+
+	node := func(id int64) *NodeAddress { return &NodeAddress{Id: newID(id), Address: "127.0.0.1:1"} }
+	watched := keyRange{start: newID(100), end: newID(200)}
+
+	tests := []struct {
+		name    string
+		closed  bool
+		problem *RingProblem
+		settled bool
+	}{
+		{"no problems", true, nil, true},
+		{"ring not closed", false, nil, false},
+		{"wrong finger in the range", true, &RingProblem{Kind: "finger", Node: node(200)}, true},
+		{"dead node only fingers refer to", true, &RingProblem{Kind: "unreachable", Node: node(150)}, true},
+		{"wrong predecessor of the owner", true, &RingProblem{Kind: "predecessor", Node: node(200)}, false},
+		{"wrong predecessor elsewhere", true, &RingProblem{Kind: "predecessor", Node: node(300)}, true},
+		{"node joining in the range", true, &RingProblem{Kind: "not-in-ring", Node: node(150)}, false},
+		{"node joining elsewhere", true, &RingProblem{Kind: "not-in-ring", Node: node(50)}, true},
+		{"ring out of order", true, &RingProblem{Kind: "order", Node: node(50)}, false},
+	}
+	for _, test := range tests {
+		report := &RingReport{Closed: test.closed}
+		if test.problem != nil {
+			report.Problems = append(report.Problems, test.problem)
+		}
+		if settled := report.settledWithin(watched); settled != test.settled {
+			t.Errorf("%s: settled = %v, want %v", test.name, settled, test.settled)
+		}
+		if test.problem != nil && test.problem.Kind != "finger" && test.problem.Kind != "unreachable" && report.settledWithin(keyRange{}) {
+			t.Errorf("%s: a prefix watch, which covers the whole ring, took the ring as settled", test.name)
+		}
+	}
+}